@@ -21,10 +21,20 @@ func (s mockSession) CountTasksForApp(appID string) (int, error) {
 	return 0, nil
 }
 
-func (s mockSession) CreateTask(request TaskRequest) error {
+func (s mockSession) CreateTask(request TaskRequest) (string, error) {
+	return "", nil
+}
+
+func (s mockSession) GetTaskState(taskGUID string) (string, error) {
+	return "", nil
+}
+
+func (s mockSession) TerminateTask(taskGUID string) error {
 	return nil
 }
 
+func (s mockSession) ForgetTask(taskGUID string) {}
+
 func TestNewFactory_Success(t *testing.T) {
 	// Setup
 	numCalls := 0
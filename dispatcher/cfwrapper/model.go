@@ -1,6 +1,7 @@
 package cfwrapper
 
 import (
+	"errors"
 	"net/http"
 
 	cfclient "github.com/venicegeo/go-cfclient"
@@ -13,6 +14,18 @@ type createSessionFunc func(*pzsvc.Session, *FactoryConfig) (CFSession, error)
 // TaskRequest is a rename of cfclient.TaskRequest to reduce imports
 type TaskRequest cfclient.TaskRequest
 
+// States that a CF task can be in, as reported by CFSession.GetTaskState
+const (
+	TaskStatePending   = "PENDING"
+	TaskStateRunning   = "RUNNING"
+	TaskStateSucceeded = "SUCCEEDED"
+	TaskStateFailed    = "FAILED"
+	TaskStateCanceling = "CANCELING"
+)
+
+// ErrTaskNotFound is returned by CFSession.GetTaskState when the backend has no record of the task
+var ErrTaskNotFound = errors.New("task not found")
+
 // FactoryConfig is an expansion of cfclient.FactoryConfig to reduce imports and inject a session creation function
 type FactoryConfig struct {
 	APIAddress        string
@@ -4,15 +4,20 @@ import (
 	"net/url"
 	"strings"
 
+	"github.com/pkg/errors"
 	cfclient "github.com/venicegeo/go-cfclient"
 	"github.com/venicegeo/pzsvc-exec/pzsvc"
 )
 
-// CFSession is an abstraction around the Go CF client library to make its inclusion modular
+// CFSession is an abstraction around the Go CF client library to make its inclusion modular.
+// Other task backends, such as the local process backend, implement it as well.
 type CFSession interface {
 	IsValid() (bool, error)
 	CountTasksForApp(appID string) (int, error)
-	CreateTask(request TaskRequest) error
+	CreateTask(request TaskRequest) (string, error)
+	GetTaskState(taskGUID string) (string, error)
+	TerminateTask(taskGUID string) error
+	ForgetTask(taskGUID string) // Called once the dispatcher no longer needs the state of a finished task
 }
 
 // CFWrappedSession is an implementation of CFSession that wraps an actual cfclient.Client
@@ -62,12 +67,49 @@ func (s wrappedCFSession) CountTasksForApp(appID string) (int, error) {
 	return len(tasks), nil
 }
 
-// CreateTask is a simple wrapper around cfclient.Client.CreateTask
-func (s wrappedCFSession) CreateTask(request TaskRequest) error {
-	_, err := s.Client.CreateTask(cfclient.TaskRequest(request))
-	return err
+// CreateTask is a simple wrapper around cfclient.Client.CreateTask, returning the new task's GUID
+func (s wrappedCFSession) CreateTask(request TaskRequest) (string, error) {
+	task, err := s.Client.CreateTask(cfclient.TaskRequest(request))
+	if err != nil {
+		return "", err
+	}
+	return task.GUID, nil
+}
+
+// GetTaskState returns the CF state (one of the TaskState constants) of the task with the given GUID,
+// or ErrTaskNotFound if CF has no such task
+func (s wrappedCFSession) GetTaskState(taskGUID string) (string, error) {
+	task, err := s.Client.GetTaskByGuid(taskGUID)
+	if isTaskNotFoundError(err) {
+		return "", ErrTaskNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return task.State, nil
 }
 
+// isTaskNotFoundError detects the 404 CF answers for an unknown task, which the v3 API reports
+// in an error list that cfclient does not decode
+func isTaskNotFoundError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if cfclient.IsResourceNotFoundError(err) {
+		return true
+	}
+	cfErr, ok := errors.Cause(err).(cfclient.CloudFoundryError)
+	return ok && strings.Contains(string(cfErr.RawBody), "CF-ResourceNotFound")
+}
+
+// TerminateTask is a simple wrapper around cfclient.Client.TerminateTask
+func (s wrappedCFSession) TerminateTask(taskGUID string) error {
+	return s.Client.TerminateTask(taskGUID)
+}
+
+// ForgetTask does nothing, since CF keeps the record of its tasks itself
+func (s wrappedCFSession) ForgetTask(taskGUID string) {}
+
 func newWrappedCFSession(pzSession *pzsvc.Session, config *FactoryConfig) (CFSession, error) {
 	client, err := cfclient.NewClient(config.CFClientConfig())
 	if err != nil {
@@ -251,7 +251,7 @@ func TestWrappedCFSession_CountTasksForApp_Error(t *testing.T) {
 
 func TestWrappedCFSession_CreateTask_Success(t *testing.T) {
 	// Setup
-	h := newPlainHandler("/v3/apps/test-app-id/tasks", http.StatusOK, []byte(`{}`))
+	h := newPlainHandler("/v3/apps/test-app-id/tasks", http.StatusOK, []byte(`{"guid": "test-task-guid"}`))
 	cfMock, err := setupMockCFHandler(h)
 	if err != nil {
 		panic(err)
@@ -260,10 +260,11 @@ func TestWrappedCFSession_CreateTask_Success(t *testing.T) {
 
 	// Tested code
 	cfSession := wrappedCFSession{PzSession: &pzsvc.Session{}, Client: cfMock.cfClient}
-	err = cfSession.CreateTask(TaskRequest{DropletGUID: "test-app-id"})
+	taskGUID, err := cfSession.CreateTask(TaskRequest{DropletGUID: "test-app-id"})
 
 	// Asserts
 	assert.Nil(t, err)
+	assert.Equal(t, "test-task-guid", taskGUID)
 	assert.Equal(t, 1, *h.calledCount)
 }
 
@@ -278,7 +279,100 @@ func TestWrappedCFSession_CreateTask_Error(t *testing.T) {
 
 	// Tested code
 	cfSession := wrappedCFSession{PzSession: &pzsvc.Session{}, Client: cfMock.cfClient}
-	err = cfSession.CreateTask(TaskRequest{DropletGUID: "test-app-id"})
+	taskGUID, err := cfSession.CreateTask(TaskRequest{DropletGUID: "test-app-id"})
+
+	// Asserts
+	assert.NotNil(t, err)
+	assert.Empty(t, taskGUID)
+	assert.Equal(t, 1, *h.calledCount)
+}
+
+func TestWrappedCFSession_GetTaskState_Success(t *testing.T) {
+	// Setup
+	h := newPlainHandler("/v3/tasks/test-task-guid", http.StatusOK, []byte(`{"guid": "test-task-guid", "state": "FAILED"}`))
+	cfMock, err := setupMockCFHandler(h)
+	if err != nil {
+		panic(err)
+	}
+	defer cfMock.TearDown()
+
+	// Tested code
+	cfSession := wrappedCFSession{PzSession: &pzsvc.Session{}, Client: cfMock.cfClient}
+	state, err := cfSession.GetTaskState("test-task-guid")
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, TaskStateFailed, state)
+	assert.Equal(t, 1, *h.calledCount)
+}
+
+func TestWrappedCFSession_GetTaskState_Error(t *testing.T) {
+	// Setup
+	h := newPlainHandler("/v3/tasks/test-task-guid", http.StatusNotFound, []byte(`{"code": 10010, "error_code": "CF-ResourceNotFound", "description": "..."}}`))
+	cfMock, err := setupMockCFHandler(h)
+	if err != nil {
+		panic(err)
+	}
+	defer cfMock.TearDown()
+
+	// Tested code
+	cfSession := wrappedCFSession{PzSession: &pzsvc.Session{}, Client: cfMock.cfClient}
+	state, err := cfSession.GetTaskState("test-task-guid")
+
+	// Asserts
+	assert.NotNil(t, err)
+	assert.Empty(t, state)
+	assert.Equal(t, 1, *h.calledCount)
+}
+
+func TestWrappedCFSession_GetTaskState_NotFound(t *testing.T) {
+	// Setup
+	h := newPlainHandler("/v3/tasks/test-task-guid", http.StatusNotFound, []byte(`{"errors": [{"code": 10010, "title": "CF-ResourceNotFound", "detail": "Task not found"}]}`))
+	cfMock, err := setupMockCFHandler(h)
+	if err != nil {
+		panic(err)
+	}
+	defer cfMock.TearDown()
+
+	// Tested code
+	cfSession := wrappedCFSession{PzSession: &pzsvc.Session{}, Client: cfMock.cfClient}
+	state, err := cfSession.GetTaskState("test-task-guid")
+
+	// Asserts
+	assert.Equal(t, ErrTaskNotFound, err)
+	assert.Empty(t, state)
+}
+
+func TestWrappedCFSession_TerminateTask_Success(t *testing.T) {
+	// Setup
+	h := newPlainHandler("/v3/tasks/test-task-guid/cancel", http.StatusAccepted, []byte(`{"guid": "test-task-guid", "state": "CANCELING"}`))
+	cfMock, err := setupMockCFHandler(h)
+	if err != nil {
+		panic(err)
+	}
+	defer cfMock.TearDown()
+
+	// Tested code
+	cfSession := wrappedCFSession{PzSession: &pzsvc.Session{}, Client: cfMock.cfClient}
+	err = cfSession.TerminateTask("test-task-guid")
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, 1, *h.calledCount)
+}
+
+func TestWrappedCFSession_TerminateTask_Error(t *testing.T) {
+	// Setup
+	h := newPlainHandler("/v3/tasks/test-task-guid/cancel", http.StatusTeapot, []byte(`{"code": 10418, "error_code": "CF-Teapot", "description": "..."}}`))
+	cfMock, err := setupMockCFHandler(h)
+	if err != nil {
+		panic(err)
+	}
+	defer cfMock.TearDown()
+
+	// Tested code
+	cfSession := wrappedCFSession{PzSession: &pzsvc.Session{}, Client: cfMock.cfClient}
+	err = cfSession.TerminateTask("test-task-guid")
 
 	// Asserts
 	assert.NotNil(t, err)
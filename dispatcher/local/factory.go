@@ -0,0 +1,39 @@
+package local
+
+import (
+	"github.com/venicegeo/pzsvc-exec/dispatcher/cfwrapper"
+	"github.com/venicegeo/pzsvc-exec/pzsvc"
+)
+
+// AppID is the application ID reported by the local backend in place of a CF VCAP application ID
+const AppID = "local"
+
+// Factory is an implementation of cfwrapper.Factory that launches worker tasks
+// as child processes of the dispatcher, rather than as Cloud Foundry tasks
+type Factory struct {
+	pzSession *pzsvc.Session
+	session   *processSession
+}
+
+// NewFactory creates a new factory object for launching local worker processes
+func NewFactory(pzSession *pzsvc.Session) *Factory {
+	return &Factory{
+		pzSession: pzSession,
+		session:   newProcessSession(pzSession),
+	}
+}
+
+// GetSession returns the single process session owned by this factory; local sessions never expire
+func (f *Factory) GetSession() (cfwrapper.CFSession, error) {
+	return f.session, nil
+}
+
+// RefreshCachedClient is a no-op, since there is no remote client to refresh
+func (f *Factory) RefreshCachedClient() error {
+	return nil
+}
+
+// AppID returns the application ID under which local tasks are counted
+func (f *Factory) AppID() string {
+	return AppID
+}
@@ -0,0 +1,40 @@
+package local
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/pzsvc-exec/pzsvc"
+)
+
+func TestNewFactory(t *testing.T) {
+	// Setup
+	pzSession := &pzsvc.Session{}
+
+	// Tested code
+	factory := NewFactory(pzSession)
+
+	// Asserts
+	assert.NotNil(t, factory)
+	assert.Equal(t, pzSession, factory.pzSession)
+	assert.Equal(t, AppID, factory.AppID())
+}
+
+func TestFactory_GetSession(t *testing.T) {
+	// Setup
+	factory := NewFactory(&pzsvc.Session{})
+
+	// Tested code
+	session1, err1 := factory.GetSession()
+	session2, err2 := factory.GetSession()
+	refreshErr := factory.RefreshCachedClient()
+
+	// Asserts
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+	assert.Nil(t, refreshErr)
+	assert.Equal(t, session1, session2) // The same session should keep track of all running tasks
+	valid, err := session1.IsValid()
+	assert.True(t, valid)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,171 @@
+package local
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/venicegeo/pzsvc-exec/dispatcher/cfwrapper"
+	"github.com/venicegeo/pzsvc-exec/pzsvc"
+)
+
+// processTask is the local record of a launched worker process
+type processTask struct {
+	GUID       string
+	Name       string
+	State      string
+	cmd        *exec.Cmd
+	terminated bool
+}
+
+// processSession is an implementation of cfwrapper.CFSession that runs each
+// task command in a local shell and keeps track of the processes it started
+type processSession struct {
+	PzSession *pzsvc.Session
+	mutex     *sync.Mutex
+	tasks     map[string]*processTask
+}
+
+func newProcessSession(pzSession *pzsvc.Session) *processSession {
+	return &processSession{
+		PzSession: pzSession,
+		mutex:     &sync.Mutex{},
+		tasks:     map[string]*processTask{},
+	}
+}
+
+// IsValid always succeeds, since there is no remote connection to lose
+func (s *processSession) IsValid() (bool, error) {
+	return true, nil
+}
+
+// CountTasksForApp returns the number of worker processes that have not exited yet
+func (s *processSession) CountTasksForApp(appID string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := 0
+	for _, task := range s.tasks {
+		if task.State == cfwrapper.TaskStateRunning {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// CreateTask starts the task command as a child process and returns its generated GUID
+// once it has launched.  The disk and memory sizes are passed on to the worker as
+// environment hints, since the local backend has no container to enforce them.
+func (s *processSession) CreateTask(request cfwrapper.TaskRequest) (string, error) {
+	// exec replaces the shell, so that terminating the task signals the worker itself
+	cmd := exec.Command("sh", "-c", "exec "+request.Command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"TASK_NAME="+request.Name,
+		"TASK_DISK_MB="+strconv.Itoa(request.DiskInMegabyte),
+		"TASK_MEMORY_MB="+strconv.Itoa(request.MemoryInMegabyte),
+	)
+
+	taskGUID, err := pzsvc.PsuUUID()
+	if err != nil {
+		return "", err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, task := range s.tasks {
+		if task.Name == request.Name && task.State == cfwrapper.TaskStateRunning {
+			return "", fmt.Errorf("local task %s is already running", request.Name)
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	task := &processTask{GUID: taskGUID, Name: request.Name, State: cfwrapper.TaskStateRunning, cmd: cmd}
+	s.tasks[taskGUID] = task
+	pzsvc.LogInfo(*s.PzSession, fmt.Sprintf("Started local task %s (%s) as pid %d", request.Name, taskGUID, cmd.Process.Pid))
+
+	go s.wait(task)
+	return taskGUID, nil
+}
+
+// GetTaskState returns the state of the local task with the given GUID.  Tasks that
+// have finished are kept, so that their state can be read again, until they are forgotten.
+func (s *processSession) GetTaskState(taskGUID string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	task, ok := s.tasks[taskGUID]
+	if !ok {
+		return "", cfwrapper.ErrTaskNotFound
+	}
+	return task.State, nil
+}
+
+// ForgetTask drops the record of a finished local task
+func (s *processSession) ForgetTask(taskGUID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if task, ok := s.tasks[taskGUID]; ok && task.State != cfwrapper.TaskStateRunning {
+		delete(s.tasks, taskGUID)
+	}
+}
+
+// terminateGracePeriod is how long a worker has to stop its algorithm and exit after SIGTERM,
+// before it is killed.  It is longer than the time the worker gives the algorithm by default.
+var terminateGracePeriod = 30 * time.Second
+
+// TerminateTask sends SIGTERM to the worker process of the local task with the given GUID, and
+// kills it if it has not exited after the grace period.  The worker passes the signal on to the
+// algorithm's process group, which killing the worker alone would leave running.
+func (s *processSession) TerminateTask(taskGUID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	task, ok := s.tasks[taskGUID]
+	if !ok {
+		return errors.New("no local task with GUID " + taskGUID)
+	}
+	if task.State != cfwrapper.TaskStateRunning {
+		return nil
+	}
+	pzsvc.LogInfo(*s.PzSession, "Terminating local task "+task.Name)
+	task.terminated = true
+	if err := task.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		return task.cmd.Process.Kill() // Windows cannot deliver SIGTERM
+	}
+	time.AfterFunc(terminateGracePeriod, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if task.State == cfwrapper.TaskStateRunning {
+			pzsvc.LogInfo(*s.PzSession, "Killing local task "+task.Name+", which did not exit after SIGTERM")
+			task.cmd.Process.Kill()
+		}
+	})
+	return nil
+}
+
+func (s *processSession) wait(task *processTask) {
+	err := task.cmd.Wait()
+
+	s.mutex.Lock()
+	if err != nil {
+		task.State = cfwrapper.TaskStateFailed
+	} else {
+		task.State = cfwrapper.TaskStateSucceeded
+	}
+	if task.terminated {
+		// Nothing reads the state of a terminated task, so its record goes with its process
+		delete(s.tasks, task.GUID)
+	}
+	s.mutex.Unlock()
+
+	if err != nil {
+		pzsvc.LogSimpleErr(*s.PzSession, "Local task "+task.Name+" exited with error: ", err)
+	} else {
+		pzsvc.LogInfo(*s.PzSession, "Local task "+task.Name+" finished")
+	}
+}
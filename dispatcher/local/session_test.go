@@ -0,0 +1,157 @@
+package local
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/pzsvc-exec/dispatcher/cfwrapper"
+	"github.com/venicegeo/pzsvc-exec/pzsvc"
+)
+
+func skipWithoutShell(t *testing.T) {
+	if _, err := exec.Command("sh", "-c", "true").Output(); err != nil {
+		t.Skip("`sh -c` not available on this platform")
+	}
+}
+
+func waitForTaskCount(session *processSession, count int) bool {
+	for i := 0; i < 100; i++ {
+		if n, _ := session.CountTasksForApp(AppID); n == count {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+func TestProcessSession_CreateTask_Success(t *testing.T) {
+	skipWithoutShell(t)
+
+	// Setup
+	tempDir, _ := ioutil.TempDir("", "test_local_task")
+	defer os.RemoveAll(tempDir)
+	outPath := filepath.Join(tempDir, "env.txt")
+	session := newProcessSession(&pzsvc.Session{})
+
+	// Tested code
+	taskGUID, err := session.CreateTask(cfwrapper.TaskRequest{
+		Command:          `echo "$TASK_NAME $TASK_DISK_MB $TASK_MEMORY_MB" > ` + outPath,
+		Name:             "test-job-id",
+		DiskInMegabyte:   1024,
+		MemoryInMegabyte: 2048,
+	})
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.NotEmpty(t, taskGUID)
+	assert.True(t, waitForTaskCount(session, 0))
+	written, _ := ioutil.ReadFile(outPath)
+	assert.Equal(t, "test-job-id 1024 2048\n", string(written))
+	state, err := session.GetTaskState(taskGUID)
+	assert.Nil(t, err)
+	assert.Equal(t, cfwrapper.TaskStateSucceeded, state)
+}
+
+func TestProcessSession_GetTaskState(t *testing.T) {
+	skipWithoutShell(t)
+
+	// Setup
+	session := newProcessSession(&pzsvc.Session{})
+	taskGUID, _ := session.CreateTask(cfwrapper.TaskRequest{Command: "sh -c 'sleep 0.1; exit 3'", Name: "job-a"})
+
+	// Tested code
+	runningState, runningErr := session.GetTaskState(taskGUID)
+	waitForTaskCount(session, 0)
+	failedState, failedErr := session.GetTaskState(taskGUID)
+	againState, _ := session.GetTaskState(taskGUID)
+	session.ForgetTask(taskGUID)
+	_, forgottenErr := session.GetTaskState(taskGUID)
+
+	// Asserts
+	assert.Nil(t, runningErr)
+	assert.Equal(t, cfwrapper.TaskStateRunning, runningState)
+	assert.Nil(t, failedErr)
+	assert.Equal(t, cfwrapper.TaskStateFailed, failedState)
+	assert.Equal(t, cfwrapper.TaskStateFailed, againState) // Kept until the dispatcher forgets it
+	assert.Equal(t, cfwrapper.ErrTaskNotFound, forgottenErr)
+}
+
+func TestProcessSession_CountTasksForApp(t *testing.T) {
+	skipWithoutShell(t)
+
+	// Setup
+	session := newProcessSession(&pzsvc.Session{})
+
+	// Tested code
+	_, errA := session.CreateTask(cfwrapper.TaskRequest{Command: "sleep 0.2", Name: "job-a"})
+	_, errB := session.CreateTask(cfwrapper.TaskRequest{Command: "sleep 0.2", Name: "job-b"})
+	count, countErr := session.CountTasksForApp(AppID)
+
+	// Asserts
+	assert.Nil(t, errA)
+	assert.Nil(t, errB)
+	assert.Nil(t, countErr)
+	assert.Equal(t, 2, count)
+	assert.True(t, waitForTaskCount(session, 0))
+}
+
+func TestProcessSession_CreateTask_DuplicateName(t *testing.T) {
+	skipWithoutShell(t)
+
+	// Setup
+	session := newProcessSession(&pzsvc.Session{})
+	session.CreateTask(cfwrapper.TaskRequest{Command: "sleep 0.2", Name: "job-a"})
+
+	// Tested code
+	_, err := session.CreateTask(cfwrapper.TaskRequest{Command: "sleep 0.2", Name: "job-a"})
+
+	// Asserts
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "already running")
+	assert.True(t, waitForTaskCount(session, 0))
+}
+
+func TestProcessSession_TerminateTask(t *testing.T) {
+	skipWithoutShell(t)
+
+	// Setup
+	session := newProcessSession(&pzsvc.Session{})
+	taskGUID, _ := session.CreateTask(cfwrapper.TaskRequest{Command: "sleep 10", Name: "job-a"})
+
+	// Tested code
+	err := session.TerminateTask(taskGUID)
+	unknownErr := session.TerminateTask("unknown-guid")
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.NotNil(t, unknownErr)
+	assert.True(t, waitForTaskCount(session, 0))
+	_, stateErr := session.GetTaskState(taskGUID)
+	assert.Equal(t, cfwrapper.ErrTaskNotFound, stateErr) // Nothing reads the state of a terminated task, so it is not kept
+}
+
+func TestProcessSession_TerminateTask_Kill(t *testing.T) {
+	skipWithoutShell(t)
+
+	// Setup: the worker ignores SIGTERM, so it is killed after the grace period
+	oldGracePeriod := terminateGracePeriod
+	terminateGracePeriod = 100 * time.Millisecond
+	defer func() { terminateGracePeriod = oldGracePeriod }()
+	session := newProcessSession(&pzsvc.Session{})
+	taskGUID, _ := session.CreateTask(cfwrapper.TaskRequest{Command: `sh -c "trap '' TERM; sleep 2 & wait"`, Name: "job-a"})
+	time.Sleep(100 * time.Millisecond) // Lets the shell set its trap
+
+	// Tested code
+	err := session.TerminateTask(taskGUID)
+
+	// Asserts
+	assert.Nil(t, err)
+	count, _ := session.CountTasksForApp(AppID)
+	assert.Equal(t, 1, count) // Still running, since SIGTERM was ignored
+	assert.True(t, waitForTaskCount(session, 0))
+}
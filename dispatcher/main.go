@@ -17,12 +17,21 @@ package main
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/venicegeo/pzsvc-exec/dispatcher/cfwrapper"
+	"github.com/venicegeo/pzsvc-exec/dispatcher/local"
 	"github.com/venicegeo/pzsvc-exec/dispatcher/poll"
 	"github.com/venicegeo/pzsvc-exec/pzsvc"
 )
@@ -37,19 +46,121 @@ func main() {
 		os.Exit(1)
 	}
 
-	// First argument after the base call should be the path to the config file.
+	// Arguments after the base call are config files, or directories of config files;
+	// each config is a separate service, served by its own polling loop.
+	configPaths, err := findConfigPaths(os.Args[1:])
+	if err != nil {
+		pzsvc.LogSimpleErr(s, "Dispatcher error in finding configs: ", err)
+		return
+	}
+
+	clientFactory := newTaskBackend(&s)
+
+	pollLoops := []*poll.Loop{}
+	for _, configPath := range configPaths {
+		pollLoop, err := newServiceLoop(s, configPath, clientFactory)
+		if err != nil {
+			pzsvc.LogSimpleErr(s, "Dispatcher could not start polling for config "+configPath+": ", err)
+			return
+		}
+		pollLoops = append(pollLoops, pollLoop)
+	}
+
+	// Loops of several services share one app, so the tasks of all of them count towards one global cap
+	if len(pollLoops) > 1 {
+		taskCap := poll.NewTaskCap(getGlobalTaskLimit(pollLoops))
+		pzsvc.LogInfo(s, fmt.Sprintf("Serving %d services, with a global limit of %d tasks", len(pollLoops), taskCap.Limit))
+		for _, pollLoop := range pollLoops {
+			pollLoop.TaskCap = taskCap
+		}
+	}
+
+	// On SIGTERM (such as a CF restage) or interrupt, stop pulling tasks and drain the loops
+	shutdownDone := make(chan bool)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		pzsvc.LogInfo(s, "Received signal "+sig.String()+"; shutting down dispatcher")
+		timeout := getShutdownTimeout()
+		var wg sync.WaitGroup
+		for _, pollLoop := range pollLoops {
+			wg.Add(1)
+			go func(pollLoop *poll.Loop) {
+				defer wg.Done()
+				pollLoop.Shutdown(timeout)
+			}(pollLoop)
+		}
+		wg.Wait()
+		close(shutdownDone)
+	}()
+
+	for _, pollLoop := range pollLoops {
+		go func(pollLoop *poll.Loop, errChan <-chan error) {
+			for err := range errChan {
+				pzsvc.LogSimpleErr(*pollLoop.PzSession, "Polling loop encountered an error on this iteration:: ", err)
+			}
+		}(pollLoop, pollLoop.Start())
+	}
+
+	<-shutdownDone
+	pzsvc.LogInfo(s, "Dispatcher shutdown complete")
+}
+
+// findConfigPaths expands the given paths into the list of config files to serve.  Each
+// path may be a config file, or a directory, in which case every regular, non-hidden
+// file in it is taken as a config, in name order.
+func findConfigPaths(paths []string) ([]string, error) {
+	configPaths := []string{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			configPaths = append(configPaths, path)
+			continue
+		}
+
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if file.Mode().IsRegular() && !strings.HasPrefix(file.Name(), ".") {
+				configPaths = append(configPaths, filepath.Join(path, file.Name()))
+			}
+		}
+	}
+	if len(configPaths) == 0 {
+		return nil, errors.New("no config files found in " + strings.Join(paths, ", "))
+	}
+	return configPaths, nil
+}
+
+// newServiceLoop reads the service config at the given path, finds the service in
+// Piazza, and creates the polling loop that dispatches its jobs.  Each service gets
+// its own copy of the base session, named after the service.
+func newServiceLoop(baseSession pzsvc.Session, configPath string, clientFactory cfwrapper.Factory) (*poll.Loop, error) {
+	s := baseSession
+
 	// ReadFile returns the contents of the file as a byte buffer.
-	configPath := os.Args[1]
 	configBuf, err := ioutil.ReadFile(configPath)
 	if err != nil {
-		pzsvc.LogSimpleErr(s, "Dispatcher error in reading config: ", err)
-		return
+		return nil, fmt.Errorf("error in reading config: %v", err)
 	}
 	var configObj pzsvc.Config
 	err = json.Unmarshal(configBuf, &configObj)
 	if err != nil {
-		pzsvc.LogSimpleErr(s, "Dispatcher error in unmarshalling config: ", err)
-		return
+		return nil, fmt.Errorf("error in unmarshalling config: %v", err)
+	}
+
+	if configObj.SvcName == "" {
+		return nil, errors.New("Config: Cannot work tasks without service name.")
+	}
+	s.SessionID = configObj.SvcName
+	if err = configObj.CheckParamSpecs(); err != nil {
+		return nil, err
 	}
 
 	s.LogAudit = configObj.LogAudit
@@ -67,34 +178,65 @@ func main() {
 		}
 	}
 	if s.PzAddr == "" {
-		pzsvc.LogSimpleErr(s, "Config: Cannot work tasks.  Must have either a valid PzAddr, or a valid and populated PzAddrEnVar.", nil)
-		return
-	}
-
-	if configObj.SvcName == "" {
-		pzsvc.LogSimpleErr(s, "Config: Cannot work tasks without service name.", nil)
-		return
+		return nil, errors.New("Config: Cannot work tasks.  Must have either a valid PzAddr, or a valid and populated PzAddrEnVar.")
 	}
 
 	if configObj.APIKeyEnVar == "" {
-		pzsvc.LogSimpleErr(s, "Config: Cannot work tasks without valid APIKeyEnVar.", nil)
-		return
+		return nil, errors.New("Config: Cannot work tasks without valid APIKeyEnVar.")
 	}
 	apiKey := os.Getenv(configObj.APIKeyEnVar)
 	if apiKey == "" {
-		pzsvc.LogSimpleErr(s, "No API key at APIKeyEnVar.  Cannot work.", nil)
-		return
+		return nil, errors.New("No API key at APIKeyEnVar.  Cannot work.")
 	}
 	s.PzAuth = "Basic " + base64.StdEncoding.EncodeToString([]byte(apiKey+":"))
 
 	// Check for the Service ID. If it exists, then grab the ID. If it doesn't exist, then Register it.
 	svcID, err := newPzSvcDiscoverer().discoverSvcID(&s, &configObj)
 	if err != nil {
-		pzsvc.LogSimpleErr(s, "Dispatcher could not find Piazza Service ID. Error: ", err)
-		return
+		return nil, fmt.Errorf("could not find Piazza Service ID: %v", err)
 	}
 	pzsvc.LogInfo(s, "Found target service.  ServiceID: "+svcID+".")
 
+	pollLoop, err := poll.NewLoop(&s, configObj, svcID, configPath, clientFactory)
+	if err != nil {
+		return nil, fmt.Errorf("error in initializing dispatch polling loop: %v", err)
+	}
+	return pollLoop, nil
+}
+
+// getGlobalTaskLimit returns the cap on the tasks of all services together, from the
+// GLOBAL_TASK_LIMIT env variable.  By default the cap is the sum of the services' own
+// limits, so that only those apply.
+func getGlobalTaskLimit(pollLoops []*poll.Loop) int {
+	if envLimit, err := strconv.Atoi(os.Getenv("GLOBAL_TASK_LIMIT")); envLimit > 0 && err == nil {
+		return envLimit
+	}
+	limit := 0
+	for _, pollLoop := range pollLoops {
+		limit += pollLoop.TaskLimit()
+	}
+	return limit
+}
+
+// getShutdownTimeout returns how long to wait for the polling loop to drain on
+// shutdown, from the SHUTDOWN_TIMEOUT env variable (in seconds).  The default
+// stays under CF's 10 second grace period before it kills the app.
+func getShutdownTimeout() time.Duration {
+	timeout := 8
+	if envTimeout, err := strconv.Atoi(os.Getenv("SHUTDOWN_TIMEOUT")); envTimeout > 0 && err == nil {
+		timeout = envTimeout
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// newTaskBackend creates the factory that worker tasks are launched through.  Tasks
+// run in Cloud Foundry unless TASK_BACKEND selects the local-process backend.
+func newTaskBackend(s *pzsvc.Session) cfwrapper.Factory {
+	if os.Getenv("TASK_BACKEND") == "local" {
+		pzsvc.LogInfo(*s, "Local task backend selected. Beginning Polling.")
+		return local.NewFactory(s)
+	}
+
 	// Initialize the CF Client
 	clientConfig := &cfwrapper.FactoryConfig{
 		APIAddress: os.Getenv("CF_API"),
@@ -104,17 +246,8 @@ func main() {
 	//Set a timout, otherwise cfclient will use the default 0/infinite value.
 	clientConfig.HTTPClient = http.DefaultClient
 	clientConfig.HTTPClient.Timeout = 2 * time.Minute
-	clientFactory := cfwrapper.NewFactory(&s, clientConfig)
+	clientFactory := cfwrapper.NewFactory(s, clientConfig)
 
-	pzsvc.LogInfo(s, "Cloud Foundry Client initialized. Beginning Polling.")
-
-	pollLoop, err := poll.NewLoop(&s, configObj, svcID, configPath, clientFactory)
-	if err != nil {
-		pzsvc.LogSimpleErr(s, "Error in initializing dispatch polling loop: ", err)
-		return
-	}
-
-	for err = range pollLoop.Start() {
-		pzsvc.LogSimpleErr(s, "Polling loop encountered an error on this iteration:: ", err)
-	}
+	pzsvc.LogInfo(*s, "Cloud Foundry Client initialized. Beginning Polling.")
+	return clientFactory
 }
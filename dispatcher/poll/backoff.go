@@ -0,0 +1,57 @@
+package poll
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// pollBackoff tracks how far the polling interval has backed off.  Each idle or
+// failed iteration doubles the interval, up to a maximum; any sign of work
+// resets it to the fast interval.
+type pollBackoff struct {
+	mutex *sync.Mutex
+	level uint
+}
+
+func newPollBackoff() *pollBackoff {
+	return &pollBackoff{mutex: &sync.Mutex{}}
+}
+
+// Reset returns the polling interval to its fastest setting
+func (b *pollBackoff) Reset() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.level = 0
+}
+
+// Increase doubles the polling interval for the next iteration
+func (b *pollBackoff) Increase() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.level < 30 { // More doubling than this would overflow the duration
+		b.level++
+	}
+}
+
+// Delay returns how long to wait before the next iteration, given the fastest
+// and slowest allowed intervals.  Backed-off delays are jittered so that many
+// dispatchers do not hit Piazza in lockstep.
+func (b *pollBackoff) Delay(min, max time.Duration) time.Duration {
+	b.mutex.Lock()
+	level := b.level
+	b.mutex.Unlock()
+
+	if level == 0 || max <= min {
+		return min
+	}
+	delay := min << level
+	if delay > max || delay <= 0 {
+		delay = max
+	}
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	if delay < min {
+		delay = min
+	}
+	return delay
+}
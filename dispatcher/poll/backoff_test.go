@@ -0,0 +1,52 @@
+package poll
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPollBackoff_Reset(t *testing.T) {
+	// Setup
+	backoff := newPollBackoff()
+	backoff.Increase()
+	backoff.Increase()
+
+	// Tested code
+	backoff.Reset()
+
+	// Asserts
+	assert.Equal(t, 5*time.Second, backoff.Delay(5*time.Second, time.Minute))
+}
+
+func TestPollBackoff_Increase(t *testing.T) {
+	// Setup
+	backoff := newPollBackoff()
+
+	// Tested code
+	backoff.Increase()
+	first := backoff.Delay(5*time.Second, time.Minute)
+	backoff.Increase()
+	second := backoff.Delay(5*time.Second, time.Minute)
+
+	// Asserts
+	assert.True(t, first >= 5*time.Second && first <= 10*time.Second, "first backoff delay was %v", first)
+	assert.True(t, second >= 10*time.Second && second <= 20*time.Second, "second backoff delay was %v", second)
+}
+
+func TestPollBackoff_Bounded(t *testing.T) {
+	// Setup
+	backoff := newPollBackoff()
+
+	// Tested code
+	for i := 0; i < 100; i++ {
+		backoff.Increase()
+	}
+	delay := backoff.Delay(5*time.Second, time.Minute)
+	noBackoffDelay := backoff.Delay(5*time.Second, 5*time.Second)
+
+	// Asserts
+	assert.True(t, delay >= 30*time.Second && delay <= time.Minute, "bounded backoff delay was %v", delay)
+	assert.Equal(t, 5*time.Second, noBackoffDelay)
+}
@@ -4,22 +4,31 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/venicegeo/pzsvc-exec/dispatcher/cfwrapper"
 	"github.com/venicegeo/pzsvc-exec/dispatcher/model"
 	"github.com/venicegeo/pzsvc-exec/pzsvc"
+	"github.com/venicegeo/pzsvc-exec/worker/config"
+	"github.com/venicegeo/pzsvc-exec/worker/input"
 )
 
 var defaultTaskDiskMB = 6142
 var defaultTaskMemoryMB = 4096
 
-var pzsvcGetS3FileSizeInMegabytes = pzsvc.GetS3FileSizeInMegabytes
+var inputSize = input.InputSize
 var pzsvcRequestKnownJSON = pzsvc.RequestKnownJSON
 var pzsvcSendExecResultNoData = pzsvc.SendExecResultNoData
+var pzsvcSendExecResultData = pzsvc.SendExecResultData
 
 func init() {
 	// Update defaults if overridden via env variables
@@ -38,41 +47,81 @@ type Loop struct {
 	SvcID         string
 	ConfigPath    string
 	ClientFactory cfwrapper.Factory
+	TaskCap       *TaskCap // Cap shared with the loops of other services, if any
 	vcapID        string
 	taskLimit     int
 	intervalTick  time.Duration
-
-	stopChan         chan bool
-	runIterationFunc func(l Loop) error
+	maxInterval   time.Duration
+	reconcileTick time.Duration
+	backoff       *pollBackoff
+	tasks         *taskTracker
+	dequeued      *taskTracker
+	pending       *pendingQueue
+	pendingMaxAge time.Duration
+
+	stopChan           chan bool
+	stopOnce           *sync.Once
+	doneChan           chan bool
+	runIterationFunc   func(l Loop) error
+	reconcileTasksFunc func(l Loop) error
 }
 
 // NewLoop creates a Loop and does starting configuration based on the given parameters
 func NewLoop(s *pzsvc.Session, configObj pzsvc.Config, svcID string, configPath string, clientFactory cfwrapper.Factory) (*Loop, error) {
 	pzsvc.LogInfo(*s, "Initializing polling loop object")
 
-	appID, err := getVCAPApplicationID()
+	appID, err := getAppID(clientFactory)
 	if err != nil {
 		return nil, err
 	}
-	pzsvc.LogInfo(*s, "Found application name from VCAP Tree: "+appID)
+	pzsvc.LogInfo(*s, "Found application ID for task backend: "+appID)
 
 	// Read the # of simultaneous Tasks that are allowed to be run by the Dispatcher
 	taskLimit := 3
-	if envTaskLimit := os.Getenv("TASK_LIMIT"); envTaskLimit != "" {
+	if configObj.TaskLimit > 0 {
+		taskLimit = configObj.TaskLimit
+	} else if envTaskLimit := os.Getenv("TASK_LIMIT"); envTaskLimit != "" {
 		taskLimit, _ = strconv.Atoi(envTaskLimit)
 	}
 
+	// Read the polling interval bounds; polling backs off from the fast interval towards the
+	// slow one while the queue is empty or Piazza is failing
+	interval, maxInterval := 5, 60
+	if envInterval, err := strconv.Atoi(os.Getenv("POLL_INTERVAL")); envInterval > 0 && err == nil {
+		interval = envInterval
+	}
+	if envMaxInterval, err := strconv.Atoi(os.Getenv("POLL_INTERVAL_MAX")); envMaxInterval > 0 && err == nil {
+		maxInterval = envMaxInterval
+	}
+
+	// Read how many jobs may wait locally for CF memory to free up, and for how long (in seconds)
+	pendingLimit, pendingMaxAge := 10, 600
+	if envPendingLimit, err := strconv.Atoi(os.Getenv("PENDING_JOB_LIMIT")); envPendingLimit >= 0 && err == nil {
+		pendingLimit = envPendingLimit
+	}
+	if envPendingMaxAge, err := strconv.Atoi(os.Getenv("PENDING_JOB_MAX_AGE")); envPendingMaxAge > 0 && err == nil {
+		pendingMaxAge = envPendingMaxAge
+	}
+
 	return &Loop{
-		PzSession:        s,
-		PzConfig:         configObj,
-		SvcID:            svcID,
-		ConfigPath:       configPath,
-		ClientFactory:    clientFactory,
-		vcapID:           appID,
-		taskLimit:        taskLimit,
-		intervalTick:     5 * time.Second,
-		stopChan:         nil, // initialized when loop starts
-		runIterationFunc: runIteration,
+		PzSession:          s,
+		PzConfig:           configObj,
+		SvcID:              svcID,
+		ConfigPath:         configPath,
+		ClientFactory:      clientFactory,
+		vcapID:             appID,
+		taskLimit:          taskLimit,
+		intervalTick:       time.Duration(interval) * time.Second,
+		maxInterval:        time.Duration(maxInterval) * time.Second,
+		reconcileTick:      30 * time.Second,
+		backoff:            newPollBackoff(),
+		tasks:              newTaskTracker(),
+		dequeued:           newTaskTracker(),
+		pending:            newPendingQueue(pendingLimit),
+		pendingMaxAge:      time.Duration(pendingMaxAge) * time.Second,
+		stopChan:           nil, // initialized when loop starts
+		runIterationFunc:   runIteration,
+		reconcileTasksFunc: reconcileTasks,
 	}, nil
 }
 
@@ -81,17 +130,40 @@ func NewLoop(s *pzsvc.Session, configObj pzsvc.Config, svcID string, configPath
 func (l *Loop) Start() <-chan error {
 	errChan := make(chan error)
 	l.stopChan = make(chan bool)
+	l.stopOnce = &sync.Once{}
+	l.doneChan = make(chan bool)
 	go func() {
-		ticker := time.Tick(l.intervalTick)
+		defer close(l.doneChan)
+		defer close(errChan)
+		nextTick := time.Now().Add(l.intervalTick)
+		ticker := time.After(l.intervalTick)
+		reconcileTicker := time.Tick(l.reconcileTick)
 		for {
 			select {
 			case <-ticker:
+				if l.stopped() {
+					return
+				}
 				err := l.runIterationFunc(*l)
 				if err != nil {
 					errChan <- err
 				}
+				// The next iteration is scheduled from when this one was due, not from when it
+				// ended, so that the time iterations take does not stretch the polling interval
+				nextTick = nextTick.Add(l.backoff.Delay(l.intervalTick, l.maxInterval))
+				if now := time.Now(); nextTick.Before(now) {
+					nextTick = now
+				}
+				ticker = time.After(time.Until(nextTick))
+			case <-reconcileTicker:
+				if l.stopped() {
+					return
+				}
+				err := l.reconcileTasksFunc(*l)
+				if err != nil {
+					errChan <- err
+				}
 			case <-l.stopChan:
-				close(errChan)
 				return
 			}
 		}
@@ -99,52 +171,182 @@ func (l *Loop) Start() <-chan error {
 	return errChan
 }
 
-// Stop halts the loop's iteration
-func (l Loop) Stop() {
-	l.stopChan <- true
-	close(l.stopChan)
+// Stop halts the loop's iteration once any in-flight iteration has finished.
+// It is safe to call more than once.
+func (l *Loop) Stop() {
+	if l.stopOnce == nil {
+		return
+	}
+	l.stopOnce.Do(func() { close(l.stopChan) })
+}
+
+func (l *Loop) stopped() bool {
+	select {
+	case <-l.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown stops the loop and waits up to the given timeout for the in-flight
+// iteration to finish.  Any Piazza job that was dequeued but has not been
+// launched by then, including jobs pending CF memory, is failed, since Piazza
+// will not hand it out again.
+func (l *Loop) Shutdown(timeout time.Duration) {
+	pzsvc.LogInfo(*l.PzSession, fmt.Sprintf("Shutting down polling loop; waiting up to %v for the current iteration", timeout))
+	l.Stop()
+	if l.doneChan != nil {
+		select {
+		case <-l.doneChan:
+			pzsvc.LogInfo(*l.PzSession, "Polling loop drained")
+		case <-time.After(timeout):
+			pzsvc.LogWarn(*l.PzSession, "Polling loop did not drain before the shutdown timeout")
+		}
+	}
+
+	for _, job := range l.dequeued.List() {
+		if !l.dequeued.Take(job.JobID) {
+			continue // Launched after all
+		}
+		pzsvc.LogAudit(*l.PzSession, l.PzSession.UserID, "Audit failure", l.PzSession.AppName, "Job "+job.JobID+" was dequeued but not launched before dispatcher shutdown. Job Failed.", pzsvc.ERROR)
+		if err := pzsvcSendExecResultNoData(*l.PzSession, l.PzSession.PzAddr, l.SvcID, job.JobID, pzsvc.PiazzaStatusFail); err != nil {
+			err.Log(*l.PzSession, "Dispatcher: error failing job "+job.JobID+" during shutdown")
+		}
+	}
+}
+
+// TaskLimit returns the number of simultaneous tasks this loop may run
+func (l Loop) TaskLimit() int {
+	return l.taskLimit
 }
 
 func runIteration(l Loop) error {
 	pzsvc.LogInfo(*l.PzSession, "Starting polling loop iteration")
+	l.expirePendingJobs()
 
 	cfSession, err := l.ClientFactory.GetSession()
 	if err != nil {
 		pzsvc.LogSimpleErr(*l.PzSession, "Error generating valid CF Client", err)
+		l.backoff.Increase()
 		return err
 	}
 
-	numTasks, err := cfSession.CountTasksForApp(l.vcapID)
+	var freeSlots int
+	if l.TaskCap != nil {
+		// With a shared cap, the app's tasks belong to several services; this loop is limited
+		// by its own tasks that are still live, and by the cap on the app's tasks as a whole
+		freeSlots, err = l.TaskCap.reserve(l.taskLimit-l.countLiveTasks(cfSession), func() (int, error) {
+			return cfSession.CountTasksForApp(l.vcapID)
+		})
+		defer l.TaskCap.release(freeSlots)
+	} else {
+		var numTasks int
+		numTasks, err = cfSession.CountTasksForApp(l.vcapID)
+		freeSlots = l.taskLimit - numTasks
+	}
 	if err != nil {
 		pzsvc.LogSimpleErr(*l.PzSession, "Error checking running tasks. ", err)
+		l.backoff.Increase()
 		return err
 	}
-	if numTasks >= l.taskLimit {
+	if freeSlots <= 0 {
 		pzsvc.LogInfo(*l.PzSession, "Too many tasks already running, skipping this iteration cycle")
+		l.backoff.Reset()
 		return nil
 	}
 
+	// Keep launching jobs until the free task slots are used up or the queue runs dry.
+	// Jobs held back by the CF memory limit are retried before new ones are pulled.
+	dispatched, failed := 0, 0
+	jobErrors := []string{}
+	for attempt := 0; attempt < freeSlots && !l.stopped(); attempt++ {
+		var result dispatchResult
+		if job, ok := l.pending.Pop(); ok {
+			pzsvc.LogInfo(*l.PzSession, "Retrying pending job "+job.JobID)
+			result, err = l.launchTask(cfSession, job)
+		} else {
+			result, err = l.dispatchNextJob(cfSession)
+		}
+		if err != nil {
+			jobErrors = append(jobErrors, err.Error())
+		}
+		if result == dispatchLaunched {
+			dispatched++
+		}
+		if result == dispatchJobFailed {
+			failed++
+		}
+		if result == dispatchQueueEmpty || result == dispatchHalted {
+			break
+		}
+	}
+	pzsvc.LogInfo(*l.PzSession, fmt.Sprintf("Dispatched %d jobs this iteration cycle (%d free task slots, %d job errors)", dispatched, freeSlots, len(jobErrors)))
+
+	// Poll quickly while there is work to pull; back off while the queue is empty or unreachable
+	if dispatched+failed > 0 {
+		l.backoff.Reset()
+	} else {
+		l.backoff.Increase()
+	}
+
+	if len(jobErrors) > 0 {
+		return errors.New(strings.Join(jobErrors, "; "))
+	}
+	return nil
+}
+
+// countLiveTasks counts the tasks this loop launched that are still pending or running.
+// Tasks whose state cannot be read are counted, so that an unreachable backend does not
+// free their slots.
+func (l Loop) countLiveTasks(cfSession cfwrapper.CFSession) int {
+	live := 0
+	for _, task := range l.tasks.List() {
+		state, err := cfSession.GetTaskState(task.TaskGUID)
+		if err == cfwrapper.ErrTaskNotFound {
+			continue
+		}
+		if err != nil || state == cfwrapper.TaskStatePending || state == cfwrapper.TaskStateRunning || state == cfwrapper.TaskStateCanceling {
+			live++
+		}
+	}
+	return live
+}
+
+// dispatchResult describes the outcome of trying to launch one job from the Piazza queue
+type dispatchResult int
+
+const (
+	dispatchLaunched   dispatchResult = iota // A task was created for the job
+	dispatchQueueEmpty                       // There were no jobs waiting in Piazza
+	dispatchJobFailed                        // The job could not be launched, but others may be
+	dispatchHalted                           // No more jobs should be pulled this iteration
+)
+
+// dispatchNextJob pulls one job from Piazza and creates a task for it
+func (l Loop) dispatchNextJob(cfSession cfwrapper.CFSession) (dispatchResult, error) {
 	taskItem, _, err := l.getPzTaskItem()
 	if err != nil {
-		return err
+		return dispatchHalted, err
 	}
 
 	jobID := taskItem.Data.SvcData.JobID
 	jobData := taskItem.Data.SvcData.Data.DataInputs.Body.Content
 	if jobData == "" {
-		pzsvc.LogInfo(*l.PzSession, ("No jobs available in task queue (jobID=''); skipping this iteration cycle"))
-		return nil
+		pzsvc.LogInfo(*l.PzSession, ("No jobs available in task queue (jobID=''); ending this iteration cycle"))
+		return dispatchQueueEmpty, nil
 	}
 	pzsvc.LogInfo(*l.PzSession, "New Task Grabbed.  JobID: "+jobID)
+	l.dequeued.Add(jobID, "")
 
-	jobInput, err := l.parseJobInput(jobData)
+	jobInput, credentials, err := l.parseJobInput(jobData)
 	if err != nil {
-		return err
+		return l.rejectJob(jobID, err)
 	}
 
-	workerCommand, err := l.buildWorkerCommand(jobInput, jobID)
+	workerCommand, err := l.buildWorkerCommand(jobInput, credentials, jobID)
 	if err != nil {
-		return err
+		return l.rejectJob(jobID, err)
 	}
 
 	diskMB, memoryMB := l.calculateDiskAndMemoryLimits(jobInput)
@@ -160,18 +362,67 @@ func runIteration(l Loop) error {
 	serializedInput, _ := json.Marshal(jobInput)
 	pzsvc.LogAudit(*l.PzSession, l.PzSession.UserID, "Creating CF Task for Job "+jobID+" : "+workerCommand, l.PzSession.AppName, string(serializedInput), pzsvc.INFO)
 
-	if err = cfSession.CreateTask(taskRequest); err != nil {
+	return l.launchTask(cfSession, pendingJob{JobID: jobID, Request: taskRequest, Queued: time.Now()})
+}
+
+// rejectJob fails a job whose input is invalid, reporting the reason to Piazza as the job's result
+func (l Loop) rejectJob(jobID string, jobErr error) (dispatchResult, error) {
+	if !l.dequeued.Take(jobID) {
+		return dispatchHalted, errors.New("Job " + jobID + " was failed by dispatcher shutdown before it could be rejected")
+	}
+	pzsvc.LogAudit(*l.PzSession, l.PzSession.UserID, "Audit failure", l.PzSession.AppName, "Invalid input for Job "+jobID+". Job Failed: "+jobErr.Error(), pzsvc.ERROR)
+	resultData, _ := json.Marshal(map[string]interface{}{"Errors": []string{jobErr.Error()}, "HTTPStatus": http.StatusBadRequest})
+	if pzErr := pzsvcSendExecResultData(*l.PzSession, l.PzSession.PzAddr, l.SvcID, jobID, pzsvc.PiazzaStatusFail, resultData); pzErr != nil {
+		pzErr.Log(*l.PzSession, "Dispatcher: error failing invalid job "+jobID)
+	}
+	return dispatchJobFailed, jobErr
+}
+
+// launchTask creates the task for a dequeued job.  If the CF memory limit has been hit,
+// the job is held in the pending queue to be retried on a later iteration.
+func (l Loop) launchTask(cfSession cfwrapper.CFSession, job pendingJob) (dispatchResult, error) {
+	if !l.dequeued.Take(job.JobID) {
+		return dispatchHalted, errors.New("Job " + job.JobID + " was failed by dispatcher shutdown before it could be launched")
+	}
+	taskGUID, err := cfSession.CreateTask(job.Request)
+	if err != nil {
 		if cfwrapper.IsMemoryLimitError(err) {
 			pzsvc.LogAudit(*l.PzSession, l.PzSession.UserID, "Audit failure", l.PzSession.AppName, "The Memory limit of CF Org has been exceeded. No further jobs can be created.", pzsvc.ERROR)
-			return errors.New("CF memory limit hit, will retry job later")
+			return l.holdPendingJob(job)
 		}
 		// General error - fail the job.
 		pzsvc.LogAudit(*l.PzSession, l.PzSession.UserID, "Audit failure", l.PzSession.AppName, "Could not Create PCF Task for Job. Job Failed: "+err.Error(), pzsvc.ERROR)
-		pzsvcSendExecResultNoData(*l.PzSession, l.PzSession.PzAddr, l.SvcID, jobID, pzsvc.PiazzaStatusFail)
-		return err
+		pzsvcSendExecResultNoData(*l.PzSession, l.PzSession.PzAddr, l.SvcID, job.JobID, pzsvc.PiazzaStatusFail)
+		return dispatchJobFailed, err
 	}
+	l.tasks.Add(job.JobID, taskGUID)
 
-	return nil
+	return dispatchLaunched, nil
+}
+
+// holdPendingJob queues a job that hit the CF memory limit, or fails it if the pending queue is full
+func (l Loop) holdPendingJob(job pendingJob) (dispatchResult, error) {
+	l.dequeued.Add(job.JobID, "")
+	if !l.pending.Push(job) {
+		l.dequeued.Remove(job.JobID)
+		pzsvc.LogAudit(*l.PzSession, l.PzSession.UserID, "Audit failure", l.PzSession.AppName, "Pending job queue is full; could not hold Job "+job.JobID+" for CF memory. Job Failed.", pzsvc.ERROR)
+		pzsvcSendExecResultNoData(*l.PzSession, l.PzSession.PzAddr, l.SvcID, job.JobID, pzsvc.PiazzaStatusFail)
+		return dispatchHalted, errors.New("CF memory limit hit and pending job queue is full; failed job " + job.JobID)
+	}
+	return dispatchHalted, errors.New("CF memory limit hit, will retry job " + job.JobID + " later")
+}
+
+// expirePendingJobs fails the pending jobs that have waited for CF memory longer than the configured maximum age
+func (l Loop) expirePendingJobs() {
+	for _, job := range l.pending.Expire(l.pendingMaxAge) {
+		if !l.dequeued.Take(job.JobID) {
+			continue // Already failed by shutdown
+		}
+		pzsvc.LogAudit(*l.PzSession, l.PzSession.UserID, "Audit failure", l.PzSession.AppName, fmt.Sprintf("Job %s waited more than %v for CF memory. Job Failed.", job.JobID, l.pendingMaxAge), pzsvc.ERROR)
+		if err := pzsvcSendExecResultNoData(*l.PzSession, l.PzSession.PzAddr, l.SvcID, job.JobID, pzsvc.PiazzaStatusFail); err != nil {
+			err.Log(*l.PzSession, "Dispatcher: error failing expired job "+job.JobID)
+		}
+	}
 }
 
 func (l Loop) getPzTaskItem() (*model.PzTaskItem, []byte, error) {
@@ -186,13 +437,20 @@ func (l Loop) getPzTaskItem() (*model.PzTaskItem, []byte, error) {
 	return &pzTaskItem, byts, nil
 }
 
-func (l Loop) parseJobInput(jobInputStr string) (*pzsvc.InpStruct, error) {
+// parseJobInput decodes a job's input.  The credentials it gives for external downloads are
+// returned separately, and masked in the input, which is written to the audit log.
+func (l Loop) parseJobInput(jobInputStr string) (*pzsvc.InpStruct, []config.Credential, error) {
 	var err error
 	var jobInputContent pzsvc.InpStruct
 
 	if err = json.Unmarshal([]byte(jobInputStr), &jobInputContent); err != nil {
 		pzsvc.LogSimpleErr(*l.PzSession, "Error decoding job input body", err)
-		return nil, err
+		return nil, nil, err
+	}
+
+	credentials, err := jobCredentials(&jobInputContent)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	if jobInputContent.ExtAuth != "" {
@@ -201,47 +459,268 @@ func (l Loop) parseJobInput(jobInputStr string) (*pzsvc.InpStruct, error) {
 	if jobInputContent.PzAuth != "" {
 		jobInputContent.PzAuth = "*****"
 	}
+	for fileName := range jobInputContent.ExtTokens {
+		jobInputContent.ExtTokens[fileName] = "*****"
+	}
+	for _, headers := range jobInputContent.ExtHeaders {
+		for name := range headers {
+			headers[name] = "*****"
+		}
+	}
 
-	return &jobInputContent, nil
+	return &jobInputContent, credentials, nil
 }
 
-func (l Loop) buildWorkerCommand(jobInput *pzsvc.InpStruct, jobID string) (string, error) {
-	workerCommand := fmt.Sprintf("worker --cliExtra '%s' --userID '%s' --config '%s' --serviceID '%s' --jobID '%s'",
-		jobInput.Command, jobInput.UserID, l.ConfigPath, l.SvcID, jobID)
+// headerNamePattern matches the names HTTP allows for headers
+var headerNamePattern = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// jobCredentials gathers the credentials a job gave for its external inputs, each limited to
+// the hosts it was issued for: those listed with ExtAuth, or else those of the job's inputs.
+// Credentials may only be sent over plain http to the hosts the job gave http URLs for.
+func jobCredentials(jobInput *pzsvc.InpStruct) ([]config.Credential, error) {
+	inputURLs := map[string]*url.URL{}
+	seenHosts := map[string]bool{}
+	allHosts := []string{}
+	httpURLs := []*url.URL{}
+	for i, fileName := range jobInput.InExtNames {
+		if i >= len(jobInput.InExtFiles) {
+			break
+		}
+		if parsed, err := url.Parse(jobInput.InExtFiles[i]); err == nil && parsed.Host != "" {
+			if !seenHosts[parsed.Host] {
+				seenHosts[parsed.Host] = true
+				allHosts = append(allHosts, parsed.Host)
+			}
+			inputURLs[fileName] = parsed
+			if strings.ToLower(parsed.Scheme) == "http" {
+				httpURLs = append(httpURLs, parsed)
+			}
+		}
+	}
+
+	var credentials []config.Credential
+	if jobInput.ExtAuth != "" {
+		hosts := jobInput.ExtAuthHosts
+		if len(hosts) == 0 {
+			hosts = allHosts
+		}
+		credential := config.Credential{Hosts: hosts, Headers: map[string]string{"Authorization": jobInput.ExtAuth}}
+		seenHTTPHosts := map[string]bool{}
+		for _, inputURL := range httpURLs {
+			if credential.MatchesHost(inputURL) && !seenHTTPHosts[inputURL.Host] {
+				seenHTTPHosts[inputURL.Host] = true
+				credential.HTTPHosts = append(credential.HTTPHosts, inputURL.Host)
+			}
+		}
+		credentials = append(credentials, credential)
+	}
 
+	// Per-input credentials are added in order of name, so that the job spec is the same each time
+	inputHeaders := map[string]map[string]string{}
+	for fileName, token := range jobInput.ExtTokens {
+		inputHeaders[fileName] = map[string]string{"Authorization": "Bearer " + token}
+	}
+	for fileName, headers := range jobInput.ExtHeaders {
+		if inputHeaders[fileName] == nil {
+			inputHeaders[fileName] = map[string]string{}
+		}
+		for name, value := range headers {
+			if !headerNamePattern.MatchString(name) || strings.ContainsAny(value, "\r\n\x00") {
+				return nil, fmt.Errorf("Header %q given for %s is not a valid HTTP header", name, fileName)
+			}
+			inputHeaders[fileName][name] = value
+		}
+	}
+	fileNames := []string{}
+	for fileName := range inputHeaders {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+	for _, fileName := range fileNames {
+		inputURL, ok := inputURLs[fileName]
+		if !ok {
+			return nil, fmt.Errorf("Credentials given for %s, which is not an external input of the job", fileName)
+		}
+		credential := config.Credential{Hosts: []string{inputURL.Host}, Input: fileName, Headers: inputHeaders[fileName]}
+		if strings.ToLower(inputURL.Scheme) == "http" {
+			credential.HTTPHosts = []string{inputURL.Host}
+		}
+		credentials = append(credentials, credential)
+	}
+	return credentials, nil
+}
+
+// buildWorkerCommand creates the worker command for a job.  The job is passed as an
+// encoded spec rather than as separate flags, so that user-supplied values cannot break
+// out of the shell quoting, and long input lists stay short enough for a task command.
+func (l Loop) buildWorkerCommand(jobInput *pzsvc.InpStruct, credentials []config.Credential, jobID string) (string, error) {
 	if len(jobInput.InExtFiles) != len(jobInput.InExtNames) {
 		return "", errors.New("Number of input file names and URLs did not match")
 	}
+	if len(jobInput.InPzFiles) != len(jobInput.InPzNames) {
+		return "", errors.New("Number of input file names and Piazza data IDs did not match")
+	}
+	if len(jobInput.InPzFiles) > 0 && !l.PzConfig.CanDownlPz {
+		return "", errors.New("Job has Piazza data inputs, but this service is not permitted to download from Piazza (CanDownlPz)")
+	}
+	if len(jobInput.InExtFiles) > 0 && !l.PzConfig.CanDownlExt {
+		return "", errors.New("Job has external inputs, but this service is not permitted to download external files (CanDownlExt)")
+	}
 
-	commandParts := []string{workerCommand}
+	// A service with a parameter schema takes only validated parameters, never free-form command text
+	var args []string
+	if len(l.PzConfig.Params) > 0 {
+		if jobInput.Command != "" {
+			return "", errors.New("This service takes its parameters as params; free-form cmd text is not permitted")
+		}
+		var err error
+		if args, err = l.PzConfig.BuildParamArgs(jobInput.Params); err != nil {
+			return "", err
+		}
+	} else if len(jobInput.Params) > 0 {
+		return "", errors.New("This service does not declare any params; use cmd instead")
+	}
 
+	jobSpec := config.JobSpec{
+		Version:         config.JobSpecVersion,
+		ConfigPath:      l.ConfigPath,
+		ServiceID:       l.SvcID,
+		JobID:           jobID,
+		UserID:          jobInput.UserID,
+		CLICommandExtra: jobInput.Command,
+		Args:            args,
+		Inputs:          []config.InputSource{},
+		Outputs:         []string{},
+		OutputTypes:     map[string]string{},
+	}
 	for i := range jobInput.InExtNames {
-		inputPair := fmt.Sprintf("%s:%s", jobInput.InExtNames[i], jobInput.InExtFiles[i])
-		commandParts = append(commandParts, "-i", inputPair)
+		jobSpec.Inputs = append(jobSpec.Inputs, config.InputSource{FileName: jobInput.InExtNames[i], URL: jobInput.InExtFiles[i]})
 	}
+	for i := range jobInput.InPzNames {
+		jobSpec.Inputs = append(jobSpec.Inputs, config.InputSource{FileName: jobInput.InPzNames[i], DataID: jobInput.InPzFiles[i]})
+	}
+	for _, source := range jobSpec.Inputs {
+		if err := config.CheckRelativePath(source.FileName); err != nil {
+			return "", err
+		}
+		if err := input.CheckDataURI(source.URL); err != nil {
+			return "", fmt.Errorf("Input %s: %v", source.FileName, err)
+		}
+	}
+	if err := applyInputChecks(jobSpec.Inputs, jobInput.InChecksums, jobInput.InSizes); err != nil {
+		return "", err
+	}
+	if err := applyInputExtracts(jobSpec.Inputs, jobInput.InExtract); err != nil {
+		return "", err
+	}
+	if len(credentials) > 0 {
+		sealed, err := config.SealCredentials(credentials)
+		if err != nil {
+			return "", err
+		}
+		jobSpec.Credentials = sealed
+	}
+
+	// Each output is ingested as the Piazza data type it was requested as
+	typedOutputs := []struct {
+		fileType  string
+		fileNames []string
+	}{
+		{"geojson", jobInput.OutGeoJs},
+		{"raster", jobInput.OutTiffs},
+		{"text", jobInput.OutTxts},
+	}
+	for _, outputs := range typedOutputs {
+		for _, fileName := range outputs.fileNames {
+			if err := config.CheckRelativePath(fileName); err != nil {
+				return "", err
+			}
+			if fileType, ok := jobSpec.OutputTypes[fileName]; ok {
+				return "", fmt.Errorf("Output file %s was requested as both %s and %s", fileName, fileType, outputs.fileType)
+			}
+			jobSpec.Outputs = append(jobSpec.Outputs, fileName)
+			jobSpec.OutputTypes[fileName] = outputs.fileType
+		}
+	}
+
+	encodedSpec, err := jobSpec.Encode()
+	if err != nil {
+		return "", err
+	}
+	if len(encodedSpec) > config.MaxEncodedJobSpecBytes {
+		return "", fmt.Errorf("Job is too large to pass to its task (%d bytes encoded, but at most %d are allowed); give large inputs as URLs rather than data: URIs",
+			len(encodedSpec), config.MaxEncodedJobSpecBytes)
+	}
+	return "worker --jobSpec " + encodedSpec, nil
+}
 
-	for _, outputFile := range jobInput.OutGeoJs { // TODO: non-geojson outputs?
-		commandParts = append(commandParts, "-o", outputFile)
+// applyInputChecks adds the expected checksums and sizes a job gave for its inputs, by name, to their specs
+func applyInputChecks(inputs []config.InputSource, checksums map[string]string, sizes map[string]int64) error {
+	indexes := map[string]int{}
+	for i, input := range inputs {
+		indexes[input.FileName] = i
 	}
+	for fileName, checksum := range checksums {
+		i, ok := indexes[fileName]
+		if !ok {
+			return fmt.Errorf("Checksum given for %s, which is not an input of the job", fileName)
+		}
+		if _, _, err := config.ParseChecksum(checksum); err != nil {
+			return fmt.Errorf("Checksum of input %s: %v", fileName, err)
+		}
+		inputs[i].Checksum = checksum
+	}
+	for fileName, size := range sizes {
+		i, ok := indexes[fileName]
+		if !ok {
+			return fmt.Errorf("Size given for %s, which is not an input of the job", fileName)
+		}
+		if size <= 0 {
+			return fmt.Errorf("Size of input %s must be positive", fileName)
+		}
+		inputs[i].Size = size
+	}
+	return nil
+}
 
-	return strings.Join(commandParts, " "), nil
+// applyInputExtracts adds the directories a job asked for its archive inputs to be extracted into, by name, to their specs
+func applyInputExtracts(inputs []config.InputSource, extracts map[string]string) error {
+	indexes := map[string]int{}
+	for i, input := range inputs {
+		indexes[input.FileName] = i
+	}
+	for fileName, dir := range extracts {
+		i, ok := indexes[fileName]
+		if !ok {
+			return fmt.Errorf("Extraction directory given for %s, which is not an input of the job", fileName)
+		}
+		cleaned := filepath.Clean(dir)
+		if dir == "" || filepath.IsAbs(cleaned) || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("Extraction directory %q of input %s must be a subdirectory of the working directory", dir, fileName)
+		}
+		if _, ok := indexes[cleaned]; ok {
+			return fmt.Errorf("Extraction directory %s of input %s is also the name of an input", dir, fileName)
+		}
+		inputs[i].ExtractTo = cleaned
+	}
+	return nil
 }
 
-func (l Loop) calculateAWSInputFileSizeMB(jobInput *pzsvc.InpStruct) (total int) {
+// calculateInputFileSizeMB adds up the sizes of the job's inputs, asking the fetcher of each
+// input's URL scheme, as the Worker uses to download it
+func (l Loop) calculateInputFileSizeMB(jobInput *pzsvc.InpStruct) (total int) {
+	if len(jobInput.InPzFiles) > 0 {
+		pzsvc.LogInfo(*l.PzSession, "Job has Piazza data inputs of unknown size; giving up on calculating input sizes")
+		return 0
+	}
 	for _, url := range jobInput.InExtFiles {
-		if strings.Contains(url, "amazonaws") {
-			fileSize, err := pzsvcGetS3FileSizeInMegabytes(url)
-			if err == nil {
-				pzsvc.LogInfo(*l.PzSession, fmt.Sprintf("S3 File Size for %s found to be %d", url, fileSize))
-				total += fileSize
-			} else {
-				err.Log(*l.PzSession, "Tried to get File Size from S3 File "+url+" but encountered an error; giving up on calculating input sizes")
-				return 0
-			}
-		} else {
-			pzsvc.LogInfo(*l.PzSession, fmt.Sprintf("Input file %s is not AWS; giving up on calculating input sizes", url))
+		fileSize, err := inputSize(url)
+		if err != nil {
+			pzsvc.LogInfo(*l.PzSession, fmt.Sprintf("Tried to get the size of input file %s but encountered an error (%v); giving up on calculating input sizes", url, err))
 			return 0
 		}
+		pzsvc.LogInfo(*l.PzSession, fmt.Sprintf("File Size for %s found to be %d", url, fileSize/1000000))
+		total += int(fileSize / 1000000)
 	}
 	return
 }
@@ -250,13 +729,13 @@ func (l Loop) calculateDiskAndMemoryLimits(jobInput *pzsvc.InpStruct) (diskMB in
 	diskMB = defaultTaskDiskMB
 	memoryMB = defaultTaskMemoryMB
 
-	if inputSize := l.calculateAWSInputFileSizeMB(jobInput); inputSize > 0 {
+	if inputSizeMB := l.calculateInputFileSizeMB(jobInput); inputSizeMB > 0 {
 		// Allocate space for the filesystem and executables (with some buffer), then add the image sizes
-		diskMB = 4096 + (inputSize * 2)
-		memoryMB = memoryMB + (inputSize * 5)
-		pzsvc.LogInfo(*l.PzSession, fmt.Sprintf("Obtained S3 File Sizes for input files; will use Dynamic Disk Space of %d in Task container and Dynamic Memory Size of %d", diskMB, memoryMB))
+		diskMB = 4096 + (inputSizeMB * 2)
+		memoryMB = memoryMB + (inputSizeMB * 5)
+		pzsvc.LogInfo(*l.PzSession, fmt.Sprintf("Obtained File Sizes for input files; will use Dynamic Disk Space of %d in Task container and Dynamic Memory Size of %d", diskMB, memoryMB))
 	} else {
-		pzsvc.LogInfo(*l.PzSession, fmt.Sprintf("Could not get the S3 File Sizes for input files. Will use the default Disk %d and Memory %d when running Task.", diskMB, memoryMB))
+		pzsvc.LogInfo(*l.PzSession, fmt.Sprintf("Could not get the File Sizes for input files. Will use the default Disk %d and Memory %d when running Task.", diskMB, memoryMB))
 	}
 	return
 }
@@ -3,7 +3,9 @@ package poll
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/venicegeo/pzsvc-exec/dispatcher/cfwrapper"
@@ -18,12 +20,17 @@ func TestRunIteration_ErrGetSession(t *testing.T) {
 		vcapID:        "test-vcap-id",
 		SvcID:         "test-svc-id",
 		PzSession:     &pzsvc.Session{},
+		PzConfig:      pzsvc.Config{CanDownlExt: true},
 		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{}, GetSessionError: errors.New("get session error")},
 		taskLimit:     10,
+		tasks:         newTaskTracker(),
+		dequeued:      newTaskTracker(),
+		pending:       newPendingQueue(10),
+		backoff:       newPollBackoff(),
 	}
 
-	originalGetS3FileSize := setMockPzsvcGetS3FileSizeInMegabytes(func(string) (int, *pzsvc.PzCustomError) { return 0, nil })
-	defer originalGetS3FileSize.Restore()
+	originalInputSize := setMockInputSize(func(string) (int64, error) { return 0, nil })
+	defer originalInputSize.Restore()
 	originalRequestJSON := setMockPzsvcRequestKnownJSON(func(string, string, string, string, interface{}) ([]byte, *pzsvc.PzCustomError) { return nil, nil })
 	defer originalRequestJSON.Restore()
 	originalSendExecResult := setMockPzsvcSendExecResultNoData(func(pzsvc.Session, string, string, string, pzsvc.PiazzaStatus) *pzsvc.PzCustomError { return nil })
@@ -43,12 +50,17 @@ func TestRunIteration_ErrCountTasks(t *testing.T) {
 		vcapID:        "test-vcap-id",
 		SvcID:         "test-svc-id",
 		PzSession:     &pzsvc.Session{},
+		PzConfig:      pzsvc.Config{CanDownlExt: true},
 		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{CountTasksError: errors.New("count error")}},
 		taskLimit:     10,
+		tasks:         newTaskTracker(),
+		dequeued:      newTaskTracker(),
+		pending:       newPendingQueue(10),
+		backoff:       newPollBackoff(),
 	}
 
-	originalGetS3FileSize := setMockPzsvcGetS3FileSizeInMegabytes(func(string) (int, *pzsvc.PzCustomError) { return 0, nil })
-	defer originalGetS3FileSize.Restore()
+	originalInputSize := setMockInputSize(func(string) (int64, error) { return 0, nil })
+	defer originalInputSize.Restore()
 	originalRequestJSON := setMockPzsvcRequestKnownJSON(func(string, string, string, string, interface{}) ([]byte, *pzsvc.PzCustomError) { return nil, nil })
 	defer originalRequestJSON.Restore()
 	originalSendExecResult := setMockPzsvcSendExecResultNoData(func(pzsvc.Session, string, string, string, pzsvc.PiazzaStatus) *pzsvc.PzCustomError { return nil })
@@ -68,16 +80,21 @@ func TestRunIteration_TooManyTasks(t *testing.T) {
 		vcapID:        "test-vcap-id",
 		SvcID:         "test-svc-id",
 		PzSession:     &pzsvc.Session{},
+		PzConfig:      pzsvc.Config{CanDownlExt: true},
 		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{NumTasks: 11}},
 		taskLimit:     10,
+		tasks:         newTaskTracker(),
+		dequeued:      newTaskTracker(),
+		pending:       newPendingQueue(10),
+		backoff:       newPollBackoff(),
 	}
 
 	externalsCalled := 0
-	originalGetS3FileSize := setMockPzsvcGetS3FileSizeInMegabytes(func(string) (int, *pzsvc.PzCustomError) {
+	originalInputSize := setMockInputSize(func(string) (int64, error) {
 		externalsCalled++
 		return 0, nil
 	})
-	defer originalGetS3FileSize.Restore()
+	defer originalInputSize.Restore()
 	originalRequestJSON := setMockPzsvcRequestKnownJSON(func(string, string, string, string, interface{}) ([]byte, *pzsvc.PzCustomError) {
 		externalsCalled++
 		return nil, nil
@@ -103,12 +120,17 @@ func TestRunIteration_ErrGetTask(t *testing.T) {
 		vcapID:        "test-vcap-id",
 		SvcID:         "test-svc-id",
 		PzSession:     &pzsvc.Session{},
+		PzConfig:      pzsvc.Config{CanDownlExt: true},
 		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{}},
 		taskLimit:     10,
+		tasks:         newTaskTracker(),
+		dequeued:      newTaskTracker(),
+		pending:       newPendingQueue(10),
+		backoff:       newPollBackoff(),
 	}
 
-	originalGetS3FileSize := setMockPzsvcGetS3FileSizeInMegabytes(func(string) (int, *pzsvc.PzCustomError) { return 0, nil })
-	defer originalGetS3FileSize.Restore()
+	originalInputSize := setMockInputSize(func(string) (int64, error) { return 0, nil })
+	defer originalInputSize.Restore()
 	originalRequestJSON := setMockPzsvcRequestKnownJSON(func(_, _, _, _ string, outObj interface{}) ([]byte, *pzsvc.PzCustomError) {
 		return nil, &pzsvc.PzCustomError{LogMsg: "test piazza task error"}
 	})
@@ -130,21 +152,26 @@ func TestRunIteration_EmptyTaskContent(t *testing.T) {
 		vcapID:        "test-vcap-id",
 		SvcID:         "test-svc-id",
 		PzSession:     &pzsvc.Session{},
+		PzConfig:      pzsvc.Config{CanDownlExt: true},
 		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{}},
 		taskLimit:     10,
+		tasks:         newTaskTracker(),
+		dequeued:      newTaskTracker(),
+		pending:       newPendingQueue(10),
+		backoff:       newPollBackoff(),
 	}
 
 	var (
-		s3FileSizeRequests = 0
+		inputSizeRequests  = 0
 		taskRequests       = 0
 		sendResultRequests = 0
 	)
 
-	originalGetS3FileSize := setMockPzsvcGetS3FileSizeInMegabytes(func(string) (int, *pzsvc.PzCustomError) {
-		s3FileSizeRequests++
+	originalInputSize := setMockInputSize(func(string) (int64, error) {
+		inputSizeRequests++
 		return 0, nil
 	})
-	defer originalGetS3FileSize.Restore()
+	defer originalInputSize.Restore()
 	originalRequestJSON := setMockPzsvcRequestKnownJSON(func(_, _, _, _ string, outObj interface{}) ([]byte, *pzsvc.PzCustomError) {
 		taskRequests++
 		body := []byte(`{"data": {"serviceData": {"jobID": "test-job-id", "data": {"dataInputs": {"body": {"content": ""}}}}}}`)
@@ -163,7 +190,7 @@ func TestRunIteration_EmptyTaskContent(t *testing.T) {
 
 	// Asserts
 	assert.Nil(t, err)
-	assert.Equal(t, 0, s3FileSizeRequests)
+	assert.Equal(t, 0, inputSizeRequests)
 	assert.Equal(t, 1, taskRequests)
 	assert.Equal(t, 0, sendResultRequests)
 }
@@ -174,12 +201,17 @@ func TestRunIteration_BadTaskContent(t *testing.T) {
 		vcapID:        "test-vcap-id",
 		SvcID:         "test-svc-id",
 		PzSession:     &pzsvc.Session{},
+		PzConfig:      pzsvc.Config{CanDownlExt: true},
 		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{}},
 		taskLimit:     10,
+		tasks:         newTaskTracker(),
+		dequeued:      newTaskTracker(),
+		pending:       newPendingQueue(10),
+		backoff:       newPollBackoff(),
 	}
 
-	originalGetS3FileSize := setMockPzsvcGetS3FileSizeInMegabytes(func(string) (int, *pzsvc.PzCustomError) { return 0, nil })
-	defer originalGetS3FileSize.Restore()
+	originalInputSize := setMockInputSize(func(string) (int64, error) { return 0, nil })
+	defer originalInputSize.Restore()
 	originalRequestJSON := setMockPzsvcRequestKnownJSON(func(_, _, _, _ string, outObj interface{}) ([]byte, *pzsvc.PzCustomError) {
 		body := []byte(`{"data": {"serviceData": {"jobID": "test-job-id", "data": {"dataInputs": {"body": {"content": "#"}}}}}}`)
 		json.Unmarshal(body, outObj)
@@ -188,6 +220,13 @@ func TestRunIteration_BadTaskContent(t *testing.T) {
 	defer originalRequestJSON.Restore()
 	originalSendExecResult := setMockPzsvcSendExecResultNoData(func(pzsvc.Session, string, string, string, pzsvc.PiazzaStatus) *pzsvc.PzCustomError { return nil })
 	defer originalSendExecResult.Restore()
+	var rejectedStatus pzsvc.PiazzaStatus
+	var rejectedData []byte
+	originalSendExecResultData := setMockPzsvcSendExecResultData(func(_ pzsvc.Session, _, _, _ string, status pzsvc.PiazzaStatus, data []byte) *pzsvc.PzCustomError {
+		rejectedStatus, rejectedData = status, data
+		return nil
+	})
+	defer originalSendExecResultData.Restore()
 
 	// Test code
 	err := runIteration(loop)
@@ -195,6 +234,11 @@ func TestRunIteration_BadTaskContent(t *testing.T) {
 	// Asserts
 	assert.NotNil(t, err)
 	assert.Contains(t, err.Error(), "invalid character '#'")
+
+	// the job was failed in Piazza with the reason
+	assert.Equal(t, pzsvc.PiazzaStatusFail, rejectedStatus)
+	assert.Contains(t, string(rejectedData), "invalid character '#'")
+	assert.Empty(t, loop.dequeued.List())
 }
 
 func TestRunIteration_BadJobInput(t *testing.T) {
@@ -203,12 +247,17 @@ func TestRunIteration_BadJobInput(t *testing.T) {
 		vcapID:        "test-vcap-id",
 		SvcID:         "test-svc-id",
 		PzSession:     &pzsvc.Session{},
+		PzConfig:      pzsvc.Config{CanDownlExt: true},
 		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{}},
 		taskLimit:     10,
+		tasks:         newTaskTracker(),
+		dequeued:      newTaskTracker(),
+		pending:       newPendingQueue(10),
+		backoff:       newPollBackoff(),
 	}
 
-	originalGetS3FileSize := setMockPzsvcGetS3FileSizeInMegabytes(func(string) (int, *pzsvc.PzCustomError) { return 0, nil })
-	defer originalGetS3FileSize.Restore()
+	originalInputSize := setMockInputSize(func(string) (int64, error) { return 0, nil })
+	defer originalInputSize.Restore()
 	originalRequestJSON := setMockPzsvcRequestKnownJSON(func(_, _, _, _ string, outObj interface{}) ([]byte, *pzsvc.PzCustomError) {
 		body := []byte(`{"data": {"serviceData": {"jobID": "test-job-id", "data": {"dataInputs": {"body": {"content": "{\"inExtFiles\": [\"http:\/\/input.localdomain\/foo.txt\"], \"inExtNames\": [\"outA.geojson\", \"outB.geojson\"]}"}}}}}}`)
 		json.Unmarshal(body, outObj)
@@ -217,6 +266,13 @@ func TestRunIteration_BadJobInput(t *testing.T) {
 	defer originalRequestJSON.Restore()
 	originalSendExecResult := setMockPzsvcSendExecResultNoData(func(pzsvc.Session, string, string, string, pzsvc.PiazzaStatus) *pzsvc.PzCustomError { return nil })
 	defer originalSendExecResult.Restore()
+	var rejectedStatus pzsvc.PiazzaStatus
+	var rejectedData []byte
+	originalSendExecResultData := setMockPzsvcSendExecResultData(func(_ pzsvc.Session, _, _, _ string, status pzsvc.PiazzaStatus, data []byte) *pzsvc.PzCustomError {
+		rejectedStatus, rejectedData = status, data
+		return nil
+	})
+	defer originalSendExecResultData.Restore()
 
 	// Test code
 	err := runIteration(loop)
@@ -224,6 +280,11 @@ func TestRunIteration_BadJobInput(t *testing.T) {
 	// Asserts
 	assert.NotNil(t, err)
 	assert.Contains(t, err.Error(), "did not match") // XXX: this is kind of a bad check for a specific error already covered by another test
+
+	// the job was failed in Piazza with the reason
+	assert.Equal(t, pzsvc.PiazzaStatusFail, rejectedStatus)
+	assert.Contains(t, string(rejectedData), "did not match")
+	assert.Empty(t, loop.dequeued.List())
 }
 
 func TestRunIteration_ErrMemoryLimit(t *testing.T) {
@@ -232,12 +293,17 @@ func TestRunIteration_ErrMemoryLimit(t *testing.T) {
 		vcapID:        "test-vcap-id",
 		SvcID:         "test-svc-id",
 		PzSession:     &pzsvc.Session{},
+		PzConfig:      pzsvc.Config{CanDownlExt: true},
 		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{CreateTaskError: &cfwrapper.CustomMemoryLimitError{Message: "test memory limit error"}}},
 		taskLimit:     10,
+		tasks:         newTaskTracker(),
+		dequeued:      newTaskTracker(),
+		pending:       newPendingQueue(10),
+		backoff:       newPollBackoff(),
 	}
 
-	originalGetS3FileSize := setMockPzsvcGetS3FileSizeInMegabytes(func(string) (int, *pzsvc.PzCustomError) { return 0, nil })
-	defer originalGetS3FileSize.Restore()
+	originalInputSize := setMockInputSize(func(string) (int64, error) { return 0, nil })
+	defer originalInputSize.Restore()
 	originalRequestJSON := setMockPzsvcRequestKnownJSON(func(_, _, _, _ string, outObj interface{}) ([]byte, *pzsvc.PzCustomError) {
 		body := []byte(`{"data": {"serviceData": {"jobID": "test-job-id", "data": {"dataInputs": {"body": {"content": "{\"inExtFiles\": [\"http:\/\/input.localdomain\/foo.txt\"], \"inExtNames\": [\"output.geojson\"]}"}}}}}}`)
 		json.Unmarshal(body, outObj)
@@ -261,12 +327,17 @@ func TestRunIteration_ErrUnknown(t *testing.T) {
 		vcapID:        "test-vcap-id",
 		SvcID:         "test-svc-id",
 		PzSession:     &pzsvc.Session{},
+		PzConfig:      pzsvc.Config{CanDownlExt: true},
 		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{CreateTaskError: errors.New("test unknown error")}},
 		taskLimit:     10,
+		tasks:         newTaskTracker(),
+		dequeued:      newTaskTracker(),
+		pending:       newPendingQueue(10),
+		backoff:       newPollBackoff(),
 	}
 
-	originalGetS3FileSize := setMockPzsvcGetS3FileSizeInMegabytes(func(string) (int, *pzsvc.PzCustomError) { return 0, nil })
-	defer originalGetS3FileSize.Restore()
+	originalInputSize := setMockInputSize(func(string) (int64, error) { return 0, nil })
+	defer originalInputSize.Restore()
 	originalRequestJSON := setMockPzsvcRequestKnownJSON(func(_, _, _, _ string, outObj interface{}) ([]byte, *pzsvc.PzCustomError) {
 		body := []byte(`{"data": {"serviceData": {"jobID": "test-job-id", "data": {"dataInputs": {"body": {"content": "{\"inExtFiles\": [\"http:\/\/input.localdomain\/foo.txt\"], \"inExtNames\": [\"output.geojson\"]}"}}}}}}`)
 		json.Unmarshal(body, outObj)
@@ -283,3 +354,390 @@ func TestRunIteration_ErrUnknown(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Contains(t, err.Error(), "test unknown error")
 }
+
+func TestRunIteration_Success(t *testing.T) {
+	// Setup
+	loop := Loop{
+		vcapID:        "test-vcap-id",
+		SvcID:         "test-svc-id",
+		PzSession:     &pzsvc.Session{},
+		PzConfig:      pzsvc.Config{CanDownlExt: true},
+		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{TaskGUID: "test-task-guid"}},
+		taskLimit:     10,
+		tasks:         newTaskTracker(),
+		dequeued:      newTaskTracker(),
+		pending:       newPendingQueue(10),
+		backoff:       newPollBackoff(),
+	}
+
+	originalInputSize := setMockInputSize(func(string) (int64, error) { return 0, nil })
+	defer originalInputSize.Restore()
+	originalRequestJSON := setMockPzsvcRequestKnownJSON(func(_, _, _, _ string, outObj interface{}) ([]byte, *pzsvc.PzCustomError) {
+		body := []byte(`{"data": {"serviceData": {"jobId": "test-job-id", "data": {"dataInputs": {"body": {"content": "{\"inExtFiles\": [\"http:\/\/input.localdomain\/foo.txt\"], \"inExtNames\": [\"output.geojson\"]}"}}}}}}`)
+		json.Unmarshal(body, outObj)
+		return body, nil
+	})
+	defer originalRequestJSON.Restore()
+	originalSendExecResult := setMockPzsvcSendExecResultNoData(func(pzsvc.Session, string, string, string, pzsvc.PiazzaStatus) *pzsvc.PzCustomError { return nil })
+	defer originalSendExecResult.Restore()
+
+	// Test code
+	err := runIteration(loop)
+
+	// Asserts
+	assert.Nil(t, err)
+	trackedTasks := loop.tasks.List()
+	assert.Len(t, trackedTasks, 1)
+	assert.Equal(t, "test-job-id", trackedTasks[0].JobID)
+	assert.Equal(t, "test-task-guid", trackedTasks[0].TaskGUID)
+}
+
+func mockQueuedJobs(numJobs int, taskRequests *int) func(string, string, string, string, interface{}) ([]byte, *pzsvc.PzCustomError) {
+	return func(_, _, _, _ string, outObj interface{}) ([]byte, *pzsvc.PzCustomError) {
+		*taskRequests++
+		content := `{\"inExtFiles\": [\"http:\/\/input.localdomain\/foo.txt\"], \"inExtNames\": [\"output.geojson\"]}`
+		if *taskRequests > numJobs {
+			content = ""
+		}
+		body := []byte(fmt.Sprintf(`{"data": {"serviceData": {"jobId": "test-job-%d", "data": {"dataInputs": {"body": {"content": "%s"}}}}}}`, *taskRequests, content))
+		json.Unmarshal(body, outObj)
+		return body, nil
+	}
+}
+
+func TestRunIteration_FillsFreeSlots(t *testing.T) {
+	// Setup
+	loop := Loop{
+		vcapID:        "test-vcap-id",
+		SvcID:         "test-svc-id",
+		PzSession:     &pzsvc.Session{},
+		PzConfig:      pzsvc.Config{CanDownlExt: true},
+		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{NumTasks: 6}},
+		taskLimit:     10,
+		tasks:         newTaskTracker(),
+		dequeued:      newTaskTracker(),
+		pending:       newPendingQueue(10),
+		backoff:       newPollBackoff(),
+	}
+
+	taskRequests := 0
+	originalInputSize := setMockInputSize(func(string) (int64, error) { return 0, nil })
+	defer originalInputSize.Restore()
+	originalRequestJSON := setMockPzsvcRequestKnownJSON(mockQueuedJobs(100, &taskRequests))
+	defer originalRequestJSON.Restore()
+
+	// Test code
+	err := runIteration(loop)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, 4, taskRequests) // One job pulled per free slot
+	assert.Len(t, loop.tasks.List(), 4)
+}
+
+func TestRunIteration_SharedTaskCap(t *testing.T) {
+	// Setup
+	loop := Loop{
+		vcapID:        "test-vcap-id",
+		SvcID:         "test-svc-id",
+		PzSession:     &pzsvc.Session{},
+		PzConfig:      pzsvc.Config{CanDownlExt: true},
+		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{NumTasks: 6, TaskStates: map[string]string{"other-task-guid": cfwrapper.TaskStateRunning}}},
+		TaskCap:       NewTaskCap(8),
+		taskLimit:     3,
+		tasks:         newTaskTracker(),
+		dequeued:      newTaskTracker(),
+		pending:       newPendingQueue(10),
+		backoff:       newPollBackoff(),
+	}
+	loop.tasks.Add("other-job-id", "other-task-guid")
+
+	taskRequests := 0
+	originalInputSize := setMockInputSize(func(string) (int64, error) { return 0, nil })
+	defer originalInputSize.Restore()
+	originalRequestJSON := setMockPzsvcRequestKnownJSON(mockQueuedJobs(100, &taskRequests))
+	defer originalRequestJSON.Restore()
+
+	// Test code
+	err := runIteration(loop)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, 2, taskRequests) // 2 slots left for this service, and 2 under the cap
+	assert.Len(t, loop.tasks.List(), 3)
+}
+
+func TestRunIteration_SharedTaskCapLiveTasks(t *testing.T) {
+	// Setup
+	taskCap := NewTaskCap(10)
+	loop := Loop{
+		vcapID:    "test-vcap-id",
+		SvcID:     "test-svc-id",
+		PzSession: &pzsvc.Session{},
+		PzConfig:  pzsvc.Config{CanDownlExt: true},
+		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{TaskStates: map[string]string{
+			"running-task-guid":  cfwrapper.TaskStateRunning,
+			"finished-task-guid": cfwrapper.TaskStateSucceeded,
+		}}},
+		TaskCap:   taskCap,
+		taskLimit: 3,
+		tasks:     newTaskTracker(),
+		dequeued:  newTaskTracker(),
+		pending:   newPendingQueue(10),
+		backoff:   newPollBackoff(),
+	}
+	loop.tasks.Add("running-job-id", "running-task-guid")
+	loop.tasks.Add("finished-job-id", "finished-task-guid") // Not reconciled yet, but no longer using a slot
+
+	taskRequests := 0
+	lockFreeRequests := 0
+	originalInputSize := setMockInputSize(func(string) (int64, error) { return 0, nil })
+	defer originalInputSize.Restore()
+	queuedJobs := mockQueuedJobs(100, &taskRequests)
+	originalRequestJSON := setMockPzsvcRequestKnownJSON(func(method, bodyStr, url, authKey string, outObj interface{}) ([]byte, *pzsvc.PzCustomError) {
+		if taskCap.mutex.TryLock() {
+			lockFreeRequests++
+			taskCap.mutex.Unlock()
+		}
+		return queuedJobs(method, bodyStr, url, authKey, outObj)
+	})
+	defer originalRequestJSON.Restore()
+
+	// Test code
+	err := runIteration(loop)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, 2, taskRequests)
+	assert.Equal(t, 2, lockFreeRequests) // Piazza is polled without holding the cap's lock
+	assert.Equal(t, 0, taskCap.reserved)
+}
+
+func TestRunIteration_SharedTaskCapFull(t *testing.T) {
+	// Setup
+	loop := Loop{
+		vcapID:        "test-vcap-id",
+		SvcID:         "test-svc-id",
+		PzSession:     &pzsvc.Session{},
+		PzConfig:      pzsvc.Config{CanDownlExt: true},
+		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{NumTasks: 8}},
+		TaskCap:       NewTaskCap(8),
+		taskLimit:     3,
+		tasks:         newTaskTracker(),
+		dequeued:      newTaskTracker(),
+		pending:       newPendingQueue(10),
+		backoff:       newPollBackoff(),
+	}
+
+	taskRequests := 0
+	originalRequestJSON := setMockPzsvcRequestKnownJSON(mockQueuedJobs(100, &taskRequests))
+	defer originalRequestJSON.Restore()
+
+	// Test code
+	err := runIteration(loop)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, 0, taskRequests) // Other services' tasks fill the cap
+}
+
+func TestRunIteration_StopsOnEmptyQueue(t *testing.T) {
+	// Setup
+	loop := Loop{
+		vcapID:        "test-vcap-id",
+		SvcID:         "test-svc-id",
+		PzSession:     &pzsvc.Session{},
+		PzConfig:      pzsvc.Config{CanDownlExt: true},
+		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{}},
+		taskLimit:     10,
+		tasks:         newTaskTracker(),
+		dequeued:      newTaskTracker(),
+		pending:       newPendingQueue(10),
+		backoff:       newPollBackoff(),
+	}
+
+	taskRequests := 0
+	originalInputSize := setMockInputSize(func(string) (int64, error) { return 0, nil })
+	defer originalInputSize.Restore()
+	originalRequestJSON := setMockPzsvcRequestKnownJSON(mockQueuedJobs(3, &taskRequests))
+	defer originalRequestJSON.Restore()
+
+	// Test code
+	err := runIteration(loop)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, 4, taskRequests) // Three jobs, then an empty queue
+	assert.Len(t, loop.tasks.List(), 3)
+}
+
+func TestRunIteration_StopsOnMemoryLimit(t *testing.T) {
+	// Setup
+	loop := Loop{
+		vcapID:        "test-vcap-id",
+		SvcID:         "test-svc-id",
+		PzSession:     &pzsvc.Session{},
+		PzConfig:      pzsvc.Config{CanDownlExt: true},
+		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{CreateTaskError: &cfwrapper.CustomMemoryLimitError{Message: "test memory limit error"}}},
+		taskLimit:     10,
+		tasks:         newTaskTracker(),
+		dequeued:      newTaskTracker(),
+		pending:       newPendingQueue(10),
+		backoff:       newPollBackoff(),
+	}
+
+	taskRequests := 0
+	originalInputSize := setMockInputSize(func(string) (int64, error) { return 0, nil })
+	defer originalInputSize.Restore()
+	originalRequestJSON := setMockPzsvcRequestKnownJSON(mockQueuedJobs(100, &taskRequests))
+	defer originalRequestJSON.Restore()
+
+	// Test code
+	err := runIteration(loop)
+
+	// Asserts
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, taskRequests) // No more jobs should be pulled once CF memory is exhausted
+	assert.Equal(t, 1, loop.pending.Len())
+	assert.Len(t, loop.dequeued.List(), 1)
+}
+
+func TestRunIteration_RetriesPendingJobFirst(t *testing.T) {
+	// Setup
+	loop := Loop{
+		vcapID:        "test-vcap-id",
+		SvcID:         "test-svc-id",
+		PzSession:     &pzsvc.Session{},
+		PzConfig:      pzsvc.Config{CanDownlExt: true},
+		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{TaskGUID: "test-task-guid"}},
+		taskLimit:     10,
+		tasks:         newTaskTracker(),
+		dequeued:      newTaskTracker(),
+		pending:       newPendingQueue(10),
+		pendingMaxAge: time.Minute,
+		backoff:       newPollBackoff(),
+	}
+	loop.dequeued.Add("pending-job", "")
+	loop.pending.Push(pendingJob{JobID: "pending-job", Queued: time.Now()})
+
+	taskRequests := 0
+	originalRequestJSON := setMockPzsvcRequestKnownJSON(mockQueuedJobs(0, &taskRequests))
+	defer originalRequestJSON.Restore()
+
+	// Test code
+	err := runIteration(loop)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, 1, taskRequests) // Queue checked only after the pending job launched
+	assert.Equal(t, 0, loop.pending.Len())
+	assert.Empty(t, loop.dequeued.List())
+	assert.Len(t, loop.tasks.List(), 1)
+	assert.Equal(t, "pending-job", loop.tasks.List()[0].JobID)
+}
+
+func TestRunIteration_ExpiresPendingJob(t *testing.T) {
+	// Setup
+	loop := Loop{
+		vcapID:        "test-vcap-id",
+		SvcID:         "test-svc-id",
+		PzSession:     &pzsvc.Session{},
+		PzConfig:      pzsvc.Config{CanDownlExt: true},
+		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{NumTasks: 10}},
+		taskLimit:     10,
+		tasks:         newTaskTracker(),
+		dequeued:      newTaskTracker(),
+		pending:       newPendingQueue(10),
+		pendingMaxAge: time.Minute,
+		backoff:       newPollBackoff(),
+	}
+	loop.dequeued.Add("old-job", "")
+	loop.pending.Push(pendingJob{JobID: "old-job", Queued: time.Now().Add(-time.Hour)})
+	loop.dequeued.Add("new-job", "")
+	loop.pending.Push(pendingJob{JobID: "new-job", Queued: time.Now()})
+
+	failedJobs := []string{}
+	originalSendExecResult := setMockPzsvcSendExecResultNoData(func(_ pzsvc.Session, _, _, jobID string, status pzsvc.PiazzaStatus) *pzsvc.PzCustomError {
+		failedJobs = append(failedJobs, jobID+":"+string(status))
+		return nil
+	})
+	defer originalSendExecResult.Restore()
+
+	// Test code
+	err := runIteration(loop)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"old-job:Fail"}, failedJobs)
+	assert.Equal(t, 1, loop.pending.Len())
+}
+
+func TestRunIteration_PendingQueueFull(t *testing.T) {
+	// Setup
+	loop := Loop{
+		vcapID:        "test-vcap-id",
+		SvcID:         "test-svc-id",
+		PzSession:     &pzsvc.Session{},
+		PzConfig:      pzsvc.Config{CanDownlExt: true},
+		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{CreateTaskError: &cfwrapper.CustomMemoryLimitError{Message: "test memory limit error"}}},
+		taskLimit:     10,
+		tasks:         newTaskTracker(),
+		dequeued:      newTaskTracker(),
+		pending:       newPendingQueue(0),
+		backoff:       newPollBackoff(),
+	}
+
+	taskRequests := 0
+	originalInputSize := setMockInputSize(func(string) (int64, error) { return 0, nil })
+	defer originalInputSize.Restore()
+	originalRequestJSON := setMockPzsvcRequestKnownJSON(mockQueuedJobs(100, &taskRequests))
+	defer originalRequestJSON.Restore()
+	failedJobs := []string{}
+	originalSendExecResult := setMockPzsvcSendExecResultNoData(func(_ pzsvc.Session, _, _, jobID string, status pzsvc.PiazzaStatus) *pzsvc.PzCustomError {
+		failedJobs = append(failedJobs, jobID+":"+string(status))
+		return nil
+	})
+	defer originalSendExecResult.Restore()
+
+	// Test code
+	err := runIteration(loop)
+
+	// Asserts
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"test-job-1:Fail"}, failedJobs)
+	assert.Empty(t, loop.dequeued.List())
+}
+
+func TestRunIteration_Backoff(t *testing.T) {
+	// Setup
+	loop := Loop{
+		vcapID:        "test-vcap-id",
+		SvcID:         "test-svc-id",
+		PzSession:     &pzsvc.Session{},
+		PzConfig:      pzsvc.Config{CanDownlExt: true},
+		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{}},
+		taskLimit:     10,
+		tasks:         newTaskTracker(),
+		dequeued:      newTaskTracker(),
+		pending:       newPendingQueue(10),
+		backoff:       newPollBackoff(),
+	}
+
+	taskRequests := 0
+	originalInputSize := setMockInputSize(func(string) (int64, error) { return 0, nil })
+	defer originalInputSize.Restore()
+	originalRequestJSON := setMockPzsvcRequestKnownJSON(mockQueuedJobs(0, &taskRequests))
+	defer originalRequestJSON.Restore()
+
+	// Test code
+	runIteration(loop)
+	runIteration(loop)
+	idleLevel := loop.backoff.level
+	setMockPzsvcRequestKnownJSON(mockQueuedJobs(1, new(int)))
+	runIteration(loop)
+	busyLevel := loop.backoff.level
+
+	// Asserts
+	assert.Equal(t, uint(2), idleLevel) // Backed off twice on an empty queue
+	assert.Equal(t, uint(0), busyLevel) // Snapped back once work appeared
+}
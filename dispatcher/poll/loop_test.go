@@ -1,14 +1,19 @@
 package poll
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/venicegeo/pzsvc-exec/pzsvc"
+	"github.com/venicegeo/pzsvc-exec/worker/config"
 )
 
 func TestNewLoop_BadVCAP(t *testing.T) {
@@ -74,6 +79,9 @@ func TestLoop_StartStop(t *testing.T) {
 	loop.intervalTick = 5 * time.Millisecond
 	loop.runIterationFunc = func(l Loop) error {
 		iterations++
+		if iterations == 10 {
+			loop.Stop()
+		}
 		if iterations%2 == 0 {
 			errorsEmitted++
 			return errors.New("Test error")
@@ -82,29 +90,25 @@ func TestLoop_StartStop(t *testing.T) {
 	}
 
 	// Tested code
+	started := time.Now()
 	errChan := loop.Start()
-	go func() {
-		<-time.After(50 * time.Millisecond)
-		loop.Stop()
-	}()
 	for range errChan {
 		errorsReceived++
 	}
+	elapsed := time.Since(started)
 
-	// Asserts
-	assert.Condition(t, func() bool {
-		return 10-iterations <= 1
-	})
+	// Asserts: ten iterations, none of them early, and none held up by the others
+	assert.Equal(t, 10, iterations)
+	assert.True(t, elapsed >= 50*time.Millisecond, "iterations ran early: %v", elapsed)
+	assert.True(t, elapsed < time.Second, "iterations ran late: %v", elapsed)
 	assert.Equal(t, errorsEmitted, errorsReceived)
 }
 
-func TestLoop_CalculateDiskAndMemoryLimits_NonS3(t *testing.T) {
-	// With at least one non-S3 source, the result should be the default disk/memory sizes
+func TestLoop_CalculateDiskAndMemoryLimits_UnsupportedScheme(t *testing.T) {
+	// With at least one source of a scheme that has no fetcher, the result should be the default disk/memory sizes
 
 	// Setup
-	original := setMockPzsvcGetS3FileSizeInMegabytes(func(string) (int, *pzsvc.PzCustomError) { return 128, nil })
-	defer original.Restore()
-	jobInput := pzsvc.InpStruct{InExtFiles: []string{"https://s3.amazonaws.localdomain/file1.txt", "https://not-aws.somehost.com"}}
+	jobInput := pzsvc.InpStruct{InExtFiles: []string{"data:,test%20data", "ftp://somehost.localdomain/file2.tif"}}
 	loop := Loop{PzSession: &pzsvc.Session{}}
 
 	// Tested code
@@ -115,18 +119,18 @@ func TestLoop_CalculateDiskAndMemoryLimits_NonS3(t *testing.T) {
 	assert.Equal(t, defaultTaskMemoryMB, memoryMB)
 }
 
-func TestLoop_CalculateDiskAndMemoryLimits_S3Error(t *testing.T) {
-	// With at least one S3 source returning an error, the result should be the default disk/memory sizes
+func TestLoop_CalculateDiskAndMemoryLimits_SizeError(t *testing.T) {
+	// With at least one source returning an error, the result should be the default disk/memory sizes
 
 	// Setup
-	original := setMockPzsvcGetS3FileSizeInMegabytes(func(url string) (int, *pzsvc.PzCustomError) {
+	original := setMockInputSize(func(url string) (int64, error) {
 		if strings.Contains(url, "file2.tif") {
-			return 0, &pzsvc.PzCustomError{}
+			return 0, errors.New("Test error")
 		}
-		return 128, nil
+		return 128000000, nil
 	})
 	defer original.Restore()
-	jobInput := pzsvc.InpStruct{InExtFiles: []string{"https://s3.amazonaws.localdomain/file1.txt", "https://s3.amazonaws.localdomain/file2.tif", "https://s3.amazonaws.localdomain/file3.jp2"}}
+	jobInput := pzsvc.InpStruct{InExtFiles: []string{"https://s3.amazonaws.localdomain/file1.txt", "s3://bucket/file2.tif", "https://somehost.localdomain/file3.jp2"}}
 	loop := Loop{PzSession: &pzsvc.Session{}}
 
 	// Tested code
@@ -139,9 +143,9 @@ func TestLoop_CalculateDiskAndMemoryLimits_S3Error(t *testing.T) {
 
 func TestLoop_CalculateDiskAndMemoryLimits_Success(t *testing.T) {
 	// Setup
-	original := setMockPzsvcGetS3FileSizeInMegabytes(func(url string) (int, *pzsvc.PzCustomError) { return 128, nil })
+	original := setMockInputSize(func(url string) (int64, error) { return 128000000, nil })
 	defer original.Restore()
-	jobInput := pzsvc.InpStruct{InExtFiles: []string{"https://s3.amazonaws.localdomain/file1.txt", "https://s3.amazonaws.localdomain/file2.tif"}}
+	jobInput := pzsvc.InpStruct{InExtFiles: []string{"https://s3.amazonaws.localdomain/file1.txt", "s3://bucket/file2.tif"}}
 	loop := Loop{PzSession: &pzsvc.Session{}}
 
 	// Tested code
@@ -152,9 +156,26 @@ func TestLoop_CalculateDiskAndMemoryLimits_Success(t *testing.T) {
 	assert.Equal(t, defaultTaskMemoryMB+(128+128)*5, memoryMB)
 }
 
+func TestLoop_CalculateDiskAndMemoryLimits_HTTPSize(t *testing.T) {
+	// Setup
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "300000000")
+	}))
+	defer server.Close()
+	jobInput := pzsvc.InpStruct{InExtFiles: []string{server.URL + "/file1.tif"}}
+	loop := Loop{PzSession: &pzsvc.Session{}}
+
+	// Tested code
+	diskMB, memoryMB := loop.calculateDiskAndMemoryLimits(&jobInput)
+
+	// Asserts
+	assert.Equal(t, 4096+300*2, diskMB)
+	assert.Equal(t, defaultTaskMemoryMB+300*5, memoryMB)
+}
+
 func TestLoop_BuildWorkerCommand_BadInput(t *testing.T) {
 	// Setup
-	loop := Loop{PzSession: &pzsvc.Session{}, ConfigPath: "/path/to/config", SvcID: "test-svcid-123"}
+	loop := Loop{PzSession: &pzsvc.Session{}, PzConfig: pzsvc.Config{CanDownlExt: true}, ConfigPath: "/path/to/config", SvcID: "test-svcid-123"}
 	jobInput := pzsvc.InpStruct{
 		Command:    "test-command-extra",
 		UserID:     "test-user-123",
@@ -164,7 +185,7 @@ func TestLoop_BuildWorkerCommand_BadInput(t *testing.T) {
 	}
 
 	// Tested code
-	command, err := loop.buildWorkerCommand(&jobInput, "job-id-123")
+	command, err := loop.buildWorkerCommand(&jobInput, nil, "job-id-123")
 
 	// Asserts
 	assert.Empty(t, command)
@@ -174,7 +195,7 @@ func TestLoop_BuildWorkerCommand_BadInput(t *testing.T) {
 
 func TestLoop_BuildWorkerCommand_Success(t *testing.T) {
 	// Setup
-	loop := Loop{PzSession: &pzsvc.Session{}, ConfigPath: "/path/to/config", SvcID: "test-svcid-123"}
+	loop := Loop{PzSession: &pzsvc.Session{}, PzConfig: pzsvc.Config{CanDownlExt: true}, ConfigPath: "/path/to/config", SvcID: "test-svcid-123"}
 	jobInput := pzsvc.InpStruct{
 		Command:    "test-command-extra",
 		UserID:     "test-user-123",
@@ -184,14 +205,383 @@ func TestLoop_BuildWorkerCommand_Success(t *testing.T) {
 	}
 
 	// Tested code
-	command, err := loop.buildWorkerCommand(&jobInput, "job-id-123")
+	command, err := loop.buildWorkerCommand(&jobInput, nil, "job-id-123")
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(command, "worker --jobSpec "))
+	jobSpec, err := config.DecodeJobSpec(strings.TrimPrefix(command, "worker --jobSpec "))
+	assert.Nil(t, err)
+	assert.Equal(t, config.JobSpec{
+		Version:         config.JobSpecVersion,
+		ConfigPath:      "/path/to/config",
+		ServiceID:       "test-svcid-123",
+		JobID:           "job-id-123",
+		UserID:          "test-user-123",
+		CLICommandExtra: "test-command-extra",
+		Inputs: []config.InputSource{
+			{FileName: "inputFile1.txt", URL: "https://s3.amazonaws.localdomain/file1.txt"},
+			{FileName: "inputFile2.tif", URL: "https://s3.amazonaws.localdomain/file2.tif"},
+		},
+		Outputs: []string{"output1.geojson", "output2.geojson"},
+		OutputTypes: map[string]string{
+			"output1.geojson": "geojson",
+			"output2.geojson": "geojson",
+		},
+	}, *jobSpec)
+}
+
+func TestLoop_BuildWorkerCommand_TypedOutputs(t *testing.T) {
+	// Setup
+	loop := Loop{PzSession: &pzsvc.Session{}, PzConfig: pzsvc.Config{CanDownlExt: true}, ConfigPath: "/path/to/config", SvcID: "test-svcid-123"}
+	jobInput := pzsvc.InpStruct{
+		OutGeoJs: []string{"output.geojson"},
+		OutTiffs: []string{"output.tif"},
+		OutTxts:  []string{"output.json"},
+	}
+
+	// Tested code
+	command, err := loop.buildWorkerCommand(&jobInput, nil, "job-id-123")
+
+	// Asserts
+	assert.Nil(t, err)
+	jobSpec, err := config.DecodeJobSpec(strings.TrimPrefix(command, "worker --jobSpec "))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"output.geojson", "output.tif", "output.json"}, jobSpec.Outputs)
+	assert.Equal(t, map[string]string{"output.geojson": "geojson", "output.tif": "raster", "output.json": "text"}, jobSpec.OutputTypes)
+}
+
+func TestLoop_BuildWorkerCommand_ConflictingOutputs(t *testing.T) {
+	// Setup
+	loop := Loop{PzSession: &pzsvc.Session{}, PzConfig: pzsvc.Config{CanDownlExt: true}, ConfigPath: "/path/to/config", SvcID: "test-svcid-123"}
+	jobInput := pzsvc.InpStruct{
+		OutTiffs: []string{"output.dat"},
+		OutTxts:  []string{"output.dat"},
+	}
+
+	// Tested code
+	command, err := loop.buildWorkerCommand(&jobInput, nil, "job-id-123")
+
+	// Asserts
+	assert.Empty(t, command)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "requested as both raster and text")
+}
+
+func TestLoop_BuildWorkerCommand_PiazzaInputs(t *testing.T) {
+	// Setup
+	loop := Loop{PzSession: &pzsvc.Session{}, PzConfig: pzsvc.Config{CanDownlPz: true, CanDownlExt: true}, ConfigPath: "/path/to/config", SvcID: "test-svcid-123"}
+	jobInput := pzsvc.InpStruct{
+		InExtNames: []string{"inputFile1.txt"},
+		InExtFiles: []string{"https://s3.amazonaws.localdomain/file1.txt"},
+		InPzNames:  []string{"inputFile2.tif"},
+		InPzFiles:  []string{"test-data-id"},
+	}
+
+	// Tested code
+	command, err := loop.buildWorkerCommand(&jobInput, nil, "job-id-123")
+
+	// Asserts
+	assert.Nil(t, err)
+	jobSpec, err := config.DecodeJobSpec(strings.TrimPrefix(command, "worker --jobSpec "))
+	assert.Nil(t, err)
+	assert.Equal(t, []config.InputSource{
+		{FileName: "inputFile1.txt", URL: "https://s3.amazonaws.localdomain/file1.txt"},
+		{FileName: "inputFile2.tif", DataID: "test-data-id"},
+	}, jobSpec.Inputs)
+}
+
+func TestLoop_BuildWorkerCommand_PiazzaInputsNotPermitted(t *testing.T) {
+	// Setup
+	loop := Loop{PzSession: &pzsvc.Session{}, PzConfig: pzsvc.Config{CanDownlPz: false, CanDownlExt: true}, ConfigPath: "/path/to/config", SvcID: "test-svcid-123"}
+	jobInput := pzsvc.InpStruct{
+		InPzNames: []string{"inputFile2.tif"},
+		InPzFiles: []string{"test-data-id"},
+	}
+
+	// Tested code
+	command, err := loop.buildWorkerCommand(&jobInput, nil, "job-id-123")
+
+	// Asserts
+	assert.Empty(t, command)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "CanDownlPz")
+}
+
+func TestLoop_BuildWorkerCommand_ExternalInputsNotPermitted(t *testing.T) {
+	// Setup
+	loop := Loop{PzSession: &pzsvc.Session{}, PzConfig: pzsvc.Config{CanDownlExt: false}, ConfigPath: "/path/to/config", SvcID: "test-svcid-123"}
+	jobInput := pzsvc.InpStruct{
+		InExtNames: []string{"inputFile1.txt"},
+		InExtFiles: []string{"https://s3.amazonaws.localdomain/file1.txt"},
+	}
+
+	// Tested code
+	command, err := loop.buildWorkerCommand(&jobInput, nil, "job-id-123")
+
+	// Asserts
+	assert.Empty(t, command)
+	assert.Contains(t, err.Error(), "CanDownlExt")
+}
+
+func TestLoop_BuildWorkerCommand_Credentials(t *testing.T) {
+	// Setup
+	mockSecretKey := setMockEnv("JOB_SECRET_KEY", "test-secret")
+	defer mockSecretKey.Restore()
+	loop := Loop{PzSession: &pzsvc.Session{}, PzConfig: pzsvc.Config{CanDownlExt: true}, ConfigPath: "/path/to/config", SvcID: "test-svcid-123"}
+	jobInput := pzsvc.InpStruct{
+		InExtNames: []string{"inputFile1.txt"},
+		InExtFiles: []string{"https://s3.amazonaws.localdomain/file1.txt"},
+	}
+	credentials := []config.Credential{{Hosts: []string{"s3.amazonaws.localdomain"}, Headers: map[string]string{"Authorization": "test-ext-auth-key"}}}
+
+	// Tested code
+	command, err := loop.buildWorkerCommand(&jobInput, credentials, "job-id-123")
 
 	// Asserts
 	assert.Nil(t, err)
-	assert.Equal(t, `worker --cliExtra 'test-command-extra' --userID 'test-user-123'`+
-		` --config '/path/to/config' --serviceID 'test-svcid-123' --jobID 'job-id-123'`+
-		` -i inputFile1.txt:https://s3.amazonaws.localdomain/file1.txt -i inputFile2.tif:https://s3.amazonaws.localdomain/file2.tif`+
-		` -o output1.geojson -o output2.geojson`, command)
+	assert.NotContains(t, command, "test-ext-auth-key")
+	jobSpec, err := config.DecodeJobSpec(strings.TrimPrefix(command, "worker --jobSpec "))
+	assert.Nil(t, err)
+	opened, err := config.OpenCredentials(jobSpec.Credentials)
+	assert.Nil(t, err)
+	assert.Equal(t, credentials, opened)
+}
+
+func TestLoop_BuildWorkerCommand_CredentialsNoSecretKey(t *testing.T) {
+	// Setup
+	mockSecretKey := setMockEnv("JOB_SECRET_KEY", "")
+	defer mockSecretKey.Restore()
+	loop := Loop{PzSession: &pzsvc.Session{}, PzConfig: pzsvc.Config{CanDownlExt: true}, ConfigPath: "/path/to/config", SvcID: "test-svcid-123"}
+	jobInput := pzsvc.InpStruct{
+		InExtNames: []string{"inputFile1.txt"},
+		InExtFiles: []string{"https://s3.amazonaws.localdomain/file1.txt"},
+	}
+	credentials := []config.Credential{{Hosts: []string{"s3.amazonaws.localdomain"}, Headers: map[string]string{"Authorization": "test-ext-auth-key"}}}
+
+	// Tested code
+	command, err := loop.buildWorkerCommand(&jobInput, credentials, "job-id-123")
+
+	// Asserts
+	assert.Empty(t, command)
+	assert.Contains(t, err.Error(), "JOB_SECRET_KEY")
+}
+
+func TestLoop_BuildWorkerCommand_ShellSafe(t *testing.T) {
+	// Setup
+	loop := Loop{PzSession: &pzsvc.Session{}, PzConfig: pzsvc.Config{CanDownlExt: true}, ConfigPath: "/path/to/config", SvcID: "test-svcid-123"}
+	jobInput := pzsvc.InpStruct{
+		Command: "--name 'x'; rm -rf / #",
+		UserID:  "o'brien",
+	}
+
+	// Tested code
+	command, err := loop.buildWorkerCommand(&jobInput, nil, "job-id-123")
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.NotContains(t, command, "'")
+	assert.NotContains(t, command, ";")
+	jobSpec, err := config.DecodeJobSpec(strings.TrimPrefix(command, "worker --jobSpec "))
+	assert.Nil(t, err)
+	assert.Equal(t, "--name 'x'; rm -rf / #", jobSpec.CLICommandExtra)
+	assert.Equal(t, "o'brien", jobSpec.UserID)
+}
+
+func TestLoop_BuildWorkerCommand_Params(t *testing.T) {
+	// Setup
+	loop := Loop{PzSession: &pzsvc.Session{}, PzConfig: pzsvc.Config{CanDownlExt: true}, ConfigPath: "/path/to/config", SvcID: "test-svcid-123"}
+	loop.PzConfig.Params = []pzsvc.ParamSpec{
+		{Name: "image", Required: true},
+		{Name: "bands", Flag: "-b", Type: "int"},
+	}
+	jobInput := pzsvc.InpStruct{Params: map[string]interface{}{"bands": 3.0, "image": "in.tif; rm -rf /"}}
+
+	// Tested code
+	command, err := loop.buildWorkerCommand(&jobInput, nil, "job-id-123")
+
+	// Asserts
+	assert.Nil(t, err)
+	jobSpec, err := config.DecodeJobSpec(strings.TrimPrefix(command, "worker --jobSpec "))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"in.tif; rm -rf /", "-b", "3"}, jobSpec.Args)
+	assert.Empty(t, jobSpec.CLICommandExtra)
+}
+
+func TestLoop_BuildWorkerCommand_InvalidParams(t *testing.T) {
+	// Setup
+	loop := Loop{PzSession: &pzsvc.Session{}, PzConfig: pzsvc.Config{CanDownlExt: true}, ConfigPath: "/path/to/config", SvcID: "test-svcid-123"}
+	loop.PzConfig.Params = []pzsvc.ParamSpec{{Name: "bands", Flag: "-b", Type: "int"}}
+	loopNoParams := Loop{PzSession: &pzsvc.Session{}, ConfigPath: "/path/to/config", SvcID: "test-svcid-123"}
+
+	// Tested code
+	_, errInvalid := loop.buildWorkerCommand(&pzsvc.InpStruct{Params: map[string]interface{}{"bands": "many"}}, nil, "job-id-123")
+	_, errCmd := loop.buildWorkerCommand(&pzsvc.InpStruct{Command: "-b 3"}, nil, "job-id-123")
+	_, errUndeclared := loopNoParams.buildWorkerCommand(&pzsvc.InpStruct{Params: map[string]interface{}{"bands": 3.0}}, nil, "job-id-123")
+
+	// Asserts
+	assert.Contains(t, errInvalid.Error(), "bands must be a number")
+	assert.Contains(t, errCmd.Error(), "free-form cmd text is not permitted")
+	assert.Contains(t, errUndeclared.Error(), "does not declare any params")
+}
+
+func TestLoop_BuildWorkerCommand_InputChecks(t *testing.T) {
+	// Setup
+	loop := Loop{PzSession: &pzsvc.Session{}, PzConfig: pzsvc.Config{CanDownlExt: true}, ConfigPath: "/path/to/config", SvcID: "test-svcid-123"}
+	jobInput := pzsvc.InpStruct{
+		InExtNames:  []string{"inputFile1.txt", "inputFile2.tif"},
+		InExtFiles:  []string{"https://s3.amazonaws.localdomain/file1.txt", "https://s3.amazonaws.localdomain/file2.tif"},
+		InChecksums: map[string]string{"inputFile2.tif": "md5:098f6bcd4621d373cade4e832627b4f6"},
+		InSizes:     map[string]int64{"inputFile1.txt": 1024},
+	}
+
+	// Tested code
+	command, err := loop.buildWorkerCommand(&jobInput, nil, "job-id-123")
+
+	// Asserts
+	assert.Nil(t, err)
+	jobSpec, err := config.DecodeJobSpec(strings.TrimPrefix(command, "worker --jobSpec "))
+	assert.Nil(t, err)
+	assert.Equal(t, []config.InputSource{
+		{FileName: "inputFile1.txt", URL: "https://s3.amazonaws.localdomain/file1.txt", Size: 1024},
+		{FileName: "inputFile2.tif", URL: "https://s3.amazonaws.localdomain/file2.tif", Checksum: "md5:098f6bcd4621d373cade4e832627b4f6"},
+	}, jobSpec.Inputs)
+}
+
+func TestLoop_BuildWorkerCommand_InvalidInputChecks(t *testing.T) {
+	// Setup
+	loop := Loop{PzSession: &pzsvc.Session{}, PzConfig: pzsvc.Config{CanDownlExt: true}, ConfigPath: "/path/to/config", SvcID: "test-svcid-123"}
+	newJobInput := func() pzsvc.InpStruct {
+		return pzsvc.InpStruct{InExtNames: []string{"inputFile1.txt"}, InExtFiles: []string{"https://s3.amazonaws.localdomain/file1.txt"}}
+	}
+	unknownChecksum := newJobInput()
+	unknownChecksum.InChecksums = map[string]string{"other.txt": "md5:098f6bcd4621d373cade4e832627b4f6"}
+	badChecksum := newJobInput()
+	badChecksum.InChecksums = map[string]string{"inputFile1.txt": "crc32:d87f7e0c"}
+	badSize := newJobInput()
+	badSize.InSizes = map[string]int64{"inputFile1.txt": -1}
+
+	// Tested code
+	_, errUnknown := loop.buildWorkerCommand(&unknownChecksum, nil, "job-id-123")
+	_, errChecksum := loop.buildWorkerCommand(&badChecksum, nil, "job-id-123")
+	_, errSize := loop.buildWorkerCommand(&badSize, nil, "job-id-123")
+
+	// Asserts
+	assert.Contains(t, errUnknown.Error(), "other.txt, which is not an input of the job")
+	assert.Contains(t, errChecksum.Error(), "Unsupported checksum algorithm crc32")
+	assert.Contains(t, errSize.Error(), "must be positive")
+}
+
+func TestLoop_BuildWorkerCommand_InputExtracts(t *testing.T) {
+	// Setup
+	loop := Loop{PzSession: &pzsvc.Session{}, PzConfig: pzsvc.Config{CanDownlExt: true}, ConfigPath: "/path/to/config", SvcID: "test-svcid-123"}
+	jobInput := pzsvc.InpStruct{
+		InExtNames: []string{"scene.zip"},
+		InExtFiles: []string{"https://s3.amazonaws.localdomain/scene.zip"},
+		InExtract:  map[string]string{"scene.zip": "scene/"},
+	}
+
+	// Tested code
+	command, err := loop.buildWorkerCommand(&jobInput, nil, "job-id-123")
+
+	// Asserts
+	assert.Nil(t, err)
+	jobSpec, err := config.DecodeJobSpec(strings.TrimPrefix(command, "worker --jobSpec "))
+	assert.Nil(t, err)
+	assert.Equal(t, []config.InputSource{
+		{FileName: "scene.zip", URL: "https://s3.amazonaws.localdomain/scene.zip", ExtractTo: "scene"},
+	}, jobSpec.Inputs)
+}
+
+func TestLoop_BuildWorkerCommand_InvalidInputExtracts(t *testing.T) {
+	// Setup
+	loop := Loop{PzSession: &pzsvc.Session{}, PzConfig: pzsvc.Config{CanDownlExt: true}, ConfigPath: "/path/to/config", SvcID: "test-svcid-123"}
+	extracts := []map[string]string{
+		{"other.zip": "scene"},
+		{"scene.zip": "../scene"},
+		{"scene.zip": "/tmp/scene"},
+		{"scene.zip": "."},
+		{"scene.zip": "scene.zip"},
+	}
+	expectedErrors := []string{
+		"other.zip, which is not an input of the job",
+		"must be a subdirectory of the working directory",
+		"must be a subdirectory of the working directory",
+		"must be a subdirectory of the working directory",
+		"is also the name of an input",
+	}
+
+	for i, extract := range extracts {
+		jobInput := pzsvc.InpStruct{
+			InExtNames: []string{"scene.zip"},
+			InExtFiles: []string{"https://s3.amazonaws.localdomain/scene.zip"},
+			InExtract:  extract,
+		}
+
+		// Tested code
+		_, err := loop.buildWorkerCommand(&jobInput, nil, "job-id-123")
+
+		// Asserts
+		assert.Contains(t, err.Error(), expectedErrors[i])
+	}
+}
+
+func TestLoop_BuildWorkerCommand_EscapingFileNames(t *testing.T) {
+	// Setup
+	loop := Loop{PzSession: &pzsvc.Session{}, PzConfig: pzsvc.Config{CanDownlExt: true, CanDownlPz: true}, ConfigPath: "/path/to/config", SvcID: "test-svcid-123"}
+	jobInputs := []pzsvc.InpStruct{
+		{InExtNames: []string{"/etc/cron.d/job"}, InExtFiles: []string{"https://s3.amazonaws.localdomain/file1.txt"}},
+		{InExtNames: []string{"../../home/vcap/.profile"}, InExtFiles: []string{"https://s3.amazonaws.localdomain/file1.txt"}},
+		{InPzNames: []string{"sub/../../escaped.tif"}, InPzFiles: []string{"test-data-id"}},
+		{OutTxts: []string{"../../proc/self/environ"}},
+		{OutGeoJs: []string{"/proc/self/environ"}},
+	}
+
+	for _, jobInput := range jobInputs {
+		// Tested code
+		command, err := loop.buildWorkerCommand(&jobInput, nil, "job-id-123")
+
+		// Asserts
+		assert.Empty(t, command)
+		assert.Contains(t, err.Error(), "must be relative to the working directory")
+	}
+}
+
+func TestLoop_BuildWorkerCommand_DataURITooLarge(t *testing.T) {
+	// Setup
+	loop := Loop{PzSession: &pzsvc.Session{}, PzConfig: pzsvc.Config{CanDownlExt: true}, ConfigPath: "/path/to/config", SvcID: "test-svcid-123"}
+	jobInput := pzsvc.InpStruct{
+		InExtNames: []string{"small.txt", "large.txt"},
+		InExtFiles: []string{"data:,test%20data", "data:," + strings.Repeat("a", 1<<20)},
+	}
+
+	// Tested code
+	command, err := loop.buildWorkerCommand(&jobInput, nil, "job-id-123")
+
+	// Asserts
+	assert.Empty(t, command)
+	assert.Contains(t, err.Error(), "Input large.txt: data URI holds more than the limit")
+}
+
+func TestLoop_BuildWorkerCommand_JobSpecTooLarge(t *testing.T) {
+	// Setup: each data: URI is within its limit, but together they make too long a command
+	loop := Loop{PzSession: &pzsvc.Session{}, PzConfig: pzsvc.Config{CanDownlExt: true}, ConfigPath: "/path/to/config", SvcID: "test-svcid-123"}
+	randomData := make([]byte, 60000)
+	jobInput := pzsvc.InpStruct{InExtNames: []string{"first.bin", "second.bin"}}
+	for range jobInput.InExtNames {
+		rand.Read(randomData)
+		jobInput.InExtFiles = append(jobInput.InExtFiles, "data:;base64,"+base64.StdEncoding.EncodeToString(randomData))
+	}
+
+	// Tested code
+	command, err := loop.buildWorkerCommand(&jobInput, nil, "job-id-123")
+	firstCommand, errFirst := loop.buildWorkerCommand(&pzsvc.InpStruct{InExtNames: jobInput.InExtNames[:1], InExtFiles: jobInput.InExtFiles[:1]}, nil, "job-id-123")
+
+	// Asserts
+	assert.Empty(t, command)
+	assert.Contains(t, err.Error(), "Job is too large to pass to its task")
+	assert.Nil(t, errFirst)
+	assert.NotEmpty(t, firstCommand)
 }
 
 func TestLoop_ParseJobInput_BadInput(t *testing.T) {
@@ -200,7 +590,7 @@ func TestLoop_ParseJobInput_BadInput(t *testing.T) {
 	jobInputStr := "this is bad json"
 
 	// Tested code
-	jobInput, err := loop.parseJobInput(jobInputStr)
+	jobInput, _, err := loop.parseJobInput(jobInputStr)
 
 	// Asserts
 	assert.Nil(t, jobInput)
@@ -226,10 +616,13 @@ func TestLoop_ParseJobInput_Success(t *testing.T) {
 	}`
 
 	// Tested code
-	jobInput, err := loop.parseJobInput(jobInputStr)
+	jobInput, credentials, err := loop.parseJobInput(jobInputStr)
 
 	// Asserts
 	assert.Nil(t, err)
+	assert.Equal(t, []config.Credential{
+		{Hosts: []string{"s3.amazonaws.localdomain"}, Headers: map[string]string{"Authorization": "test-ext-auth-key"}},
+	}, credentials)
 	assert.Equal(t, pzsvc.InpStruct{
 		Command:    "test-command",
 		UserID:     "test-user-id",
@@ -246,6 +639,53 @@ func TestLoop_ParseJobInput_Success(t *testing.T) {
 	}, *jobInput)
 }
 
+func TestLoop_ParseJobInput_Credentials(t *testing.T) {
+	// Setup
+	loop := Loop{PzSession: &pzsvc.Session{}}
+	jobInputStr := `{
+		"inExtFiles": ["https://images.localdomain/scene.tif", "http://catalog.localdomain:8443/scene.json"],
+		"inExtNames": ["scene.tif", "scene.json"],
+		"inExtAuthKey": "Basic dGVzdA==",
+		"inExtAuthHosts": ["*.localdomain"],
+		"inExtTokens": {"scene.tif": "test-token"},
+		"inExtHeaders": {"scene.tif": {"X-Api-Key": "test-api-key"}, "scene.json": {"X-Api-Key": "test-other-key"}}
+	}`
+
+	// Tested code
+	jobInput, credentials, err := loop.parseJobInput(jobInputStr)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, []config.Credential{
+		{Hosts: []string{"*.localdomain"}, HTTPHosts: []string{"catalog.localdomain:8443"}, Headers: map[string]string{"Authorization": "Basic dGVzdA=="}},
+		{Hosts: []string{"catalog.localdomain:8443"}, Input: "scene.json", HTTPHosts: []string{"catalog.localdomain:8443"}, Headers: map[string]string{"X-Api-Key": "test-other-key"}},
+		{Hosts: []string{"images.localdomain"}, Input: "scene.tif", Headers: map[string]string{"Authorization": "Bearer test-token", "X-Api-Key": "test-api-key"}},
+	}, credentials)
+	assert.Equal(t, "*****", jobInput.ExtAuth)
+	assert.Equal(t, map[string]string{"scene.tif": "*****"}, jobInput.ExtTokens)
+	assert.Equal(t, map[string]map[string]string{"scene.tif": {"X-Api-Key": "*****"}, "scene.json": {"X-Api-Key": "*****"}}, jobInput.ExtHeaders)
+}
+
+func TestLoop_ParseJobInput_BadCredentials(t *testing.T) {
+	// Setup
+	loop := Loop{PzSession: &pzsvc.Session{}}
+	jobInputStrs := []string{
+		`{"inExtFiles": ["https://images.localdomain/scene.tif"], "inExtNames": ["scene.tif"], "inExtHeaders": {"scene.tif": {"Bad Header": "x"}}}`,
+		`{"inExtFiles": ["https://images.localdomain/scene.tif"], "inExtNames": ["scene.tif"], "inExtHeaders": {"scene.tif": {"X-Api-Key": "x\r\nHost: evil"}}}`,
+		`{"inExtFiles": ["https://images.localdomain/scene.tif"], "inExtNames": ["scene.tif"], "inExtTokens": {"other.tif": "test-token"}}`,
+	}
+	expectedErrors := []string{"is not a valid HTTP header", "is not a valid HTTP header", "which is not an external input of the job"}
+
+	for i, jobInputStr := range jobInputStrs {
+		// Tested code
+		jobInput, _, err := loop.parseJobInput(jobInputStr)
+
+		// Asserts
+		assert.Nil(t, jobInput)
+		assert.Contains(t, err.Error(), expectedErrors[i])
+	}
+}
+
 func TestLoop_GetPzTaskItem_Failure(t *testing.T) {
 	// Setup
 	setMockPzsvcRequestKnownJSON(func(method, bodyStr, address, authKey string, outObj interface{}) ([]byte, *pzsvc.PzCustomError) {
@@ -294,3 +734,107 @@ func TestLoop_GetPzTaskItem_Success(t *testing.T) {
 	assert.Equal(t, "test-job-id", taskItem.Data.SvcData.JobID)
 	assert.Equal(t, "test-job-content", taskItem.Data.SvcData.Data.DataInputs.Body.Content)
 }
+
+func TestLoop_StopTwice(t *testing.T) {
+	// Setup
+	mockVCAP := setMockEnv("VCAP_APPLICATION", `{"application_id": "test-app-123"}`)
+	defer mockVCAP.Restore()
+	loop, _ := NewLoop(&pzsvc.Session{}, pzsvc.Config{}, "test-svcid-123", "/path/to/config", nil)
+	loop.intervalTick = 5 * time.Millisecond
+	loop.runIterationFunc = func(l Loop) error { return nil }
+
+	// Tested code
+	loop.Stop() // Stopping before starting should do nothing
+	errChan := loop.Start()
+	loop.Stop()
+	loop.Stop()
+
+	// Asserts
+	for range errChan {
+	}
+	assert.True(t, loop.stopped())
+}
+
+func TestLoop_Shutdown(t *testing.T) {
+	// Setup
+	failedJobs := []string{}
+	original := setMockPzsvcSendExecResultNoData(func(_ pzsvc.Session, _, _, jobID string, status pzsvc.PiazzaStatus) *pzsvc.PzCustomError {
+		failedJobs = append(failedJobs, jobID+":"+string(status))
+		return nil
+	})
+	defer original.Restore()
+
+	mockVCAP := setMockEnv("VCAP_APPLICATION", `{"application_id": "test-app-123"}`)
+	defer mockVCAP.Restore()
+	loop, _ := NewLoop(&pzsvc.Session{}, pzsvc.Config{}, "test-svcid-123", "/path/to/config", nil)
+	loop.intervalTick = 5 * time.Millisecond
+	iterationStarted := make(chan bool)
+	loop.runIterationFunc = func(l Loop) error {
+		// Simulate an iteration stuck launching a job it has dequeued
+		l.dequeued.Add("stuck-job", "")
+		close(iterationStarted)
+		<-time.After(time.Second)
+		return nil
+	}
+
+	// Tested code
+	loop.Start()
+	<-iterationStarted
+	start := time.Now()
+	loop.Shutdown(20 * time.Millisecond)
+
+	// Asserts
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+	assert.Equal(t, []string{"stuck-job:Fail"}, failedJobs)
+	assert.Empty(t, loop.dequeued.List())
+}
+
+func TestLoop_ShutdownDrained(t *testing.T) {
+	// Setup
+	failedJobs := 0
+	original := setMockPzsvcSendExecResultNoData(func(pzsvc.Session, string, string, string, pzsvc.PiazzaStatus) *pzsvc.PzCustomError {
+		failedJobs++
+		return nil
+	})
+	defer original.Restore()
+
+	mockVCAP := setMockEnv("VCAP_APPLICATION", `{"application_id": "test-app-123"}`)
+	defer mockVCAP.Restore()
+	loop, _ := NewLoop(&pzsvc.Session{}, pzsvc.Config{}, "test-svcid-123", "/path/to/config", nil)
+	loop.intervalTick = 5 * time.Millisecond
+	loop.runIterationFunc = func(l Loop) error { return nil }
+
+	// Tested code
+	errChan := loop.Start()
+	<-time.After(20 * time.Millisecond)
+	loop.Shutdown(time.Second)
+
+	// Asserts
+	_, open := <-errChan
+	assert.False(t, open)
+	assert.Equal(t, 0, failedJobs)
+}
+
+func TestLoop_ShutdownFailsPendingJobs(t *testing.T) {
+	// Setup
+	failedJobs := []string{}
+	original := setMockPzsvcSendExecResultNoData(func(_ pzsvc.Session, _, _, jobID string, status pzsvc.PiazzaStatus) *pzsvc.PzCustomError {
+		failedJobs = append(failedJobs, jobID+":"+string(status))
+		return nil
+	})
+	defer original.Restore()
+
+	mockVCAP := setMockEnv("VCAP_APPLICATION", `{"application_id": "test-app-123"}`)
+	defer mockVCAP.Restore()
+	loop, _ := NewLoop(&pzsvc.Session{}, pzsvc.Config{}, "test-svcid-123", "/path/to/config", nil)
+	loop.holdPendingJob(pendingJob{JobID: "pending-job", Queued: time.Now()})
+
+	// Tested code
+	loop.Shutdown(20 * time.Millisecond)
+
+	// Asserts
+	assert.Equal(t, []string{"pending-job:Fail"}, failedJobs)
+	result, err := loop.launchTask(mockCFSession{}, pendingJob{JobID: "pending-job"})
+	assert.Equal(t, dispatchHalted, result)
+	assert.NotNil(t, err)
+}
@@ -22,16 +22,16 @@ func (e originalEnv) Restore() {
 	os.Setenv(e.key, e.originalValue)
 }
 
-type originalPzsvcGetS3FileSizeInMegabytesFunc func(string) (int, *pzsvc.PzCustomError)
+type originalInputSizeFunc func(string) (int64, error)
 
-func setMockPzsvcGetS3FileSizeInMegabytes(mockFunc func(string) (int, *pzsvc.PzCustomError)) originalPzsvcGetS3FileSizeInMegabytesFunc {
-	original := pzsvcGetS3FileSizeInMegabytes
-	pzsvcGetS3FileSizeInMegabytes = mockFunc
+func setMockInputSize(mockFunc func(string) (int64, error)) originalInputSizeFunc {
+	original := inputSize
+	inputSize = mockFunc
 	return original
 }
 
-func (f originalPzsvcGetS3FileSizeInMegabytesFunc) Restore() {
-	pzsvcGetS3FileSizeInMegabytes = f
+func (f originalInputSizeFunc) Restore() {
+	inputSize = f
 }
 
 type originalPzsvcRequestKnownJSONFunc func(string, string, string, string, interface{}) ([]byte, *pzsvc.PzCustomError)
@@ -58,6 +58,18 @@ func (f originalPzsvcSendExecResultNoDataFunc) Restore() {
 	pzsvcSendExecResultNoData = f
 }
 
+type originalPzsvcSendExecResultDataFunc func(pzsvc.Session, string, string, string, pzsvc.PiazzaStatus, []byte) *pzsvc.PzCustomError
+
+func setMockPzsvcSendExecResultData(mockFunc func(pzsvc.Session, string, string, string, pzsvc.PiazzaStatus, []byte) *pzsvc.PzCustomError) originalPzsvcSendExecResultDataFunc {
+	original := pzsvcSendExecResultData
+	pzsvcSendExecResultData = mockFunc
+	return original
+}
+
+func (f originalPzsvcSendExecResultDataFunc) Restore() {
+	pzsvcSendExecResultData = f
+}
+
 type mockCFWrapperFactory struct {
 	Session                   cfwrapper.CFSession
 	GetSessionError           error
@@ -73,11 +85,17 @@ func (m mockCFWrapperFactory) RefreshCachedClient() error {
 }
 
 type mockCFSession struct {
-	Valid           bool
-	NumTasks        int
-	IsValidError    error
-	CountTasksError error
-	CreateTaskError error
+	Valid             bool
+	NumTasks          int
+	TaskGUID          string
+	TaskStates        map[string]string
+	IsValidError      error
+	CountTasksError   error
+	CreateTaskError   error
+	GetTaskStateError error
+	TerminateError    error
+	TerminatedGUIDs   *[]string
+	ForgottenGUIDs    *[]string
 }
 
 func (m mockCFSession) IsValid() (bool, error) {
@@ -88,6 +106,23 @@ func (m mockCFSession) CountTasksForApp(appID string) (int, error) {
 	return m.NumTasks, m.CountTasksError
 }
 
-func (m mockCFSession) CreateTask(request cfwrapper.TaskRequest) error {
-	return m.CreateTaskError
+func (m mockCFSession) CreateTask(request cfwrapper.TaskRequest) (string, error) {
+	return m.TaskGUID, m.CreateTaskError
+}
+
+func (m mockCFSession) GetTaskState(taskGUID string) (string, error) {
+	return m.TaskStates[taskGUID], m.GetTaskStateError
+}
+
+func (m mockCFSession) TerminateTask(taskGUID string) error {
+	if m.TerminatedGUIDs != nil {
+		*m.TerminatedGUIDs = append(*m.TerminatedGUIDs, taskGUID)
+	}
+	return m.TerminateError
+}
+
+func (m mockCFSession) ForgetTask(taskGUID string) {
+	if m.ForgottenGUIDs != nil {
+		*m.ForgottenGUIDs = append(*m.ForgottenGUIDs, taskGUID)
+	}
 }
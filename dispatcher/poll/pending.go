@@ -0,0 +1,76 @@
+package poll
+
+import (
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pzsvc-exec/dispatcher/cfwrapper"
+)
+
+// pendingJob is a Piazza job that has been dequeued, but whose task could not be
+// created yet because the CF memory quota was exhausted
+type pendingJob struct {
+	JobID   string
+	Request cfwrapper.TaskRequest
+	Queued  time.Time
+}
+
+// pendingQueue is a bounded, concurrency-safe queue of pending jobs, oldest first
+type pendingQueue struct {
+	mutex *sync.Mutex
+	jobs  []pendingJob
+	limit int
+}
+
+func newPendingQueue(limit int) *pendingQueue {
+	return &pendingQueue{mutex: &sync.Mutex{}, jobs: []pendingJob{}, limit: limit}
+}
+
+// Push adds a job in order of the time it was first queued, so that retried jobs
+// keep their place.  It reports false if the queue is already full.
+func (q *pendingQueue) Push(job pendingJob) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.jobs) >= q.limit {
+		return false
+	}
+	i := len(q.jobs)
+	for i > 0 && q.jobs[i-1].Queued.After(job.Queued) {
+		i--
+	}
+	q.jobs = append(q.jobs, pendingJob{})
+	copy(q.jobs[i+1:], q.jobs[i:])
+	q.jobs[i] = job
+	return true
+}
+
+// Pop removes and returns the oldest job, if there is one
+func (q *pendingQueue) Pop() (pendingJob, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.jobs) == 0 {
+		return pendingJob{}, false
+	}
+	job := q.jobs[0]
+	q.jobs = q.jobs[1:]
+	return job, true
+}
+
+// Expire removes and returns the jobs that were first queued longer ago than maxAge
+func (q *pendingQueue) Expire(maxAge time.Duration) []pendingJob {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	i := 0
+	for i < len(q.jobs) && time.Since(q.jobs[i].Queued) > maxAge {
+		i++
+	}
+	expired := append([]pendingJob{}, q.jobs[:i]...)
+	q.jobs = q.jobs[i:]
+	return expired
+}
+
+func (q *pendingQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.jobs)
+}
@@ -0,0 +1,58 @@
+package poll
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPendingQueue_PushPop(t *testing.T) {
+	// Setup
+	queue := newPendingQueue(10)
+	now := time.Now()
+
+	// Tested code
+	queue.Push(pendingJob{JobID: "job-2", Queued: now})
+	queue.Push(pendingJob{JobID: "job-3", Queued: now.Add(time.Second)})
+	queue.Push(pendingJob{JobID: "job-1", Queued: now.Add(-time.Second)}) // A retried job keeps its place
+	first, _ := queue.Pop()
+	second, _ := queue.Pop()
+	third, _ := queue.Pop()
+	_, ok := queue.Pop()
+
+	// Asserts
+	assert.Equal(t, "job-1", first.JobID)
+	assert.Equal(t, "job-2", second.JobID)
+	assert.Equal(t, "job-3", third.JobID)
+	assert.False(t, ok)
+}
+
+func TestPendingQueue_Full(t *testing.T) {
+	// Setup
+	queue := newPendingQueue(1)
+
+	// Tested code
+	firstOK := queue.Push(pendingJob{JobID: "job-1", Queued: time.Now()})
+	secondOK := queue.Push(pendingJob{JobID: "job-2", Queued: time.Now()})
+
+	// Asserts
+	assert.True(t, firstOK)
+	assert.False(t, secondOK)
+	assert.Equal(t, 1, queue.Len())
+}
+
+func TestPendingQueue_Expire(t *testing.T) {
+	// Setup
+	queue := newPendingQueue(10)
+	queue.Push(pendingJob{JobID: "old-job", Queued: time.Now().Add(-time.Hour)})
+	queue.Push(pendingJob{JobID: "new-job", Queued: time.Now()})
+
+	// Tested code
+	expired := queue.Expire(time.Minute)
+
+	// Asserts
+	assert.Len(t, expired, 1)
+	assert.Equal(t, "old-job", expired[0].JobID)
+	assert.Equal(t, 1, queue.Len())
+}
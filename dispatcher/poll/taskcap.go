@@ -0,0 +1,44 @@
+package poll
+
+import "sync"
+
+// TaskCap limits the total number of tasks run by all of the loops sharing it.
+// Loops hold its lock only while counting tasks and reserving free slots, so that they
+// do not race each other for the same slots, and release the reservation once they are
+// done launching.  Slow Piazza or CF requests of one loop then do not stall the others.
+type TaskCap struct {
+	Limit    int
+	mutex    *sync.Mutex
+	reserved int // Slots reserved by loops that are still launching tasks
+}
+
+// NewTaskCap creates a TaskCap allowing up to the given number of tasks
+func NewTaskCap(limit int) *TaskCap {
+	return &TaskCap{Limit: limit, mutex: &sync.Mutex{}}
+}
+
+// reserve claims up to the wanted number of slots, given a function counting the app's
+// running tasks, and returns how many it claimed
+func (c *TaskCap) reserve(want int, countTasks func() (int, error)) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	numTasks, err := countTasks()
+	if err != nil {
+		return 0, err
+	}
+	if capSlots := c.Limit - numTasks - c.reserved; capSlots < want {
+		want = capSlots
+	}
+	if want <= 0 {
+		return 0, nil
+	}
+	c.reserved += want
+	return want, nil
+}
+
+// release returns reserved slots, once the tasks launched in them can be counted instead
+func (c *TaskCap) release(slots int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.reserved -= slots
+}
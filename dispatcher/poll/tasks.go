@@ -0,0 +1,168 @@
+package poll
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pzsvc-exec/dispatcher/cfwrapper"
+	"github.com/venicegeo/pzsvc-exec/pzsvc"
+)
+
+// trackedTask records which backend task was launched for a Piazza job
+type trackedTask struct {
+	JobID    string
+	TaskGUID string
+	Created  time.Time
+}
+
+// taskTracker is a concurrency-safe record of Piazza jobs the dispatcher is
+// responsible for, keyed by job ID, along with the GUID of their task once launched
+type taskTracker struct {
+	mutex *sync.Mutex
+	tasks map[string]trackedTask
+}
+
+func newTaskTracker() *taskTracker {
+	return &taskTracker{mutex: &sync.Mutex{}, tasks: map[string]trackedTask{}}
+}
+
+func (t *taskTracker) Add(jobID, taskGUID string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.tasks[jobID] = trackedTask{JobID: jobID, TaskGUID: taskGUID, Created: time.Now()}
+}
+
+func (t *taskTracker) Remove(jobID string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.tasks, jobID)
+}
+
+// Take stops tracking the given job, and reports whether it was being tracked
+func (t *taskTracker) Take(jobID string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	_, ok := t.tasks[jobID]
+	delete(t.tasks, jobID)
+	return ok
+}
+
+func (t *taskTracker) List() []trackedTask {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	list := []trackedTask{}
+	for _, task := range t.tasks {
+		list = append(list, task)
+	}
+	return list
+}
+
+// pzJobFinished reports whether the given Piazza job status means a result has
+// already been reported for the job
+func pzJobFinished(status string) bool {
+	switch pzsvc.PiazzaStatus(status) {
+	case pzsvc.PiazzaStatusSuccess, pzsvc.PiazzaStatusError, pzsvc.PiazzaStatusFail, pzsvc.PiazzaStatusCancelled:
+		return true
+	}
+	return false
+}
+
+// reconcileTasks checks the state of every tracked task, stops tracking the ones that
+// have finished or that the backend no longer knows, fails the Piazza jobs whose task
+// failed or vanished without reporting a result, and terminates the tasks whose Piazza
+// job has been cancelled.  A finished task is only forgotten by the backend once the
+// tracker has let go of it, so that a job that could not be failed is retried next time.
+func reconcileTasks(l Loop) error {
+	trackedTasks := l.tasks.List()
+	if len(trackedTasks) == 0 {
+		return nil
+	}
+	pzsvc.LogInfo(*l.PzSession, fmt.Sprintf("Reconciling %d tracked tasks", len(trackedTasks)))
+
+	cfSession, err := l.ClientFactory.GetSession()
+	if err != nil {
+		pzsvc.LogSimpleErr(*l.PzSession, "Error generating valid CF Client", err)
+		return err
+	}
+
+	for _, task := range trackedTasks {
+		state, err := cfSession.GetTaskState(task.TaskGUID)
+		if err == cfwrapper.ErrTaskNotFound {
+			pzsvc.LogWarn(*l.PzSession, "Task "+task.TaskGUID+" for job "+task.JobID+" is not known to the task backend")
+			if err = l.failUnreportedJob(task); err == nil {
+				l.tasks.Remove(task.JobID)
+			}
+			continue
+		}
+		if err != nil {
+			pzsvc.LogSimpleErr(*l.PzSession, "Could not get state of task "+task.TaskGUID+" for job "+task.JobID+": ", err)
+			continue
+		}
+
+		switch state {
+		case cfwrapper.TaskStateSucceeded:
+			l.tasks.Remove(task.JobID)
+			cfSession.ForgetTask(task.TaskGUID)
+		case cfwrapper.TaskStateFailed:
+			if err = l.failUnreportedJob(task); err != nil {
+				continue
+			}
+			l.tasks.Remove(task.JobID)
+			cfSession.ForgetTask(task.TaskGUID)
+		case cfwrapper.TaskStatePending, cfwrapper.TaskStateRunning:
+			l.terminateCancelledJob(cfSession, task)
+		}
+	}
+	return nil
+}
+
+// getPzJobStatus looks up the current Piazza status of the given job
+func (l Loop) getPzJobStatus(jobID string) (string, error) {
+	var jobStatus struct {
+		Data pzsvc.JobStatusResp `json:"data,omitempty"`
+	}
+	url := fmt.Sprintf("%s/job/%s", l.PzSession.PzAddr, jobID)
+	if byts, err := pzsvcRequestKnownJSON("GET", "", url, l.PzSession.PzAuth, &jobStatus); err != nil {
+		return "", err.Log(*l.PzSession, "Dispatcher: error getting status of job "+jobID+":"+string(byts))
+	}
+	return jobStatus.Data.Status, nil
+}
+
+// failUnreportedJob sets a Piazza job to failed, unless its worker reported a result before its task ended
+func (l Loop) failUnreportedJob(task trackedTask) error {
+	status, err := l.getPzJobStatus(task.JobID)
+	if err != nil {
+		return err
+	}
+
+	if pzJobFinished(status) {
+		pzsvc.LogInfo(*l.PzSession, "Task for job "+task.JobID+" failed after reporting status "+status)
+		return nil
+	}
+
+	pzsvc.LogAudit(*l.PzSession, l.PzSession.UserID, "Audit failure", l.PzSession.AppName, "Task "+task.TaskGUID+" for Job "+task.JobID+" failed without reporting a result. Job Failed.", pzsvc.ERROR)
+	if pzErr := pzsvcSendExecResultNoData(*l.PzSession, l.PzSession.PzAddr, l.SvcID, task.JobID, pzsvc.PiazzaStatusFail); pzErr != nil {
+		return pzErr.Log(*l.PzSession, "Dispatcher: error failing job "+task.JobID)
+	}
+	return nil
+}
+
+// terminateCancelledJob terminates the task of a Piazza job if the job has been cancelled
+func (l Loop) terminateCancelledJob(cfSession cfwrapper.CFSession, task trackedTask) error {
+	status, err := l.getPzJobStatus(task.JobID)
+	if err != nil {
+		return err
+	}
+	if pzsvc.PiazzaStatus(status) != pzsvc.PiazzaStatusCancelled {
+		return nil
+	}
+
+	if err = cfSession.TerminateTask(task.TaskGUID); err != nil {
+		pzsvc.LogSimpleErr(*l.PzSession, "Could not terminate task "+task.TaskGUID+" for cancelled job "+task.JobID+": ", err)
+		return err
+	}
+	pzsvc.LogAudit(*l.PzSession, l.PzSession.UserID, "Terminating CF Task for cancelled Job "+task.JobID, l.PzSession.AppName, "Job was cancelled in Piazza. Terminated task "+task.TaskGUID+".", pzsvc.INFO)
+	l.tasks.Remove(task.JobID)
+	return nil
+}
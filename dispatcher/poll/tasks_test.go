@@ -0,0 +1,244 @@
+package poll
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/pzsvc-exec/dispatcher/cfwrapper"
+	"github.com/venicegeo/pzsvc-exec/pzsvc"
+)
+
+type sendExecResultNoDataCall struct {
+	jobID  string
+	status pzsvc.PiazzaStatus
+}
+
+func setupReconcileMocks(jobStatus string) (*[]sendExecResultNoDataCall, func()) {
+	sendCalls := &[]sendExecResultNoDataCall{}
+	originalRequestJSON := setMockPzsvcRequestKnownJSON(func(_, _, _, _ string, outObj interface{}) ([]byte, *pzsvc.PzCustomError) {
+		body := []byte(`{"data": {"status": "` + jobStatus + `"}}`)
+		json.Unmarshal(body, outObj)
+		return body, nil
+	})
+	originalSendExecResult := setMockPzsvcSendExecResultNoData(func(_ pzsvc.Session, _, _, jobID string, status pzsvc.PiazzaStatus) *pzsvc.PzCustomError {
+		*sendCalls = append(*sendCalls, sendExecResultNoDataCall{jobID, status})
+		return nil
+	})
+	return sendCalls, func() {
+		originalRequestJSON.Restore()
+		originalSendExecResult.Restore()
+	}
+}
+
+func TestTaskTracker_AddRemoveList(t *testing.T) {
+	// Setup
+	tracker := newTaskTracker()
+
+	// Tested code
+	tracker.Add("job-1", "guid-1")
+	tracker.Add("job-2", "guid-2")
+	tracker.Remove("job-1")
+	tasks := tracker.List()
+
+	// Asserts
+	assert.Len(t, tasks, 1)
+	assert.Equal(t, "job-2", tasks[0].JobID)
+	assert.Equal(t, "guid-2", tasks[0].TaskGUID)
+}
+
+func TestReconcileTasks_NoTasks(t *testing.T) {
+	// Setup
+	loop := Loop{PzSession: &pzsvc.Session{}, tasks: newTaskTracker()}
+
+	// Tested code
+	err := reconcileTasks(loop) // Nil ClientFactory would panic if a session was requested
+
+	// Asserts
+	assert.Nil(t, err)
+}
+
+func TestReconcileTasks_ErrGetSession(t *testing.T) {
+	// Setup
+	loop := Loop{
+		PzSession:     &pzsvc.Session{},
+		ClientFactory: &mockCFWrapperFactory{GetSessionError: errors.New("get session error")},
+		tasks:         newTaskTracker(),
+	}
+	loop.tasks.Add("job-1", "guid-1")
+
+	// Tested code
+	err := reconcileTasks(loop)
+
+	// Asserts
+	assert.NotNil(t, err)
+	assert.Len(t, loop.tasks.List(), 1)
+}
+
+func TestReconcileTasks_States(t *testing.T) {
+	// Setup
+	sendCalls, teardown := setupReconcileMocks("Running")
+	defer teardown()
+	forgotten := []string{}
+	loop := Loop{
+		PzSession: &pzsvc.Session{},
+		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{TaskStates: map[string]string{
+			"guid-running":   cfwrapper.TaskStateRunning,
+			"guid-succeeded": cfwrapper.TaskStateSucceeded,
+			"guid-failed":    cfwrapper.TaskStateFailed,
+		}, ForgottenGUIDs: &forgotten}},
+		tasks: newTaskTracker(),
+	}
+	loop.tasks.Add("job-running", "guid-running")
+	loop.tasks.Add("job-succeeded", "guid-succeeded")
+	loop.tasks.Add("job-failed", "guid-failed")
+
+	// Tested code
+	err := reconcileTasks(loop)
+
+	// Asserts
+	assert.Nil(t, err)
+	remaining := loop.tasks.List()
+	assert.Len(t, remaining, 1)
+	assert.Equal(t, "job-running", remaining[0].JobID)
+	assert.Equal(t, []sendExecResultNoDataCall{{"job-failed", pzsvc.PiazzaStatusFail}}, *sendCalls)
+	sort.Strings(forgotten)
+	assert.Equal(t, []string{"guid-failed", "guid-succeeded"}, forgotten)
+}
+
+func TestReconcileTasks_FailJobError(t *testing.T) {
+	// Setup
+	_, teardown := setupReconcileMocks("Running")
+	defer teardown()
+	originalSendExecResult := setMockPzsvcSendExecResultNoData(func(_ pzsvc.Session, _, _, _ string, _ pzsvc.PiazzaStatus) *pzsvc.PzCustomError {
+		return &pzsvc.PzCustomError{LogMsg: "send error"}
+	})
+	defer originalSendExecResult.Restore()
+	forgotten := []string{}
+	loop := Loop{
+		PzSession: &pzsvc.Session{},
+		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{
+			TaskStates:     map[string]string{"guid-failed": cfwrapper.TaskStateFailed},
+			ForgottenGUIDs: &forgotten,
+		}},
+		tasks: newTaskTracker(),
+	}
+	loop.tasks.Add("job-failed", "guid-failed")
+
+	// Tested code
+	err := reconcileTasks(loop)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Len(t, loop.tasks.List(), 1) // Kept so that failing the job is tried again
+	assert.Empty(t, forgotten)
+}
+
+func TestReconcileTasks_TaskNotFound(t *testing.T) {
+	// Setup
+	sendCalls, teardown := setupReconcileMocks("Running")
+	defer teardown()
+	loop := Loop{
+		PzSession:     &pzsvc.Session{},
+		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{GetTaskStateError: cfwrapper.ErrTaskNotFound}},
+		tasks:         newTaskTracker(),
+	}
+	loop.tasks.Add("job-1", "guid-1")
+
+	// Tested code
+	err := reconcileTasks(loop)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Empty(t, loop.tasks.List())
+	assert.Equal(t, []sendExecResultNoDataCall{{"job-1", pzsvc.PiazzaStatusFail}}, *sendCalls)
+}
+
+func TestReconcileTasks_FailedAfterReporting(t *testing.T) {
+	// Setup
+	sendCalls, teardown := setupReconcileMocks("Success")
+	defer teardown()
+	loop := Loop{
+		PzSession:     &pzsvc.Session{},
+		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{TaskStates: map[string]string{"guid-failed": cfwrapper.TaskStateFailed}}},
+		tasks:         newTaskTracker(),
+	}
+	loop.tasks.Add("job-failed", "guid-failed")
+
+	// Tested code
+	err := reconcileTasks(loop)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Empty(t, loop.tasks.List())
+	assert.Empty(t, *sendCalls) // The worker already reported a result, so it must not be overwritten
+}
+
+func TestReconcileTasks_ErrTaskState(t *testing.T) {
+	// Setup
+	sendCalls, teardown := setupReconcileMocks("Running")
+	defer teardown()
+	loop := Loop{
+		PzSession:     &pzsvc.Session{},
+		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{GetTaskStateError: errors.New("task state error")}},
+		tasks:         newTaskTracker(),
+	}
+	loop.tasks.Add("job-1", "guid-1")
+
+	// Tested code
+	err := reconcileTasks(loop)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Len(t, loop.tasks.List(), 1) // Kept to be checked again on the next reconciliation
+	assert.Empty(t, *sendCalls)
+}
+
+func TestReconcileTasks_Cancelled(t *testing.T) {
+	// Setup
+	sendCalls, teardown := setupReconcileMocks("Cancelled")
+	defer teardown()
+	terminated := []string{}
+	loop := Loop{
+		PzSession: &pzsvc.Session{},
+		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{
+			TaskStates:      map[string]string{"guid-running": cfwrapper.TaskStateRunning},
+			TerminatedGUIDs: &terminated,
+		}},
+		tasks: newTaskTracker(),
+	}
+	loop.tasks.Add("job-running", "guid-running")
+
+	// Tested code
+	err := reconcileTasks(loop)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"guid-running"}, terminated)
+	assert.Empty(t, loop.tasks.List())
+	assert.Empty(t, *sendCalls)
+}
+
+func TestReconcileTasks_CancelledTerminateError(t *testing.T) {
+	// Setup
+	_, teardown := setupReconcileMocks("Cancelled")
+	defer teardown()
+	loop := Loop{
+		PzSession: &pzsvc.Session{},
+		ClientFactory: &mockCFWrapperFactory{Session: mockCFSession{
+			TaskStates:     map[string]string{"guid-running": cfwrapper.TaskStateRunning},
+			TerminateError: errors.New("terminate error"),
+		}},
+		tasks: newTaskTracker(),
+	}
+	loop.tasks.Add("job-running", "guid-running")
+
+	// Tested code
+	err := reconcileTasks(loop)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Len(t, loop.tasks.List(), 1) // Kept so that termination is retried
+}
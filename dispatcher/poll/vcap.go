@@ -4,8 +4,23 @@ import (
 	"encoding/json"
 	"errors"
 	"os"
+
+	"github.com/venicegeo/pzsvc-exec/dispatcher/cfwrapper"
 )
 
+// appIDProvider is implemented by task backends that identify their own
+// application, rather than running inside a CF app with a VCAP tree
+type appIDProvider interface {
+	AppID() string
+}
+
+func getAppID(clientFactory cfwrapper.Factory) (string, error) {
+	if provider, ok := clientFactory.(appIDProvider); ok {
+		return provider.AppID(), nil
+	}
+	return getVCAPApplicationID()
+}
+
 func getVCAPApplicationID() (string, error) {
 	// Get the application name
 	vcapJSONContainer := make(map[string]interface{})
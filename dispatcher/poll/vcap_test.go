@@ -45,3 +45,37 @@ func TestGetVCAPApplicationID_Success(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, "test-id-123", id)
 }
+
+type mockAppIDFactory struct {
+	mockCFWrapperFactory
+}
+
+func (m mockAppIDFactory) AppID() string {
+	return "test-local-id"
+}
+
+func TestGetAppID_FromFactory(t *testing.T) {
+	// Setup
+	mockVCAP := setMockEnv("VCAP_APPLICATION", "bad json value")
+	defer mockVCAP.Restore()
+
+	// Tested code
+	id, err := getAppID(mockAppIDFactory{})
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, "test-local-id", id)
+}
+
+func TestGetAppID_FromVCAP(t *testing.T) {
+	// Setup
+	mockVCAP := setMockEnv("VCAP_APPLICATION", `{"application_id": "test-id-123"}`)
+	defer mockVCAP.Restore()
+
+	// Tested code
+	id, err := getAppID(mockCFWrapperFactory{})
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, "test-id-123", id)
+}
@@ -38,12 +38,14 @@ type Config struct {
 	CanDownlPz    bool              // True if this service is permitted to download files from Piazza
 	CanDownlExt   bool              // True if this service is permitted to download files from an external source
 	RegForTaskMgr bool              // True if autoregistration should be as a service using the Pz task manager
-	MaxRunTime    int               // Time in seconds before a running job should be considered to have failed.  Used for task worker registration.
+	MaxRunTime    int               // Time in seconds before a running job should be considered to have failed.  Used for task worker registration, and enforced by the worker.
 	LocalOnly     bool              // True if service should only accept connections from localhost (used with task worker)
 	LogAudit      bool              // True to log all auditable events
 	LimitUserData bool              // True to limit the information availabel to the individual user
 	ExtRetryOn202 bool              // If true, will retry when receiving a 202 response from external file download links
 	DocURL        string            // URL to provide to autoregistration and to documentation endpoint for info about the service
+	TaskLimit     int               // Number of simultaneous tasks the dispatcher may run for this service.  Defaults to the TASK_LIMIT env var.
+	Params        []ParamSpec       // Parameters a job may give its algorithm.  If set, jobs pass "params" in place of free-form "cmd" text.
 	//JwtSecAuthURL string            // URL for taskworker to decrypt JWT.  If nonblank, will assume that all jobs are JWT format, and will require decrypting.
 }
 
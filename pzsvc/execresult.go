@@ -20,8 +20,9 @@ import (
 )
 
 type statusUpdateJSON struct {
-	Status PiazzaStatus            `json:"status"`
-	Result *statusUpdateResultJSON `json:"result,omitempty"`
+	Status   PiazzaStatus            `json:"status"`
+	Result   *statusUpdateResultJSON `json:"result,omitempty"`
+	Progress *JobProg                `json:"progress,omitempty"`
 }
 
 type statusUpdateResultJSON struct {
@@ -41,6 +42,18 @@ func SendExecResultNoData(s Session, pzAddr, svcID, jobID string, status PiazzaS
 	return err
 }
 
+// SendExecProgress reports the progress of a running job execution to Piazza
+func SendExecProgress(s Session, pzAddr, svcID, jobID string, progress JobProg) *PzCustomError {
+	outAddr := fmt.Sprintf("%s/service/%s/task/%s", pzAddr, svcID, jobID)
+
+	LogInfo(s, fmt.Sprintf("Sending exec progress. URL=%s PercentComplete=%d ", outAddr, progress.PercentComplete))
+	outData := statusUpdateJSON{Status: PiazzaStatusRunning, Progress: &progress}
+	outJSON, _ := json.Marshal(outData)
+
+	_, err := SubmitSinglePart("POST", string(outJSON), outAddr, s.PzAuth)
+	return err
+}
+
 // SendExecResultData sends the result of a job execution to Piazza, including extra text data
 func SendExecResultData(s Session, pzAddr, svcID, jobID string, status PiazzaStatus, resultData []byte) *PzCustomError {
 	outAddr := pzAddr + `/service/` + svcID + `/task/` + jobID
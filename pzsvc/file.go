@@ -19,14 +19,19 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"path/filepath"
 )
 
 // locString simplifies certain local processes that wish to interact with
-// files that may or may not be in a subfolder.
+// files that may or may not be in a subfolder.  The subfolder may be relative
+// to the current directory, or absolute, such as a worker's job directory.
 func locString(subFold, fname string) string {
 	if subFold == "" {
 		return fmt.Sprintf(`./%s`, fname)
 	}
+	if filepath.IsAbs(subFold) {
+		return filepath.Join(subFold, fname)
+	}
 	return fmt.Sprintf(`./%s/%s`, subFold, fname)
 }
 
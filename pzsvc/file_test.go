@@ -54,3 +54,15 @@ func TestIngestFile(t *testing.T) {
 	}
 	os.RemoveAll(subFold)
 }
+
+func TestLocString(t *testing.T) {
+	if loc := locString("", "file.txt"); loc != "./file.txt" {
+		t.Error(`TestLocString: wrong path with no subfolder: ` + loc)
+	}
+	if loc := locString("folderName", "file.txt"); loc != "./folderName/file.txt" {
+		t.Error(`TestLocString: wrong path with relative subfolder: ` + loc)
+	}
+	if loc := locString("/tmp/job-1", "file.txt"); loc != "/tmp/job-1/file.txt" {
+		t.Error(`TestLocString: wrong path with absolute subfolder: ` + loc)
+	}
+}
@@ -177,18 +177,25 @@ type Service struct {
 
 // InpStruct is the format that pzsvc-exec demarshals input data into
 type InpStruct struct {
-	Command    string   `json:"cmd,omitempty"`
-	UserID     string   `json:"userID,omitempty"`       // string: unique ID of initiating user
-	InPzFiles  []string `json:"inPzFiles,omitempty"`    // slice: Pz dataIds
-	InExtFiles []string `json:"inExtFiles,omitempty"`   // slice: external URL
-	InPzNames  []string `json:"inPzNames,omitempty"`    // slice: name for the InPzFile of the same index
-	InExtNames []string `json:"inExtNames,omitempty"`   // slice: name for the InExtFile of the same index
-	OutTiffs   []string `json:"outTiffs,omitempty"`     // slice: filenames of GeoTIFFs to be ingested
-	OutTxts    []string `json:"outTxts,omitempty"`      // slice: filenames of text files to be ingested
-	OutGeoJs   []string `json:"outGeoJson,omitempty"`   // slice: filenames of GeoJSON files to be ingested
-	ExtAuth    string   `json:"inExtAuthKey,omitempty"` // string: auth key for accessing external files
-	PzAuth     string   `json:"pzAuthKey,omitempty"`    // string: auth key for accessing Piazza
-	PzAddr     string   `json:"pzAddr,omitempty"`       // string: URL for the targeted Pz instance
+	Command      string                       `json:"cmd,omitempty"`
+	UserID       string                       `json:"userID,omitempty"`         // string: unique ID of initiating user
+	InPzFiles    []string                     `json:"inPzFiles,omitempty"`      // slice: Pz dataIds
+	InExtFiles   []string                     `json:"inExtFiles,omitempty"`     // slice: external URL
+	InPzNames    []string                     `json:"inPzNames,omitempty"`      // slice: name for the InPzFile of the same index
+	InExtNames   []string                     `json:"inExtNames,omitempty"`     // slice: name for the InExtFile of the same index
+	OutTiffs     []string                     `json:"outTiffs,omitempty"`       // slice: filenames of GeoTIFFs to be ingested
+	OutTxts      []string                     `json:"outTxts,omitempty"`        // slice: filenames of text files to be ingested
+	OutGeoJs     []string                     `json:"outGeoJson,omitempty"`     // slice: filenames of GeoJSON files to be ingested
+	ExtAuth      string                       `json:"inExtAuthKey,omitempty"`   // string: auth key for accessing external files
+	PzAuth       string                       `json:"pzAuthKey,omitempty"`      // string: auth key for accessing Piazza
+	PzAddr       string                       `json:"pzAddr,omitempty"`         // string: URL for the targeted Pz instance
+	Params       map[string]interface{}       `json:"params,omitempty"`         // map: algorithm parameters, checked against the config's Params
+	InChecksums  map[string]string            `json:"inChecksums,omitempty"`    // map: expected "sha256:<hex>" or "md5:<hex>" digest of the named input
+	InSizes      map[string]int64             `json:"inSizes,omitempty"`        // map: expected size in bytes of the named input
+	InExtract    map[string]string            `json:"inExtract,omitempty"`      // map: directory to extract the named archive input into
+	ExtAuthHosts []string                     `json:"inExtAuthHosts,omitempty"` // slice: hosts ExtAuth may be sent to, by default those of InExtFiles
+	ExtTokens    map[string]string            `json:"inExtTokens,omitempty"`    // map: bearer token for downloading the named external input
+	ExtHeaders   map[string]map[string]string `json:"inExtHeaders,omitempty"`   // map: headers to send when downloading the named external input
 }
 
 // IngestReq is the base object used to ingest a file to Piazza.
@@ -355,6 +362,9 @@ type UserProfileResp struct {
 // PiazzaStatus is an alias type for a Piazza job status
 type PiazzaStatus string
 
+// PiazzaStatusRunning is a Piazza job status corresponding to a job still being worked
+var PiazzaStatusRunning PiazzaStatus = "Running"
+
 // PiazzaStatusSuccess is a Piazza job status corresponding to success
 var PiazzaStatusSuccess PiazzaStatus = "Success"
 
@@ -363,3 +373,6 @@ var PiazzaStatusError PiazzaStatus = "Error"
 
 // PiazzaStatusFail is a Piazza job status corresponding to failure prior to running the job
 var PiazzaStatusFail PiazzaStatus = "Fail"
+
+// PiazzaStatusCancelled is a Piazza job status corresponding to a job cancelled by its user
+var PiazzaStatusCancelled PiazzaStatus = "Cancelled"
@@ -0,0 +1,157 @@
+// Copyright 2018, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pzsvc
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParamSpec describes one parameter that jobs may pass to a service's algorithm.
+type ParamSpec struct {
+	Name     string   // Name of the parameter in the job's "params"
+	Flag     string   // Command line flag the value follows, such as "--threshold".  Passed positionally if blank.
+	Type     string   // One of "string", "int", "float" or "bool".  Defaults to "string".  A true bool passes just its Flag.
+	Enum     []string // The values permitted, if they are limited
+	Min      *float64 // Least value permitted for an int or float
+	Max      *float64 // Greatest value permitted for an int or float
+	Required bool     // True if every job must give this parameter
+}
+
+// CheckParamSpecs reports whether the config's parameter schema is usable.
+func (c Config) CheckParamSpecs() error {
+	names := map[string]bool{}
+	for _, spec := range c.Params {
+		if spec.Name == "" {
+			return fmt.Errorf("Config: every entry of Params needs a Name")
+		}
+		if names[spec.Name] {
+			return fmt.Errorf("Config: parameter %s is listed twice in Params", spec.Name)
+		}
+		names[spec.Name] = true
+		switch spec.Type {
+		case "", "string", "int", "float":
+		case "bool":
+			if spec.Flag == "" {
+				return fmt.Errorf("Config: bool parameter %s needs a Flag", spec.Name)
+			}
+		default:
+			return fmt.Errorf("Config: parameter %s has unknown Type %s", spec.Name, spec.Type)
+		}
+	}
+	return nil
+}
+
+// BuildParamArgs checks a job's parameters against the config's Params schema, and
+// returns the command line arguments they stand for, in the order of the schema.
+func (c Config) BuildParamArgs(params map[string]interface{}) ([]string, error) {
+	known := map[string]bool{}
+	for _, spec := range c.Params {
+		known[spec.Name] = true
+	}
+	unknown := []string{}
+	for name := range params {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("Unknown parameters: %v", unknown)
+	}
+
+	args := []string{}
+	for _, spec := range c.Params {
+		value, ok := params[spec.Name]
+		if !ok || value == nil {
+			if spec.Required {
+				return nil, fmt.Errorf("Parameter %s is required", spec.Name)
+			}
+			continue
+		}
+		argValue, err := spec.formatValue(value)
+		if err != nil {
+			return nil, err
+		}
+
+		if spec.Type == "bool" {
+			if argValue == "true" {
+				args = append(args, spec.Flag)
+			}
+			continue
+		}
+		if spec.Flag != "" {
+			args = append(args, spec.Flag)
+		} else if strings.HasPrefix(argValue, "-") {
+			// A positional value the program would read as an option could smuggle in flags
+			return nil, fmt.Errorf("Parameter %s is passed positionally, so its value may not start with \"-\"", spec.Name)
+		}
+		args = append(args, argValue)
+	}
+	return args, nil
+}
+
+// formatValue checks a parameter value against the spec, and returns it as an argument
+func (spec ParamSpec) formatValue(value interface{}) (string, error) {
+	var formatted string
+	switch spec.Type {
+	case "", "string":
+		str, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("Parameter %s must be a string", spec.Name)
+		}
+		formatted = str
+	case "bool":
+		b, ok := value.(bool)
+		if !ok {
+			return "", fmt.Errorf("Parameter %s must be true or false", spec.Name)
+		}
+		formatted = strconv.FormatBool(b)
+	case "int", "float":
+		num, ok := value.(float64)
+		if !ok {
+			return "", fmt.Errorf("Parameter %s must be a number", spec.Name)
+		}
+		if spec.Type == "int" {
+			if num != math.Trunc(num) {
+				return "", fmt.Errorf("Parameter %s must be a whole number", spec.Name)
+			}
+			formatted = strconv.FormatFloat(num, 'f', 0, 64)
+		} else {
+			formatted = strconv.FormatFloat(num, 'g', -1, 64)
+		}
+		if spec.Min != nil && num < *spec.Min {
+			return "", fmt.Errorf("Parameter %s must be at least %v", spec.Name, *spec.Min)
+		}
+		if spec.Max != nil && num > *spec.Max {
+			return "", fmt.Errorf("Parameter %s must be at most %v", spec.Name, *spec.Max)
+		}
+	default:
+		return "", fmt.Errorf("Parameter %s has unknown type %s", spec.Name, spec.Type)
+	}
+
+	if len(spec.Enum) > 0 {
+		for _, allowed := range spec.Enum {
+			if formatted == allowed {
+				return formatted, nil
+			}
+		}
+		return "", fmt.Errorf("Parameter %s must be one of %v", spec.Name, spec.Enum)
+	}
+	return formatted, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2018, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pzsvc
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testParamConfig() Config {
+	var configObj Config
+	json.Unmarshal([]byte(`{"Params": [
+		{"Name": "image", "Required": true},
+		{"Name": "threshold", "Flag": "--threshold", "Type": "float", "Min": 0, "Max": 1},
+		{"Name": "bands", "Flag": "-b", "Type": "int", "Min": 1},
+		{"Name": "method", "Flag": "--method", "Enum": ["fast", "exact"]},
+		{"Name": "verbose", "Flag": "-v", "Type": "bool"}
+	]}`), &configObj)
+	return configObj
+}
+
+func TestCheckParamSpecs(t *testing.T) {
+	if err := testParamConfig().CheckParamSpecs(); err != nil {
+		t.Error(`TestCheckParamSpecs: valid schema rejected: ` + err.Error())
+	}
+	badSchemas := map[string][]ParamSpec{
+		"needs a Name":     {{Flag: "-x"}},
+		"listed twice":     {{Name: "a"}, {Name: "a"}},
+		"needs a Flag":     {{Name: "a", Type: "bool"}},
+		"unknown Type foo": {{Name: "a", Type: "foo"}},
+	}
+	for expected, params := range badSchemas {
+		err := Config{Params: params}.CheckParamSpecs()
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf(`TestCheckParamSpecs: expected error "%s", got %v`, expected, err)
+		}
+	}
+}
+
+func TestBuildParamArgs(t *testing.T) {
+	var params map[string]interface{}
+	json.Unmarshal([]byte(`{"verbose": true, "method": "exact", "bands": 3, "threshold": 0.25, "image": "in put.tif"}`), &params)
+
+	args, err := testParamConfig().BuildParamArgs(params)
+	if err != nil {
+		t.Error(`TestBuildParamArgs: valid params rejected: ` + err.Error())
+	}
+	expected := []string{"in put.tif", "--threshold", "0.25", "-b", "3", "--method", "exact", "-v"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf(`TestBuildParamArgs: expected args %v, got %v`, expected, args)
+	}
+
+	args, err = testParamConfig().BuildParamArgs(map[string]interface{}{"image": "a.tif", "verbose": false})
+	if err != nil || !reflect.DeepEqual(args, []string{"a.tif"}) {
+		t.Errorf(`TestBuildParamArgs: optional params not skipped: %v, %v`, args, err)
+	}
+}
+
+func TestBuildParamArgs_Invalid(t *testing.T) {
+	invalidParams := map[string]string{
+		`{}`:                                    "image is required",
+		`{"image": "a", "extra": 1}`:            "Unknown parameters: [extra]",
+		`{"image": 5}`:                          "image must be a string",
+		`{"image": "a", "threshold": "high"}`:   "threshold must be a number",
+		`{"image": "a", "threshold": 1.5}`:      "threshold must be at most 1",
+		`{"image": "a", "bands": 0}`:            "bands must be at least 1",
+		`{"image": "a", "bands": 2.5}`:          "bands must be a whole number",
+		`{"image": "a", "method": "slow"}`:      "method must be one of [fast exact]",
+		`{"image": "a", "verbose": "yes"}`:      "verbose must be true or false",
+		`{"image": "a; rm -rf /", "bands": -1}`: "bands must be at least 1",
+		`{"image": "--output=/etc/passwd"}`:     "image is passed positionally",
+		`{"image": "a", "method": "-x"}`:        "method must be one of [fast exact]",
+	}
+	for paramsJSON, expected := range invalidParams {
+		var params map[string]interface{}
+		json.Unmarshal([]byte(paramsJSON), &params)
+		_, err := testParamConfig().BuildParamArgs(params)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf(`TestBuildParamArgs_Invalid: for %s expected error "%s", got %v`, paramsJSON, expected, err)
+		}
+	}
+}
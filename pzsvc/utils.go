@@ -86,7 +86,7 @@ func LogSimpleErr(s Session, message string, err error) LoggedError {
 		message += err.Error()
 	}
 	logMessage(s, 3, message)
-	return fmt.Errorf(message)
+	return errors.New(message)
 }
 
 // LogInfo posts a logMessage call for standard, non-error messages.  The
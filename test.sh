@@ -2,6 +2,7 @@
 go test -cover \
   github.com/venicegeo/pzsvc-exec/dispatcher \
   github.com/venicegeo/pzsvc-exec/dispatcher/cfwrapper \
+  github.com/venicegeo/pzsvc-exec/dispatcher/local \
   github.com/venicegeo/pzsvc-exec/dispatcher/model \
   github.com/venicegeo/pzsvc-exec/dispatcher/poll \
   github.com/venicegeo/pzsvc-exec/pzsvc \
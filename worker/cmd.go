@@ -45,6 +45,7 @@ func init() {
 		cli.StringFlag{Name: "jobID", Usage: "job ID for this run, used for logging"},
 		cli.StringSliceFlag{Name: "input, i", Usage: "input source specification (as \"filename:URL\")"},
 		cli.StringSliceFlag{Name: "output, o", Usage: "output file name (usable multiple times; at least one required)"},
+		cli.StringFlag{Name: "jobSpec", Usage: "encoded job specification from the dispatcher; replaces config, cliExtra, userID, serviceID, jobID, input and output"},
 	}
 }
 
@@ -63,10 +64,28 @@ func runCmd(ctx *cli.Context) error {
 	}
 	workerlog.Info(cfg, "startup")
 
-	if ctx.String("config") == "" {
+	configPath := ctx.String("config")
+	var jobSpec *config.JobSpec
+	if ctx.String("jobSpec") != "" {
+		var err error
+		if jobSpec, err = config.DecodeJobSpec(ctx.String("jobSpec")); err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		cfg.ApplyJobSpec(*jobSpec)
+		if jobSpec.Credentials != "" {
+			if cfg.Credentials, err = config.OpenCredentials(jobSpec.Credentials); err != nil {
+				return cli.NewExitError(err, 1)
+			}
+		}
+		if jobSpec.ConfigPath != "" {
+			configPath = jobSpec.ConfigPath
+		}
+	}
+
+	if configPath == "" {
 		return cli.NewExitError("pzsvc-exec config file is required", 1)
 	}
-	if err := cfg.ReadPzSEConfig(ctx.String("config")); err != nil {
+	if err := cfg.ReadPzSEConfig(configPath); err != nil {
 		return cli.NewExitError(err, 1)
 	}
 
@@ -94,17 +113,21 @@ func runCmd(ctx *cli.Context) error {
 		return cli.NewExitError("1 or more output files are required", 1)
 	}
 
-	for _, sourceString := range ctx.StringSlice("input") {
-		inFile, err := config.ParseInputSource(sourceString)
-		if err != nil {
-			return cli.NewExitError(err, 1)
+	// Inputs from a job spec are already parsed
+	if jobSpec == nil {
+		for _, sourceString := range ctx.StringSlice("input") {
+			inFile, err := config.ParseInputSource(sourceString)
+			if err != nil {
+				return cli.NewExitError(err, 1)
+			}
+			cfg.Inputs = append(cfg.Inputs, *inFile)
 		}
-		cfg.Inputs = append(cfg.Inputs, *inFile)
 	}
 
 	workerlog.Info(cfg, fmt.Sprintf("config validated: %s", cfg.Serialize()))
 
 	workerlog.Info(cfg, "Starting actual worker execution")
+	workerexec.HandleTermination()
 	err := workerexec.NewWorker().Exec(cfg)
 	if err != nil {
 		workerlog.SimpleErr(cfg, "execution error, quitting with status 1", err)
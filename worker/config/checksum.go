@@ -0,0 +1,43 @@
+// Copyright 2018, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// checksumLengths is the length in bytes of the digest of each supported checksum algorithm
+var checksumLengths = map[string]int{"sha256": 32, "md5": 16}
+
+// ParseChecksum splits an input checksum of the form "<algorithm>:<hex digest>" into
+// its algorithm and lowercase digest, and checks that both are valid
+func ParseChecksum(checksum string) (algorithm string, digest string, err error) {
+	parts := strings.SplitN(checksum, ":", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("Invalid checksum %s; expected <algorithm>:<hex digest>", checksum)
+	}
+	algorithm, digest = strings.ToLower(parts[0]), strings.ToLower(parts[1])
+
+	length, ok := checksumLengths[algorithm]
+	if !ok {
+		return "", "", fmt.Errorf("Unsupported checksum algorithm %s; expected sha256 or md5", parts[0])
+	}
+	if decoded, err := hex.DecodeString(digest); err != nil || len(decoded) != length {
+		return "", "", fmt.Errorf("Invalid %s digest %s", algorithm, parts[1])
+	}
+	return algorithm, digest, nil
+}
@@ -18,15 +18,26 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
 	"strings"
 
 	"github.com/venicegeo/pzsvc-exec/pzsvc"
 )
 
-// InputSource encapsulates the location and sourcing of a file
+// InputSource encapsulates the location and sourcing of a file.  A file is
+// sourced either from an external URL, or from the Piazza data with DataID.
+// Checksum and Size, when given, are verified once the file is downloaded.
+// An input with ExtractTo is unpacked once every input has been downloaded.
 type InputSource struct {
-	FileName string
-	URL      string
+	FileName  string
+	URL       string
+	DataID    string
+	Checksum  string // Expected digest of the file, as "sha256:<hex>" or "md5:<hex>"
+	Size      int64  // Expected size of the file in bytes, or 0 if unknown
+	ExtractTo string // Directory, relative to the working directory, to extract the file into if it is an archive
+
+	Credentials []Credential `json:"-"` // Credentials to download the file with, never written out
+	RetryOn202  bool         `json:"-"` // Whether to wait while the server answers 202 Accepted, from the service's ExtRetryOn202
 }
 
 // ParseInputSource takes a colon-separates input source string and turns it
@@ -49,12 +60,16 @@ type WorkerConfig struct {
 	PiazzaAPIKey    string
 	PiazzaServiceID string
 	CLICommandExtra string
+	Args            []string // Algorithm arguments validated against the config's Params, each passed as one shell word
 	UserID          string
 	JobID           string
 	Inputs          []InputSource
 	Outputs         []string
+	OutputTypes     map[string]string // Piazza data type requested for an output, overriding detection from its extension
 	PzSEConfig      pzsvc.Config
+	WorkDir         string // Scratch directory the job runs in; inputs and outputs are relative to it
 	MuteLogs        bool
+	Credentials     []Credential `json:"-"` // Credentials for external downloads, unsealed from the job spec
 }
 
 // ReadPzSEConfig reads the pzsvc-exec.config data from the given path
@@ -78,7 +93,34 @@ func (wc WorkerConfig) Serialize() string {
 func (wc WorkerConfig) InputsAsMap() map[string]string {
 	converted := map[string]string{}
 	for _, input := range wc.Inputs {
-		converted[input.FileName] = input.URL
+		if input.DataID != "" {
+			converted[input.FileName] = input.DataID
+		} else {
+			converted[input.FileName] = input.URL
+		}
 	}
 	return converted
 }
+
+// WorkPath returns the path of the given input or output file within the job's working directory.
+// Job file names come from the job's submitter, so any that would lead out of it are refused.
+func (wc WorkerConfig) WorkPath(fileName string) (string, error) {
+	if err := CheckRelativePath(fileName); err != nil {
+		return "", err
+	}
+	if wc.WorkDir == "" {
+		return fileName, nil
+	}
+	return filepath.Join(wc.WorkDir, fileName), nil
+}
+
+// CheckRelativePath checks that a file name given by a job stays within the working directory:
+// it may not be absolute, nor climb out of the directory with ".."
+func CheckRelativePath(fileName string) error {
+	cleaned := filepath.Clean(filepath.FromSlash(fileName))
+	if fileName == "" || cleaned == "." || filepath.IsAbs(cleaned) || filepath.VolumeName(cleaned) != "" ||
+		cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("File name %q must be relative to the working directory, and stay within it", fileName)
+	}
+	return nil
+}
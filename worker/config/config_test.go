@@ -83,13 +83,56 @@ func TestInputsAsMap(t *testing.T) {
 	wc := WorkerConfig{Inputs: []InputSource{
 		InputSource{FileName: "testFile1.txt", URL: "http://example1.localdomain/test1.txt"},
 		InputSource{FileName: "testFile2.jp2", URL: "http://example2.localdomain/test2.jp2"},
+		InputSource{FileName: "testFile3.tif", DataID: "test-data-id"},
 	}}
 
 	// Tested code
 	inputs := wc.InputsAsMap()
 
 	// Asserts
-	assert.Len(t, inputs, 2)
+	assert.Len(t, inputs, 3)
 	assert.Equal(t, "http://example1.localdomain/test1.txt", inputs["testFile1.txt"])
 	assert.Equal(t, "http://example2.localdomain/test2.jp2", inputs["testFile2.jp2"])
+	assert.Equal(t, "test-data-id", inputs["testFile3.tif"])
+}
+
+func TestWorkPath(t *testing.T) {
+	// Setup
+	wc := WorkerConfig{}
+	wcWorkDir := WorkerConfig{WorkDir: "/tmp/job-1"}
+
+	// Tested code
+	path, err := wc.WorkPath("output.tif")
+	workPath, workErr := wcWorkDir.WorkPath("output.tif")
+	subPath, subErr := wcWorkDir.WorkPath("out/../out/output.tif")
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, "output.tif", path)
+	assert.Nil(t, workErr)
+	assert.Equal(t, "/tmp/job-1/output.tif", workPath)
+	assert.Nil(t, subErr)
+	assert.Equal(t, "/tmp/job-1/out/output.tif", subPath)
+	for _, name := range []string{"/data/output.tif", "../output.tif", "out/../../output.tif", "..", ".", ""} {
+		_, escapeErr := wcWorkDir.WorkPath(name)
+		assert.Contains(t, escapeErr.Error(), "must be relative to the working directory", name)
+		_, escapeErr = wc.WorkPath(name)
+		assert.NotNil(t, escapeErr, name)
+	}
+}
+
+func TestParseChecksum(t *testing.T) {
+	algorithm, digest, err := ParseChecksum("SHA256:9F86D081884C7D659A2FEAA0C55AD015A3BF4F1B2B0B822CD15D6C15B0F00A08")
+	assert.Nil(t, err)
+	assert.Equal(t, "sha256", algorithm)
+	assert.Equal(t, "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", digest)
+
+	algorithm, _, err = ParseChecksum("md5:098f6bcd4621d373cade4e832627b4f6")
+	assert.Nil(t, err)
+	assert.Equal(t, "md5", algorithm)
+
+	for _, invalid := range []string{"", "098f6bcd4621d373cade4e832627b4f6", "crc32:d87f7e0c", "md5:098f6bcd", "md5:zz8f6bcd4621d373cade4e832627b4f6"} {
+		_, _, err = ParseChecksum(invalid)
+		assert.NotNil(t, err, invalid)
+	}
 }
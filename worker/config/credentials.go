@@ -0,0 +1,143 @@
+// Copyright 2018, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Credential is a set of headers, such as an Authorization header, to send when downloading
+// inputs from the hosts it was issued for
+type Credential struct {
+	Hosts     []string // Hosts the headers may be sent to, as "name" or "name:port"; "*.name" also matches subdomains
+	Input     string   // File name of the only input the headers are for, or "" for all external inputs
+	HTTPHosts []string `json:",omitempty"` // Hosts the headers may also be sent to over plain http, rather than only https
+	Headers   map[string]string
+}
+
+// MatchesURL reports whether the credential may be sent in a request for a URL: one to a host
+// it was issued for, over https, or over http to a host it was issued an http URL for
+func (c Credential) MatchesURL(u *url.URL) bool {
+	switch strings.ToLower(u.Scheme) {
+	case "https":
+		return c.MatchesHost(u)
+	case "http":
+		return c.MatchesHost(u) && hostMatches(c.HTTPHosts, u)
+	}
+	return false
+}
+
+// MatchesHost reports whether the credential was issued for the host of a URL
+func (c Credential) MatchesHost(u *url.URL) bool {
+	return hostMatches(c.Hosts, u)
+}
+
+func hostMatches(patterns []string, u *url.URL) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		host := strings.ToLower(u.Hostname())
+		if strings.Contains(pattern, ":") {
+			host = strings.ToLower(u.Host)
+		}
+		if pattern == host || (strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// CredentialsFor returns the credentials that may be used to download the named input
+func (wc WorkerConfig) CredentialsFor(fileName string) []Credential {
+	var credentials []Credential
+	for _, credential := range wc.Credentials {
+		if credential.Input == "" || credential.Input == fileName {
+			credentials = append(credentials, credential)
+		}
+	}
+	return credentials
+}
+
+// credentialKey derives the key credentials are sealed with from JOB_SECRET_KEY, which the
+// Dispatcher and its Worker tasks share through the app's environment
+func credentialKey() ([]byte, error) {
+	secret := os.Getenv("JOB_SECRET_KEY")
+	if secret == "" {
+		return nil, errors.New("Job credentials cannot be passed to the worker unless JOB_SECRET_KEY is set")
+	}
+	key := sha256.Sum256([]byte(secret))
+	return key[:], nil
+}
+
+func credentialCipher() (cipher.AEAD, error) {
+	key, err := credentialKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealCredentials encrypts credentials to be carried in a job spec.  The spec is part of the
+// task's command, which shows in task listings and logs, so credentials never go in it as text.
+func SealCredentials(credentials []Credential) (string, error) {
+	data, err := json.Marshal(credentials)
+	if err != nil {
+		return "", err
+	}
+	aead, err := credentialCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, data, nil)), nil
+}
+
+// OpenCredentials decrypts the credentials sealed in a job spec
+func OpenCredentials(sealed string) ([]Credential, error) {
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := credentialCipher()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("Sealed job credentials are truncated")
+	}
+	data, err = aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("Job credentials could not be unsealed; JOB_SECRET_KEY may differ from the dispatcher's")
+	}
+	var credentials []Credential
+	err = json.Unmarshal(data, &credentials)
+	return credentials, err
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCredential_MatchesHost(t *testing.T) {
+	// Setup
+	credential := Credential{Hosts: []string{"data.example.localdomain", "*.images.localdomain", "archive.localdomain:8443"}}
+	matches := map[string]bool{
+		"https://data.example.localdomain/file.tif":      true,
+		"https://DATA.example.localdomain:443/file.tif":  true,
+		"https://a.images.localdomain/file.tif":          true,
+		"https://images.localdomain/file.tif":            false,
+		"https://archive.localdomain:8443/file.tif":      true,
+		"https://archive.localdomain/file.tif":           false,
+		"https://data.example.localdomain.evil/file.tif": false,
+	}
+
+	for rawURL, expected := range matches {
+		parsed, _ := url.Parse(rawURL)
+
+		// Tested code
+		matched := credential.MatchesHost(parsed)
+
+		// Asserts
+		assert.Equal(t, expected, matched, rawURL)
+	}
+}
+
+func TestCredential_MatchesURL(t *testing.T) {
+	// Setup
+	secure := Credential{Hosts: []string{"data.example.localdomain", "images.localdomain"}}
+	plain := Credential{Hosts: []string{"data.example.localdomain", "images.localdomain"}, HTTPHosts: []string{"data.example.localdomain"}}
+	matches := map[string][2]bool{
+		"https://data.example.localdomain/file.tif": {true, true},
+		"HTTPS://data.example.localdomain/file.tif": {true, true},
+		"http://data.example.localdomain/file.tif":  {false, true},
+		"ftp://data.example.localdomain/file.tif":   {false, false},
+		"https://images.localdomain/file.tif":       {true, true},
+		"http://images.localdomain/file.tif":        {false, false},
+		"https://other.localdomain/file.tif":        {false, false},
+	}
+
+	for rawURL, expected := range matches {
+		parsed, _ := url.Parse(rawURL)
+
+		// Tested code
+		matchedSecure := secure.MatchesURL(parsed)
+		matchedPlain := plain.MatchesURL(parsed)
+
+		// Asserts
+		assert.Equal(t, expected, [2]bool{matchedSecure, matchedPlain}, rawURL)
+	}
+}
+
+func TestWorkerConfig_CredentialsFor(t *testing.T) {
+	// Setup
+	all := Credential{Hosts: []string{"example.localdomain"}, Headers: map[string]string{"Authorization": "all"}}
+	one := Credential{Hosts: []string{"example.localdomain"}, Input: "in1.tif", Headers: map[string]string{"X-Token": "one"}}
+	workerConfig := WorkerConfig{Credentials: []Credential{all, one}}
+
+	// Tested code & Asserts
+	assert.Equal(t, []Credential{all, one}, workerConfig.CredentialsFor("in1.tif"))
+	assert.Equal(t, []Credential{all}, workerConfig.CredentialsFor("in2.tif"))
+	assert.Nil(t, WorkerConfig{}.CredentialsFor("in1.tif"))
+}
+
+func TestSealCredentials_RoundTrip(t *testing.T) {
+	// Setup
+	oldKey := os.Getenv("JOB_SECRET_KEY")
+	defer os.Setenv("JOB_SECRET_KEY", oldKey)
+	os.Setenv("JOB_SECRET_KEY", "test-secret")
+	credentials := []Credential{{Hosts: []string{"example.localdomain"}, Headers: map[string]string{"Authorization": "Bearer abc"}}}
+
+	// Tested code
+	sealed, errSeal := SealCredentials(credentials)
+	opened, errOpen := OpenCredentials(sealed)
+	os.Setenv("JOB_SECRET_KEY", "other-secret")
+	_, errWrongKey := OpenCredentials(sealed)
+	os.Setenv("JOB_SECRET_KEY", "")
+	_, errNoKey := SealCredentials(credentials)
+
+	// Asserts
+	assert.Nil(t, errSeal)
+	assert.NotContains(t, sealed, "Bearer")
+	assert.Nil(t, errOpen)
+	assert.Equal(t, credentials, opened)
+	assert.Contains(t, errWrongKey.Error(), "could not be unsealed")
+	assert.Contains(t, errNoKey.Error(), "unless JOB_SECRET_KEY is set")
+}
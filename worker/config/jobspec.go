@@ -0,0 +1,107 @@
+// Copyright 2018, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// JobSpecVersion is the version of the job spec format written and read by this build
+const JobSpecVersion = 1
+
+// MaxEncodedJobSpecBytes is the longest an encoded job spec may be.  The spec is one word of
+// the task's command, which the shell is given as a single argument, and Linux refuses to run a
+// command with an argument over 128 KiB, so this leaves room for the rest of the command.
+const MaxEncodedJobSpecBytes = 100 * 1024
+
+// JobSpec is the specification of a single job, handed from the dispatcher to the
+// worker as one encoded value, so that user-supplied values never go through shell quoting
+type JobSpec struct {
+	Version         int
+	ConfigPath      string
+	ServiceID       string
+	JobID           string
+	UserID          string
+	CLICommandExtra string
+	Args            []string
+	Inputs          []InputSource
+	Outputs         []string
+	OutputTypes     map[string]string
+	Credentials     string `json:",omitempty"` // Credentials for external downloads, sealed with SealCredentials
+}
+
+// Encode serializes the spec as gzipped JSON in base64, which is compact and safe
+// to use unquoted in a shell command
+func (js JobSpec) Encode() (string, error) {
+	data, err := json.Marshal(js)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	zipper := gzip.NewWriter(&buf)
+	if _, err = zipper.Write(data); err != nil {
+		return "", err
+	}
+	if err = zipper.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// DecodeJobSpec parses a job spec created by JobSpec.Encode
+func DecodeJobSpec(encoded string) (*JobSpec, error) {
+	zipped, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid job spec encoding: %v", err)
+	}
+	unzipper, err := gzip.NewReader(bytes.NewReader(zipped))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid job spec encoding: %v", err)
+	}
+	data, err := ioutil.ReadAll(unzipper)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid job spec encoding: %v", err)
+	}
+
+	var spec JobSpec
+	if err = json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("Invalid job spec: %v", err)
+	}
+	if spec.Version != JobSpecVersion {
+		return nil, fmt.Errorf("Unsupported job spec version %d (expected %d)", spec.Version, JobSpecVersion)
+	}
+	return &spec, nil
+}
+
+// ApplyJobSpec sets the job-specific configuration from the given spec
+func (wc *WorkerConfig) ApplyJobSpec(spec JobSpec) {
+	wc.PiazzaServiceID = spec.ServiceID
+	wc.JobID = spec.JobID
+	wc.UserID = spec.UserID
+	wc.CLICommandExtra = spec.CLICommandExtra
+	wc.Args = append([]string{}, spec.Args...)
+	wc.Inputs = append([]InputSource{}, spec.Inputs...)
+	wc.Outputs = append([]string{}, spec.Outputs...)
+	wc.OutputTypes = map[string]string{}
+	for fileName, fileType := range spec.OutputTypes {
+		wc.OutputTypes[fileName] = fileType
+	}
+}
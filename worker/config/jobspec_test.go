@@ -0,0 +1,88 @@
+package config
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobSpec_EncodeDecode(t *testing.T) {
+	// Setup
+	spec := JobSpec{
+		Version:         JobSpecVersion,
+		ConfigPath:      "/path/to/config",
+		ServiceID:       "test-service-id",
+		JobID:           "test-job-id",
+		UserID:          "test-user-id",
+		CLICommandExtra: `--flag 'quoted value' "and more"`,
+		Inputs:          []InputSource{{FileName: "input.tif", URL: "https://example.localdomain/input.tif"}},
+		Outputs:         []string{"output.geojson"},
+		OutputTypes:     map[string]string{"output.geojson": "geojson"},
+	}
+
+	// Tested code
+	encoded, err := spec.Encode()
+	decoded, decodeErr := DecodeJobSpec(encoded)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Nil(t, decodeErr)
+	assert.Equal(t, spec, *decoded)
+}
+
+func TestDecodeJobSpec_BadEncoding(t *testing.T) {
+	// Tested code
+	spec, err := DecodeJobSpec("not base64!")
+
+	// Asserts
+	assert.Nil(t, spec)
+	assert.Contains(t, err.Error(), "Invalid job spec encoding")
+}
+
+func TestDecodeJobSpec_NotGzipped(t *testing.T) {
+	// Tested code
+	spec, err := DecodeJobSpec(base64.StdEncoding.EncodeToString([]byte(`{"Version": 1}`)))
+
+	// Asserts
+	assert.Nil(t, spec)
+	assert.Contains(t, err.Error(), "Invalid job spec encoding")
+}
+
+func TestDecodeJobSpec_BadVersion(t *testing.T) {
+	// Setup
+	encoded, _ := JobSpec{Version: JobSpecVersion + 1}.Encode()
+
+	// Tested code
+	spec, err := DecodeJobSpec(encoded)
+
+	// Asserts
+	assert.Nil(t, spec)
+	assert.Contains(t, err.Error(), "Unsupported job spec version")
+}
+
+func TestWorkerConfig_ApplyJobSpec(t *testing.T) {
+	// Setup
+	wc := WorkerConfig{JobID: "old-job-id", Outputs: []string{"old.geojson"}}
+	spec := JobSpec{
+		ServiceID:       "test-service-id",
+		JobID:           "test-job-id",
+		UserID:          "test-user-id",
+		CLICommandExtra: "test-extra",
+		Inputs:          []InputSource{{FileName: "input.tif", URL: "https://example.localdomain/input.tif"}},
+		Outputs:         []string{"output.tif"},
+		OutputTypes:     map[string]string{"output.tif": "raster"},
+	}
+
+	// Tested code
+	wc.ApplyJobSpec(spec)
+
+	// Asserts
+	assert.Equal(t, "test-service-id", wc.PiazzaServiceID)
+	assert.Equal(t, "test-job-id", wc.JobID)
+	assert.Equal(t, "test-user-id", wc.UserID)
+	assert.Equal(t, "test-extra", wc.CLICommandExtra)
+	assert.Equal(t, spec.Inputs, wc.Inputs)
+	assert.Equal(t, []string{"output.tif"}, wc.Outputs)
+	assert.Equal(t, map[string]string{"output.tif": "raster"}, wc.OutputTypes)
+}
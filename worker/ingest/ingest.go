@@ -58,14 +58,24 @@ func assembleIngestorCalls(cfg config.WorkerConfig, algFullCommand string, algVe
 
 	for _, filePath := range cfg.Outputs {
 		workerlog.Info(cfg, "preparing ingest call: "+filePath)
-		if _, fStatErr := os.Stat(filePath); fStatErr != nil {
+		// Outputs are found in the job's working directory, which the session's SubFold points IngestFile at
+		workPath, pathErr := cfg.WorkPath(filePath)
+		if pathErr != nil {
+			workerlog.SimpleErr(cfg, "invalid output file name", pathErr)
+			outputErrors = append(outputErrors, errors.New("error validating outputs"))
+			continue
+		}
+		if _, fStatErr := os.Stat(workPath); fStatErr != nil {
 			errMsg := fmt.Sprintf("error statting file `%s`: %v", filePath, fStatErr)
 			workerlog.SimpleErr(cfg, errMsg, fStatErr)
 			outputErrors = append(outputErrors, errors.New("error validating outputs"))
 			continue
 		}
 
-		fileType := detectPiazzaFileType(filePath)
+		fileType := cfg.OutputTypes[filePath]
+		if fileType == "" {
+			fileType = detectPiazzaFileType(filePath)
+		}
 
 		attMap := map[string]string{
 			"algoName":     cfg.PiazzaServiceID,
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -84,6 +85,12 @@ func setUpMockOutputs() {
 	if err != nil {
 		panic(err)
 	}
+	// Outputs are named relative to the job's working directory
+	testWorkerConfig.WorkDir = filepath.Dir(mockOutput1.Name())
+}
+
+func outputName(mockOutput *os.File) string {
+	return filepath.Base(mockOutput.Name())
 }
 
 func tearDownMockOutputs() {
@@ -95,7 +102,7 @@ func tearDownMockOutputs() {
 
 func TestAssembleIngestorCalls_Success(t *testing.T) {
 	// Setup
-	testWorkerConfig.Outputs = []string{mockOutput1.Name(), mockOutput2.Name()}
+	testWorkerConfig.Outputs = []string{outputName(mockOutput1), outputName(mockOutput2)}
 
 	// Tested code
 	ingestorCalls, asmErrors := assembleIngestorCalls(testWorkerConfig, "./run_algo --someArg 123 --anotherAlg value", "1.2.3test")
@@ -105,18 +112,47 @@ func TestAssembleIngestorCalls_Success(t *testing.T) {
 	assert.Len(t, ingestorCalls, 2)
 
 	assert.Equal(t, "1.2.3test", ingestorCalls[0].algVersion)
-	assert.Equal(t, mockOutput1.Name(), ingestorCalls[0].filePath)
+	assert.Equal(t, outputName(mockOutput1), ingestorCalls[0].filePath)
 	assert.Equal(t, testWorkerConfig.PiazzaServiceID, ingestorCalls[0].serviceID)
 	assert.Equal(t, "./run_algo --someArg 123 --anotherAlg value", ingestorCalls[0].attMap["algoCmd"])
 	assert.Equal(t, "1.2.3test", ingestorCalls[0].attMap["algoVersion"])
 
 	assert.Equal(t, "1.2.3test", ingestorCalls[1].algVersion)
-	assert.Equal(t, mockOutput2.Name(), ingestorCalls[1].filePath)
+	assert.Equal(t, outputName(mockOutput2), ingestorCalls[1].filePath)
 	assert.Equal(t, testWorkerConfig.PiazzaServiceID, ingestorCalls[1].serviceID)
 	assert.Equal(t, "./run_algo --someArg 123 --anotherAlg value", ingestorCalls[1].attMap["algoCmd"])
 	assert.Equal(t, "1.2.3test", ingestorCalls[1].attMap["algoVersion"])
 }
 
+func TestAssembleIngestorCalls_RequestedType(t *testing.T) {
+	// Setup
+	testWorkerConfig.Outputs = []string{outputName(mockOutput1), outputName(mockOutput2)}
+	testWorkerConfig.OutputTypes = map[string]string{outputName(mockOutput1): "raster"}
+	defer func() { testWorkerConfig.OutputTypes = nil }()
+
+	// Tested code
+	ingestorCalls, asmErrors := assembleIngestorCalls(testWorkerConfig, "./run_algo", "1.2.3test")
+
+	// Asserts
+	assert.Empty(t, asmErrors)
+	assert.Len(t, ingestorCalls, 2)
+	assert.Equal(t, "raster", ingestorCalls[0].fileType)
+	assert.Equal(t, detectPiazzaFileType(outputName(mockOutput2)), ingestorCalls[1].fileType)
+}
+
+func TestAssembleIngestorCalls_WorkDir(t *testing.T) {
+	// Setup
+	testWorkerConfig.Outputs = []string{outputName(mockOutput1)}
+
+	// Tested code
+	ingestorCalls, asmErrors := assembleIngestorCalls(testWorkerConfig, "./run_algo", "1.2.3test")
+
+	// Asserts
+	assert.Empty(t, asmErrors)
+	assert.Len(t, ingestorCalls, 1)
+	assert.Equal(t, outputName(mockOutput1), ingestorCalls[0].filePath)
+}
+
 func TestAssembleIngestorCalls_Failure(t *testing.T) {
 	// Setup
 	testWorkerConfig.Outputs = []string{"does_not_exist_1.txt", "does_not_exist_2.geojson"}
@@ -131,7 +167,7 @@ func TestAssembleIngestorCalls_Failure(t *testing.T) {
 
 func TestAssembleIngestorCalls_Mixture(t *testing.T) {
 	// Setup
-	testWorkerConfig.Outputs = []string{"does_not_exist_1.txt", mockOutput1.Name(), "does_not_exist_2.geojson", mockOutput2.Name()}
+	testWorkerConfig.Outputs = []string{"does_not_exist_1.txt", outputName(mockOutput1), "does_not_exist_2.geojson", outputName(mockOutput2)}
 
 	// Tested code
 	ingestorCalls, asmErrors := assembleIngestorCalls(testWorkerConfig, "./run_algo --someArg 123 --anotherAlg value", "1.2.3test")
@@ -141,13 +177,13 @@ func TestAssembleIngestorCalls_Mixture(t *testing.T) {
 	assert.Len(t, asmErrors, 2)
 
 	assert.Equal(t, "1.2.3test", ingestorCalls[0].algVersion)
-	assert.Equal(t, mockOutput1.Name(), ingestorCalls[0].filePath)
+	assert.Equal(t, outputName(mockOutput1), ingestorCalls[0].filePath)
 	assert.Equal(t, testWorkerConfig.PiazzaServiceID, ingestorCalls[0].serviceID)
 	assert.Equal(t, "./run_algo --someArg 123 --anotherAlg value", ingestorCalls[0].attMap["algoCmd"])
 	assert.Equal(t, "1.2.3test", ingestorCalls[0].attMap["algoVersion"])
 
 	assert.Equal(t, "1.2.3test", ingestorCalls[1].algVersion)
-	assert.Equal(t, mockOutput2.Name(), ingestorCalls[1].filePath)
+	assert.Equal(t, outputName(mockOutput2), ingestorCalls[1].filePath)
 	assert.Equal(t, testWorkerConfig.PiazzaServiceID, ingestorCalls[1].serviceID)
 	assert.Equal(t, "./run_algo --someArg 123 --anotherAlg value", ingestorCalls[1].attMap["algoCmd"])
 }
@@ -224,10 +260,10 @@ func TestHandleIngestResults(t *testing.T) {
 
 func TestOutputFilesToPiazza_Full(t *testing.T) {
 	// Setup
-	testWorkerConfig.Outputs = []string{mockOutput1.Name(), mockOutput2.Name(), "does_not_exist.txt"}
+	testWorkerConfig.Outputs = []string{outputName(mockOutput1), outputName(mockOutput2), "does_not_exist.txt"}
 	mockOutputs := []singleIngestOutput{
-		singleIngestOutput{mockOutput1.Name(), "output-data-id-1", nil},
-		singleIngestOutput{mockOutput2.Name(), "output-data-id-2", nil},
+		singleIngestOutput{outputName(mockOutput1), "output-data-id-1", nil},
+		singleIngestOutput{outputName(mockOutput2), "output-data-id-2", nil},
 	}
 	mockAsyncIngestorInstance.Reset(mockOutputs)
 
@@ -238,6 +274,18 @@ func TestOutputFilesToPiazza_Full(t *testing.T) {
 	assert.Len(t, multiOutput.Errors, 1)
 }
 
+func TestAssembleIngestorCalls_EscapingName(t *testing.T) {
+	// Setup
+	testWorkerConfig.Outputs = []string{"../../proc/self/environ", mockOutput1.Name()}
+
+	// Tested code
+	ingestorCalls, asmErrors := assembleIngestorCalls(testWorkerConfig, "./run_algo", "1.2.3test")
+
+	// Asserts
+	assert.Empty(t, ingestorCalls)
+	assert.Len(t, asmErrors, 2)
+}
+
 func TestDetectPiazzaFileType(t *testing.T) {
 	assert.Equal(t, "geojson", detectPiazzaFileType("something.geojson"))
 	assert.Equal(t, "geojson", detectPiazzaFileType("SOMETHING_ELSE.GEOJSON"))
@@ -0,0 +1,371 @@
+// Copyright 2018, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/venicegeo/pzsvc-exec/worker/config"
+)
+
+// inputCache is a store of downloaded inputs on disk, which the Workers on a machine can share.
+// A file is kept under a key made from its URL, the credentials it was downloaded with, and its
+// version, which is the checksum the job gave for it, or else the ETag the server gives for it.
+// Files without either are not cached.  Each file is kept with its SHA-256 digest, and is
+// checked against it whenever it is used, so that a copy a job has changed is never handed on.
+type inputCache struct {
+	Dir      string
+	MaxBytes int64 // Most bytes the cached files may hold, beyond which the least recently used are removed
+	Link     bool  // Whether to hard link cached files into job directories, rather than copy them
+}
+
+const (
+	cacheEntrySuffix  = ".data"
+	cacheDigestSuffix = ".sha256"
+	cacheLockSuffix   = ".lock"
+	cacheHeadTimeout  = 30 * time.Second
+)
+
+func getInputCache() *inputCache {
+	dir := os.Getenv("INPUT_CACHE_DIR")
+	if dir == "" {
+		return nil
+	}
+	link := false
+	if envLink := os.Getenv("INPUT_CACHE_LINK"); envLink != "" {
+		if parsed, err := strconv.ParseBool(envLink); err == nil {
+			link = parsed
+		}
+	}
+	return &inputCache{Dir: dir, MaxBytes: int64(getEnvInt("INPUT_CACHE_MAX_MB", 10240)) << 20, Link: link}
+}
+
+// withInputCache wraps a downloader with the cache configured by INPUT_CACHE_DIR, if any
+func withInputCache(next asyncDownloader) asyncDownloader {
+	if cache := getInputCache(); cache != nil {
+		return cachingDownloader{cache: *cache, next: next}
+	}
+	return next
+}
+
+// cachingDownloader serves inputs from the cache where it can.  It downloads the others with
+// the next downloader, then adds them to the cache.
+type cachingDownloader struct {
+	cache inputCache
+	next  asyncDownloader
+}
+
+// checksumDownloader is a downloader that also reports the checksums the server gave for the
+// file it downloaded
+type checksumDownloader interface {
+	downloadInput(source config.InputSource, header http.Header) (serverChecksums, error)
+}
+
+func (d cachingDownloader) DownloadInputAsync(source config.InputSource, header http.Header) chan error {
+	errChan := make(chan error)
+
+	go func() {
+		defer close(errChan)
+		if err := d.download(source, header); err != nil {
+			errChan <- err
+		}
+	}()
+
+	return errChan
+}
+
+func (d cachingDownloader) download(source config.InputSource, header http.Header) error {
+	version := source.Checksum
+	if version == "" {
+		version = fetchETag(source, header)
+	}
+	if version == "" {
+		return <-d.next.DownloadInputAsync(source, header)
+	}
+
+	// Holding the lock of the entry while downloading it means that Workers wanting the same
+	// file wait for one download, rather than each making their own
+	key := cacheKey(source.URL, credentialScope(source, header), version)
+	if err := os.MkdirAll(d.cache.Dir, 0777); err != nil {
+		fmt.Fprintf(os.Stderr, "Input cache %s is unusable: %v\n", d.cache.Dir, err)
+		return <-d.next.DownloadInputAsync(source, header)
+	}
+	lock, err := lockFile(d.cache.path(key, cacheLockSuffix))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not lock input cache entry for %s: %v\n", source.URL, err)
+		return <-d.next.DownloadInputAsync(source, header)
+	}
+	defer lock.Unlock()
+
+	if err = d.cache.fetch(key, source); err == nil {
+		fmt.Fprintf(os.Stderr, "Input %s served from cache\n", source.FileName)
+		return nil
+	} else if !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "Could not use cached copy of %s, downloading it instead: %v\n", source.URL, err)
+	}
+
+	if source.Checksum != "" {
+		// The download is verified against the checksum, so it is the version the key names
+		err = <-d.next.DownloadInputAsync(source, header)
+	} else {
+		err = d.downloadETag(source, header, version)
+	}
+	if err == errNotCacheable {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// A file that cannot be cached has still been downloaded, so the job carries on
+	if err = d.cache.store(key, source.FileName); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not add %s to input cache: %v\n", source.URL, err)
+	}
+	return nil
+}
+
+// errNotCacheable is returned by downloadETag for a file that was downloaded, but must not
+// be cached under the version asked for
+var errNotCacheable = errors.New("downloaded input is not the version asked for")
+
+// downloadETag downloads a file cached under the ETag from a HEAD request.  The file may have
+// changed between the HEAD and the download, so it is only cached if the download had the same
+// ETag, and only downloaders that report the ETag can download files for caching.
+func (d cachingDownloader) downloadETag(source config.InputSource, header http.Header, etag string) error {
+	next, ok := d.next.(checksumDownloader)
+	if !ok {
+		if err := <-d.next.DownloadInputAsync(source, header); err != nil {
+			return err
+		}
+		return errNotCacheable
+	}
+	server, err := next.downloadInput(source, header)
+	if err != nil {
+		return err
+	}
+	if server.ETag != etag {
+		fmt.Fprintf(os.Stderr, "Input at URL %s changed while being fetched (ETag %s, then %s), so it is not cached\n", source.URL, etag, server.ETag)
+		return errNotCacheable
+	}
+	return nil
+}
+
+// fetchETag asks the server for the strong ETag of a source, returning "" if it gives none
+func fetchETag(source config.InputSource, header http.Header) string {
+	ctx, cancel := context.WithTimeout(context.Background(), cacheHeadTimeout)
+	defer cancel()
+	req, err := http.NewRequest("HEAD", source.URL, nil)
+	if err != nil {
+		return ""
+	}
+	req = req.WithContext(ctx)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req = withCredentials(req, source.Credentials)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return ""
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || strings.HasPrefix(etag, "W/") {
+		return ""
+	}
+	return etag
+}
+
+// credentialScope describes the credentials a source is downloaded with, so that a file
+// downloaded with one job's credentials is never served to a job with other credentials
+func credentialScope(source config.InputSource, header http.Header) string {
+	scope, _ := json.Marshal(struct {
+		Authorization []string
+		Credentials   []config.Credential
+	}{header["Authorization"], source.Credentials})
+	return string(scope)
+}
+
+func cacheKey(url, scope, version string) string {
+	digest := sha256.Sum256([]byte(url + "\n" + scope + "\n" + version))
+	return hex.EncodeToString(digest[:])
+}
+
+func (c inputCache) path(key, suffix string) string {
+	return filepath.Join(c.Dir, key+suffix)
+}
+
+// fetch puts the cached copy of a file into place for the job, and marks it as recently used.
+// A copy that no longer matches its digest is removed from the cache.  The caller must hold
+// the lock of the entry.
+func (c inputCache) fetch(key string, source config.InputSource) error {
+	entryPath := c.path(key, cacheEntrySuffix)
+	info, err := os.Stat(entryPath)
+	if err != nil {
+		return err
+	}
+	if source.Size > 0 && info.Size() != source.Size {
+		return fmt.Errorf("cached copy is %d bytes, but %d were expected", info.Size(), source.Size)
+	}
+	expected, err := ioutil.ReadFile(c.path(key, cacheDigestSuffix))
+	if err != nil {
+		c.remove(key)
+		return fmt.Errorf("cached copy has no digest: %v", err)
+	}
+	now := time.Now()
+	if err = os.Chtimes(entryPath, now, now); err != nil {
+		return err
+	}
+	digest, err := c.linkOrCopy(entryPath, source.FileName)
+	if err != nil {
+		return err
+	}
+	if digest != string(expected) {
+		os.Remove(source.FileName)
+		c.remove(key)
+		return fmt.Errorf("cached copy has been changed since it was stored (its sha256 is %s, but %s was expected)", digest, expected)
+	}
+	return nil
+}
+
+// store adds a downloaded file to the cache, then makes room for it.  The file is always
+// copied, so that the job's own input is not the cached file.  The caller must hold the lock
+// of the entry.
+func (c inputCache) store(key, fileName string) error {
+	entryPath := c.path(key, cacheEntrySuffix)
+	tempPath := c.path(key, ".tmp")
+	os.Remove(tempPath)
+	digest, err := copyFile(fileName, tempPath)
+	if err != nil {
+		return err
+	}
+	// Cached files are read-only, so that a job given a link to one does not change it by mistake
+	if err = os.Chmod(tempPath, 0444); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	if err = ioutil.WriteFile(c.path(key, cacheDigestSuffix), []byte(digest), 0444); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	if err = os.Rename(tempPath, entryPath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return c.evict(key)
+}
+
+// remove deletes an entry from the cache.  The caller must hold the lock of the entry.
+func (c inputCache) remove(key string) error {
+	os.Remove(c.path(key, cacheDigestSuffix))
+	return os.Remove(c.path(key, cacheEntrySuffix))
+}
+
+// linkOrCopy hard links a file to a new name, or copies it if linking is off or fails, as it
+// does across filesystems.  It returns the SHA-256 digest of the file it put in place.
+func (c inputCache) linkOrCopy(source, target string) (string, error) {
+	if c.Link && os.Link(source, target) == nil {
+		return fileDigest(target)
+	}
+	return copyFile(source, target)
+}
+
+// copyFile copies a file to a new name, returning the SHA-256 digest of what it copied
+func copyFile(source, target string) (string, error) {
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return "", err
+	}
+	defer sourceFile.Close()
+	targetFile, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(targetFile, digest), sourceFile); err != nil {
+		targetFile.Close()
+		os.Remove(target)
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), targetFile.Close()
+}
+
+// fileDigest returns the SHA-256 digest of a file
+func fileDigest(fileName string) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	digest := sha256.New()
+	if _, err = io.Copy(digest, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// evict removes the least recently used files until the cache fits in its size, keeping the
+// entry just stored, and any entry another Worker holds the lock of
+func (c inputCache) evict(keep string) error {
+	lock, err := lockFile(filepath.Join(c.Dir, "evict"+cacheLockSuffix))
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	infos, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return err
+	}
+	entries := []os.FileInfo{}
+	var total int64
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), cacheEntrySuffix) {
+			entries = append(entries, info)
+			total += info.Size()
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ModTime().Before(entries[j].ModTime()) })
+
+	for _, entry := range entries {
+		if total <= c.MaxBytes {
+			break
+		}
+		key := strings.TrimSuffix(entry.Name(), cacheEntrySuffix)
+		if key == keep {
+			continue
+		}
+		entryLock, err := tryLockFile(c.path(key, cacheLockSuffix))
+		if err != nil || entryLock == nil {
+			continue
+		}
+		if err = c.remove(key); err == nil {
+			total -= entry.Size()
+		}
+		entryLock.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package input
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/pzsvc-exec/worker/config"
+)
+
+// cacheTestServer serves "test data", counting the downloads it is asked for
+type cacheTestServer struct {
+	ETag  string
+	mutex sync.Mutex
+	gets  int
+}
+
+func (s *cacheTestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.ETag != "" {
+		w.Header().Set("ETag", s.ETag)
+	}
+	if r.Method == "HEAD" {
+		return
+	}
+	s.mutex.Lock()
+	s.gets++
+	s.mutex.Unlock()
+	time.Sleep(10 * time.Millisecond) // Lets concurrent requests overlap
+	w.Write([]byte("test data"))
+}
+
+func (s *cacheTestServer) Gets() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.gets
+}
+
+// setupCache returns a caching downloader using a new cache directory, and a directory for job files
+func setupCache(t *testing.T, link bool) (cachingDownloader, string, string) {
+	cacheDir, err := ioutil.TempDir("", "cache_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobDir, err := ioutil.TempDir("", "cache_test_job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloader := cachingDownloader{
+		cache: inputCache{Dir: cacheDir, MaxBytes: 1 << 20, Link: link},
+		next:  defaultAsyncDownloader{},
+	}
+	return downloader, cacheDir, jobDir
+}
+
+func TestCachingDownloader_ETag(t *testing.T) {
+	// Setup
+	server := &cacheTestServer{ETag: `"abc123"`}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	downloader, cacheDir, jobDir := setupCache(t, true)
+	defer os.RemoveAll(cacheDir)
+	defer os.RemoveAll(jobDir)
+	first := config.InputSource{FileName: filepath.Join(jobDir, "first.txt"), URL: httpServer.URL + "/scene.tif"}
+	second := config.InputSource{FileName: filepath.Join(jobDir, "second.txt"), URL: httpServer.URL + "/scene.tif"}
+
+	// Tested code
+	errFirst := <-downloader.DownloadInputAsync(first, http.Header{})
+	errSecond := <-downloader.DownloadInputAsync(second, http.Header{})
+
+	// Asserts
+	assert.Nil(t, errFirst)
+	assert.Nil(t, errSecond)
+	assert.Equal(t, 1, server.Gets())
+	assertExtractedFile(t, second.FileName, "test data")
+	firstInfo, _ := os.Stat(first.FileName)
+	secondInfo, _ := os.Stat(second.FileName)
+	assert.False(t, os.SameFile(firstInfo, secondInfo))
+	assert.NotEqual(t, os.FileMode(0444), firstInfo.Mode().Perm()) // The downloading job's input is not the cached file
+	assert.Equal(t, os.FileMode(0444), secondInfo.Mode().Perm())
+}
+
+func TestCachingDownloader_ChangedEntry(t *testing.T) {
+	// Setup: a job given a link to the cached file changes it in place
+	server := &cacheTestServer{ETag: `"abc123"`}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	downloader, cacheDir, jobDir := setupCache(t, true)
+	defer os.RemoveAll(cacheDir)
+	defer os.RemoveAll(jobDir)
+	first := config.InputSource{FileName: filepath.Join(jobDir, "first.txt"), URL: httpServer.URL}
+	second := config.InputSource{FileName: filepath.Join(jobDir, "second.txt"), URL: httpServer.URL}
+	third := config.InputSource{FileName: filepath.Join(jobDir, "third.txt"), URL: httpServer.URL}
+	assert.Nil(t, <-downloader.DownloadInputAsync(first, http.Header{}))
+	assert.Nil(t, <-downloader.DownloadInputAsync(second, http.Header{}))
+	os.Chmod(second.FileName, 0666)
+	ioutil.WriteFile(second.FileName, []byte("evil data"), 0666)
+
+	// Tested code
+	err := <-downloader.DownloadInputAsync(third, http.Header{})
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, 2, server.Gets())
+	assertExtractedFile(t, third.FileName, "test data")
+}
+
+func TestCachingDownloader_Checksum(t *testing.T) {
+	// Setup
+	server := &cacheTestServer{}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	downloader, cacheDir, jobDir := setupCache(t, false)
+	defer os.RemoveAll(cacheDir)
+	defer os.RemoveAll(jobDir)
+	checksum := "sha256:" + testDataSHA256
+	first := config.InputSource{FileName: filepath.Join(jobDir, "first.txt"), URL: httpServer.URL + "/scene.tif", Checksum: checksum}
+	second := config.InputSource{FileName: filepath.Join(jobDir, "second.txt"), URL: httpServer.URL + "/scene.tif", Checksum: checksum}
+
+	// Tested code
+	errFirst := <-downloader.DownloadInputAsync(first, http.Header{})
+	errSecond := <-downloader.DownloadInputAsync(second, http.Header{})
+
+	// Asserts
+	assert.Nil(t, errFirst)
+	assert.Nil(t, errSecond)
+	assert.Equal(t, 1, server.Gets())
+	assertExtractedFile(t, second.FileName, "test data")
+	firstInfo, _ := os.Stat(first.FileName)
+	secondInfo, _ := os.Stat(second.FileName)
+	assert.False(t, os.SameFile(firstInfo, secondInfo))
+}
+
+func TestCachingDownloader_NoVersion(t *testing.T) {
+	// Setup
+	server := &cacheTestServer{}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	downloader, cacheDir, jobDir := setupCache(t, true)
+	defer os.RemoveAll(cacheDir)
+	defer os.RemoveAll(jobDir)
+
+	// Tested code
+	errFirst := <-downloader.DownloadInputAsync(config.InputSource{FileName: filepath.Join(jobDir, "first.txt"), URL: httpServer.URL}, http.Header{})
+	errSecond := <-downloader.DownloadInputAsync(config.InputSource{FileName: filepath.Join(jobDir, "second.txt"), URL: httpServer.URL}, http.Header{})
+
+	// Asserts
+	assert.Nil(t, errFirst)
+	assert.Nil(t, errSecond)
+	assert.Equal(t, 2, server.Gets())
+}
+
+func TestCachingDownloader_Concurrent(t *testing.T) {
+	// Setup
+	server := &cacheTestServer{ETag: `"abc123"`}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	downloader, cacheDir, jobDir := setupCache(t, true)
+	defer os.RemoveAll(cacheDir)
+	defer os.RemoveAll(jobDir)
+
+	// Tested code
+	errChans := []chan error{}
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		errChans = append(errChans, downloader.DownloadInputAsync(config.InputSource{FileName: filepath.Join(jobDir, name), URL: httpServer.URL}, http.Header{}))
+	}
+
+	// Asserts
+	for _, errChan := range errChans {
+		assert.Nil(t, <-errChan)
+	}
+	assert.Equal(t, 1, server.Gets())
+}
+
+func TestCachingDownloader_SizeMismatch(t *testing.T) {
+	// Setup
+	server := &cacheTestServer{ETag: `"abc123"`}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	downloader, cacheDir, jobDir := setupCache(t, true)
+	defer os.RemoveAll(cacheDir)
+	defer os.RemoveAll(jobDir)
+
+	// Tested code
+	errFirst := <-downloader.DownloadInputAsync(config.InputSource{FileName: filepath.Join(jobDir, "first.txt"), URL: httpServer.URL}, http.Header{})
+	errSecond := <-downloader.DownloadInputAsync(config.InputSource{FileName: filepath.Join(jobDir, "second.txt"), URL: httpServer.URL, Size: 10}, http.Header{})
+
+	// Asserts
+	assert.Nil(t, errFirst)
+	assert.Contains(t, errSecond.Error(), "input "+filepath.Join(jobDir, "second.txt")+" is 9 bytes, but 10 were expected")
+	assert.Equal(t, 2, server.Gets())
+}
+
+func TestCachingDownloader_Credentials(t *testing.T) {
+	// Setup
+	server := &cacheTestServer{ETag: `"abc123"`}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	downloader, cacheDir, jobDir := setupCache(t, true)
+	defer os.RemoveAll(cacheDir)
+	defer os.RemoveAll(jobDir)
+	credentials := []config.Credential{{Headers: map[string]string{"X-Api-Key": "tenant-a"}}}
+	otherCredentials := []config.Credential{{Headers: map[string]string{"X-Api-Key": "tenant-b"}}}
+
+	// Tested code
+	errs := []error{
+		<-downloader.DownloadInputAsync(config.InputSource{FileName: filepath.Join(jobDir, "a.txt"), URL: httpServer.URL, Credentials: credentials}, http.Header{}),
+		<-downloader.DownloadInputAsync(config.InputSource{FileName: filepath.Join(jobDir, "b.txt"), URL: httpServer.URL, Credentials: otherCredentials}, http.Header{}),
+		<-downloader.DownloadInputAsync(config.InputSource{FileName: filepath.Join(jobDir, "c.txt"), URL: httpServer.URL}, http.Header{"Authorization": []string{"tenant-c"}}),
+		<-downloader.DownloadInputAsync(config.InputSource{FileName: filepath.Join(jobDir, "d.txt"), URL: httpServer.URL, Credentials: credentials}, http.Header{}),
+	}
+
+	// Asserts: only the download with the same credentials as an earlier one is served from the cache
+	assert.Equal(t, []error{nil, nil, nil, nil}, errs)
+	assert.Equal(t, 3, server.Gets())
+}
+
+func TestCachingDownloader_ETagChanged(t *testing.T) {
+	// Setup: the file changes between the HEAD request and the download
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w.Header().Set("ETag", `"old"`)
+			return
+		}
+		w.Header().Set("ETag", `"new"`)
+		w.Write([]byte("test data"))
+	}))
+	defer httpServer.Close()
+	downloader, cacheDir, jobDir := setupCache(t, true)
+	defer os.RemoveAll(cacheDir)
+	defer os.RemoveAll(jobDir)
+	source := config.InputSource{FileName: filepath.Join(jobDir, "first.txt"), URL: httpServer.URL}
+
+	// Tested code
+	err := <-downloader.DownloadInputAsync(source, http.Header{})
+
+	// Asserts
+	assert.Nil(t, err)
+	assertExtractedFile(t, source.FileName, "test data")
+	entries, _ := filepath.Glob(filepath.Join(cacheDir, "*"+cacheEntrySuffix))
+	assert.Empty(t, entries)
+}
+
+func TestInputCache_Evict(t *testing.T) {
+	// Setup
+	downloader, cacheDir, jobDir := setupCache(t, true)
+	defer os.RemoveAll(cacheDir)
+	defer os.RemoveAll(jobDir)
+	cache := downloader.cache
+	cache.MaxBytes = 20 // Room for two copies of "test data"
+	now := time.Now()
+	for i, key := range []string{"oldest", "locked", "newest"} {
+		fileName := filepath.Join(jobDir, key)
+		ioutil.WriteFile(fileName, []byte("test data"), 0666)
+		_, err := cache.linkOrCopy(fileName, cache.path(key, cacheEntrySuffix))
+		assert.Nil(t, err)
+		modTime := now.Add(time.Duration(i-3) * time.Hour)
+		os.Chtimes(cache.path(key, cacheEntrySuffix), modTime, modTime)
+	}
+	lock, err := lockFile(cache.path("locked", cacheLockSuffix))
+	assert.Nil(t, err)
+
+	// Tested code
+	errLocked := cache.evict("newest")
+	lock.Unlock()
+	errUnlocked := cache.evict("newest")
+
+	// Asserts
+	assert.Nil(t, errLocked)
+	assert.Nil(t, errUnlocked)
+	_, err = os.Stat(cache.path("oldest", cacheEntrySuffix))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(cache.path("locked", cacheEntrySuffix))
+	assert.Nil(t, err)
+	_, err = os.Stat(cache.path("newest", cacheEntrySuffix))
+	assert.Nil(t, err)
+}
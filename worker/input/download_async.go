@@ -1,87 +1,461 @@
 package input
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
-	"time"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/venicegeo/pzsvc-exec/worker/config"
 )
 
-func getClientTimeout() time.Duration {
-	defaultTimeout := 180
-	if envTimeout := os.Getenv("HTTP_TIMEOUT"); envTimeout != "" {
-		defaultTimeout , _ = strconv.Atoi(envTimeout)
+func getEnvInt(name string, defaultValue int) int {
+	if envValue, err := strconv.Atoi(os.Getenv(name)); envValue >= 0 && err == nil {
+		return envValue
 	}
-	return (time.Duration(defaultTimeout) * time.Second)
+	return defaultValue
 }
 
-func getClientRetries() int {
-	defaultRetries := 1
-	if envRetries := os.Getenv("HTTP_RETRIES"); envRetries != "" {
-		defaultRetries , _ = strconv.Atoi(envRetries)
+// The client has no overall timeout, since a multi-GB download can rightly take a long
+// time; each attempt is instead cancelled if the transfer stalls for the idle timeout.
+var httpClient = http.Client{CheckRedirect: reapplyCredentials}
+
+// credentialsKey is the context key of the credentials a request may use
+type credentialsKey struct{}
+
+// withCredentials sets the headers of the credentials that were issued for the host of the
+// request, and keeps the credentials with the request so that redirects can do the same
+func withCredentials(req *http.Request, credentials []config.Credential) *http.Request {
+	if len(credentials) == 0 {
+		return req
 	}
-	return defaultRetries
+	req = req.WithContext(context.WithValue(req.Context(), credentialsKey{}, credentials))
+	applyCredentials(req, credentials)
+	return req
 }
 
-var httpClient = http.Client{
-	Timeout: getClientTimeout(),
+func applyCredentials(req *http.Request, credentials []config.Credential) {
+	for _, credential := range credentials {
+		for name := range credential.Headers {
+			req.Header.Del(name)
+		}
+	}
+	for _, credential := range credentials {
+		if credential.MatchesURL(req.URL) {
+			for name, value := range credential.Headers {
+				req.Header.Set(name, value)
+			}
+		}
+	}
+}
+
+// reapplyCredentials follows a redirect, sending only the credentials issued for the new
+// host, rather than all the headers of the first request
+func reapplyCredentials(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if credentials, ok := req.Context().Value(credentialsKey{}).([]config.Credential); ok {
+		applyCredentials(req, credentials)
+	}
+	return nil
 }
 
 type asyncDownloader interface {
-	DownloadInputAsync(source config.InputSource) chan error
+	DownloadInputAsync(source config.InputSource, header http.Header) chan error
+}
+
+// defaultAsyncDownloader downloads over HTTP, retrying failed attempts with exponential
+// backoff, and resuming from the end of the partially written file where the server allows.
+// For sources with RetryOn202, it polls while the server answers 202 Accepted to say that it
+// is still staging the file, for up to the StagingTimeout.
+// Inputs with other URL schemes are handed to the fetcher registered for the scheme.
+type defaultAsyncDownloader struct {
+	Retries     int                     // Number of retries after the first attempt
+	BackoffBase time.Duration           // Wait before the first retry, doubled for each one after
+	BackoffMax  time.Duration           // Longest wait between retries
+	IdleTimeout time.Duration           // Time an attempt may go without receiving data before it is abandoned
+	Sign        func(req *http.Request) // Adds credentials to each request, if set
+
+	StagingTimeout time.Duration // Longest time to poll a server that is staging a file
+}
+
+var defaultDownloader = defaultAsyncDownloader{
+	Retries:     getEnvInt("DOWNLOAD_RETRIES", 5),
+	BackoffBase: time.Duration(getEnvInt("DOWNLOAD_BACKOFF", 1)) * time.Second,
+	BackoffMax:  time.Duration(getEnvInt("DOWNLOAD_BACKOFF_MAX", 60)) * time.Second,
+	IdleTimeout: time.Duration(getEnvInt("DOWNLOAD_IDLE_TIMEOUT", 60)) * time.Second,
+
+	StagingTimeout: time.Duration(getEnvInt("DOWNLOAD_STAGING_TIMEOUT", 600)) * time.Second,
 }
 
-type defaultAsyncDownloader struct{
-	Retries int
+var asyncDownloaderInstance = withInputCache(defaultDownloader)
+
+// downloadError is the error of a single download attempt, and whether it is worth retrying
+type downloadError struct {
+	err        error
+	retryable  bool
+	retryAfter time.Duration // Wait the server asked for before retrying, if any
+	staging    bool          // The server accepted the request, but is still staging the file
+	location   string        // URL the server asked to be polled while staging, if any
+}
+
+func (e downloadError) Error() string {
+	return e.err.Error()
 }
 
-var asyncDownloaderInstance asyncDownloader = defaultAsyncDownloader{
-	Retries: getClientRetries(),
+// retryableStatus reports whether an HTTP status may be cleared up by trying again
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return status >= 500
 }
 
-func (dl defaultAsyncDownloader) DownloadInputAsync(source config.InputSource) chan error {
+// retryAfter reads the wait a response asks for before the next request, given either as
+// seconds or as a date, or 0 if it gives none
+func retryAfter(resp *http.Response) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+func (dl defaultAsyncDownloader) DownloadInputAsync(source config.InputSource, header http.Header) chan error {
 	errChan := make(chan error)
 
 	go func() {
-		var err error
-		var resp *http.Response
 		defer close(errChan)
-
-		targetFile, err := fileCheckerInstance.CheckAndOpen(source.FileName, 0777)
-		if err != nil {
+		if _, err := dl.downloadInput(source, header); err != nil {
 			errChan <- err
-			return
 		}
-		defer targetFile.Close()
+	}()
+
+	return errChan
+}
 
-		for i := 0; i <= dl.Retries; i++ {
-			resp, err = httpClient.Get(source.URL)
-			if err == nil && resp.StatusCode != http.StatusOK {
-				err = fmt.Errorf("unexpected status downloading input (%v)", resp.StatusCode)
+// downloadInput downloads and verifies a file, returning the checksums the server gave for it
+func (dl defaultAsyncDownloader) downloadInput(source config.InputSource, header http.Header) (serverChecksums, error) {
+	fetcher, err := dl.fetcherFor(source.URL)
+	if err != nil {
+		return serverChecksums{}, err
+	}
+	targetFile, err := fileCheckerInstance.CheckAndOpen(source.FileName, 0777)
+	if err != nil {
+		return serverChecksums{}, err
+	}
+	defer targetFile.Close()
+
+	server, err := fetcher.Fetch(source, header, targetFile)
+	if err != nil {
+		return server, err
+	}
+	return server, verifyDownload(source, targetFile, server)
+}
+
+// Fetch downloads a file over HTTP
+func (dl defaultAsyncDownloader) Fetch(source config.InputSource, header http.Header, targetFile *os.File) (serverChecksums, error) {
+	server := serverChecksums{}
+	err := dl.download(source, header, targetFile, &server)
+	return server, err
+}
+
+// sizeHeadTimeout is the longest a HEAD request for the size of a file may take.  Sizes are
+// asked for while a job is being dispatched, so an unresponsive server must not hold it up.
+var sizeHeadTimeout = 10 * time.Second
+
+// Size asks the server for the size of a file with a HEAD request
+func (dl defaultAsyncDownloader) Size(url string, header http.Header) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sizeHeadTimeout)
+	defer cancel()
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+	if dl.Sign != nil {
+		dl.Sign(req)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status getting size of input (%v)", resp.StatusCode)
+	}
+	if resp.ContentLength < 0 {
+		return 0, errors.New("server did not give the size of the input")
+	}
+	return resp.ContentLength, nil
+}
+
+// download fetches the source into the target file, retrying as configured, and records
+// the checksums the server reports.  Polls of a server that is staging the file are not
+// counted as retries.
+func (dl defaultAsyncDownloader) download(source config.InputSource, header http.Header, targetFile *os.File, server *serverChecksums) error {
+	var written int64
+	var stagingDeadline time.Time
+	url := source.URL
+	for attempt, polls := 0, 0; ; attempt++ {
+		var err error
+		written, err = dl.downloadAttempt(source, url, header, targetFile, written, server)
+		if err == nil {
+			return nil
+		}
+
+		dlErr, ok := err.(downloadError)
+		if ok && dlErr.staging {
+			if stagingDeadline.IsZero() {
+				stagingDeadline = time.Now().Add(dl.StagingTimeout)
+			}
+			remaining := time.Until(stagingDeadline)
+			if remaining <= 0 {
+				return fmt.Errorf("input was still being staged by the server after %v", dl.StagingTimeout)
+			}
+			if dlErr.location != "" {
+				url = dlErr.location
 			}
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to download URL %s on the %d attempt: %v. Timing out after %d retries.\n", source.URL, i+1, err, dl.Retries)
-				continue
+			delay := dlErr.retryAfter
+			if delay <= 0 {
+				delay = dl.backoffDelay(polls)
 			}
+			if delay > remaining {
+				delay = remaining
+			}
+			fmt.Fprintf(os.Stderr, "Input at URL %s is being staged by the server. Polling %s in %v.\n", source.URL, url, delay)
+			time.Sleep(delay)
+			attempt--
+			polls++
+			continue
 		}
-		if err != nil {
-			errChan <- err
-			return
+		if !ok || !dlErr.retryable || attempt >= dl.Retries {
+			return err
+		}
+		delay := dl.backoffDelay(attempt)
+		if dlErr.retryAfter > delay {
+			delay = dlErr.retryAfter
+			if dl.BackoffMax > 0 && delay > dl.BackoffMax {
+				// A server asking for an hour's wait should not hold the job up for that long
+				delay = dl.BackoffMax
+			}
 		}
+		fmt.Fprintf(os.Stderr, "Failed to download URL %s on attempt %d of %d, with %d bytes written: %v. Retrying in %v.\n",
+			source.URL, attempt+1, dl.Retries+1, written, err, delay)
+		time.Sleep(delay)
+	}
+}
 
-		defer resp.Body.Close()
+// backoffDelay returns how long to wait before the retry after the given attempt.
+// Delays are jittered so that many workers do not retry against a struggling host in lockstep.
+func (dl defaultAsyncDownloader) backoffDelay(attempt int) time.Duration {
+	if dl.BackoffBase <= 0 {
+		return 0
+	}
+	if attempt > 30 { // More doubling than this would overflow the duration
+		attempt = 30
+	}
+	delay := dl.BackoffBase << uint(attempt)
+	if dl.BackoffMax > 0 && (delay > dl.BackoffMax || delay <= 0) {
+		delay = dl.BackoffMax
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
 
-		_, err = io.Copy(targetFile, resp.Body)
+// downloadAttempt makes one request for the source at the URL, asking for only the bytes
+// after those already written.  It returns the number of bytes in the file when it stopped.
+func (dl defaultAsyncDownloader) downloadAttempt(source config.InputSource, url string, header http.Header, targetFile *os.File, written int64, server *serverChecksums) (int64, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watchdog := newIdleWatchdog(dl.IdleTimeout, cancel)
+	defer watchdog.Stop()
 
-		if err != nil {
-			errChan <- err
-			return
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return written, err
+	}
+	req = req.WithContext(ctx)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	// Byte ranges, sizes and checksums all refer to the file as stored, not a compressed encoding of it
+	req.Header.Set("Accept-Encoding", "identity")
+	if written > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", written))
+		if server.ETag != "" {
+			// If the file has changed since, the server sends all of the new version instead
+			req.Header.Set("If-Range", server.ETag)
 		}
-	}()
+	}
+	req = withCredentials(req, source.Credentials)
+	if dl.Sign != nil {
+		dl.Sign(req)
+	}
 
-	return errChan
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return written, downloadError{err: watchdog.Explain(err), retryable: true}
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && written > 0:
+		if start, _, ok := parseContentRange(resp.Header.Get("Content-Range")); !ok || start != written {
+			// Not the part we asked for; start over rather than corrupt the file
+			if err = restartFile(targetFile); err != nil {
+				return 0, err
+			}
+			return 0, downloadError{err: fmt.Errorf("server resumed download at the wrong offset (%s)", resp.Header.Get("Content-Range")), retryable: true}
+		}
+	case resp.StatusCode == http.StatusOK:
+		if written > 0 {
+			// The server ignored the range, and is sending the whole file again
+			if err = restartFile(targetFile); err != nil {
+				return 0, err
+			}
+			written = 0
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && written > 0:
+		if _, size, ok := parseContentRange(resp.Header.Get("Content-Range")); ok && size == written {
+			return written, nil // Everything had been written already
+		}
+		if err = restartFile(targetFile); err != nil {
+			return 0, err
+		}
+		return 0, downloadError{err: errors.New("server could not resume download"), retryable: true}
+	case resp.StatusCode == http.StatusAccepted && source.RetryOn202:
+		stagingErr := downloadError{err: errors.New("server is still staging the input (202)"), staging: true, retryAfter: retryAfter(resp)}
+		if location, err := resp.Request.URL.Parse(resp.Header.Get("Location")); err == nil && resp.Header.Get("Location") != "" {
+			stagingErr.location = location.String()
+		}
+		return written, stagingErr
+	default:
+		return written, downloadError{
+			err:        fmt.Errorf("unexpected status downloading input (%v)", resp.StatusCode),
+			retryable:  retryableStatus(resp.StatusCode),
+			retryAfter: retryAfter(resp),
+		}
+	}
+
+	server.update(resp)
+	copied, err := io.Copy(targetFile, downloadLimiter.Reader(watchdog.Reader(resp.Body)))
+	written += copied
+	if err != nil {
+		return written, downloadError{err: watchdog.Explain(err), retryable: true}
+	}
+	if resp.ContentLength >= 0 && copied < resp.ContentLength {
+		return written, downloadError{err: fmt.Errorf("download ended after %d of %d bytes", copied, resp.ContentLength), retryable: true}
+	}
+	return written, nil
+}
+
+// restartFile empties a partially written file, so that the download can start over
+func restartFile(targetFile *os.File) error {
+	if err := targetFile.Truncate(0); err != nil {
+		return err
+	}
+	_, err := targetFile.Seek(0, io.SeekStart)
+	return err
+}
+
+// parseContentRange reads the start offset and total size from a Content-Range header,
+// such as "bytes 100-199/1000", or "bytes */1000" for an unsatisfiable range.
+// The size is -1 if the server did not give it.
+func parseContentRange(contentRange string) (start int64, size int64, ok bool) {
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		return 0, 0, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(contentRange, "bytes "), "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+
+	size = -1
+	if parts[1] != "*" {
+		var err error
+		if size, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	if parts[0] == "*" {
+		return 0, size, true
+	}
+	bounds := strings.SplitN(parts[0], "-", 2)
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, size, true
+}
+
+// idleWatchdog cancels a download attempt once it has gone the timeout without receiving data
+type idleWatchdog struct {
+	timeout  time.Duration
+	timer    *time.Timer
+	fired    chan bool
+	fireOnce *sync.Once
+}
+
+func newIdleWatchdog(timeout time.Duration, cancel func()) *idleWatchdog {
+	w := &idleWatchdog{timeout: timeout, fired: make(chan bool), fireOnce: &sync.Once{}}
+	if timeout > 0 {
+		// A read racing the timer can restart it after it fires, so it may fire more than once
+		w.timer = time.AfterFunc(timeout, func() {
+			w.fireOnce.Do(func() { close(w.fired) })
+			cancel()
+		})
+	}
+	return w
+}
+
+// Reader wraps the body of the response, so that each read of data restarts the timeout
+func (w *idleWatchdog) Reader(body io.Reader) io.Reader {
+	return idleReader{body, w}
+}
+
+// Explain replaces the cancellation error of an attempt the watchdog abandoned with the reason for it
+func (w *idleWatchdog) Explain(err error) error {
+	select {
+	case <-w.fired:
+		return fmt.Errorf("no data received for %v", w.timeout)
+	default:
+		return err
+	}
+}
+
+func (w *idleWatchdog) Stop() {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+type idleReader struct {
+	body     io.Reader
+	watchdog *idleWatchdog
+}
+
+func (r idleReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 && r.watchdog.timer != nil {
+		r.watchdog.timer.Reset(r.watchdog.timeout)
+	}
+	return n, err
 }
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"testing"
 	"time"
@@ -65,7 +66,7 @@ func TestDefaultAsyncDownloader_OK(t *testing.T) {
 
 	// Tested code
 	downloader := defaultAsyncDownloader{}
-	errChan := downloader.DownloadInputAsync(inputSource)
+	errChan := downloader.DownloadInputAsync(inputSource, nil)
 
 	// Asserts
 	select {
@@ -99,8 +100,8 @@ func TestDefaultAsyncDownloader_HTTPError(t *testing.T) {
 	inputSource := config.InputSource{FileName: "file1.txt", URL: server.URL + "/notfound.txt"}
 
 	// Tested code
-	downloader := defaultAsyncDownloader{ Retries: 3 }
-	errChan := downloader.DownloadInputAsync(inputSource)
+	downloader := defaultAsyncDownloader{Retries: 3}
+	errChan := downloader.DownloadInputAsync(inputSource, nil)
 
 	// Asserts
 	select {
@@ -132,7 +133,7 @@ func TestDefaultAsyncDownloader_FileError(t *testing.T) {
 
 	// Tested code
 	downloader := defaultAsyncDownloader{}
-	errChan := downloader.DownloadInputAsync(inputSource)
+	errChan := downloader.DownloadInputAsync(inputSource, nil)
 
 	// Asserts
 	select {
@@ -149,3 +150,428 @@ func TestDefaultAsyncDownloader_FileError(t *testing.T) {
 	// Teardown
 	fileCheckerInstance = oldFileChecker
 }
+
+func TestDefaultAsyncDownloader_Header(t *testing.T) {
+	// Setup
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "test-auth" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("test data"))
+	}))
+	defer server.Close()
+
+	mockFileCheckerInstance := newMockFileChecker(nil)
+	defer os.Remove(mockFileCheckerInstance.tempFile.Name())
+	oldFileChecker := fileCheckerInstance
+	fileCheckerInstance = mockFileCheckerInstance
+
+	inputSource := config.InputSource{FileName: "file1.txt", URL: server.URL + "/file/test-data-id"}
+	header := http.Header{}
+	header.Set("Authorization", "test-auth")
+
+	// Tested code
+	downloader := defaultAsyncDownloader{}
+	errChan := downloader.DownloadInputAsync(inputSource, header)
+
+	// Asserts
+	select {
+	case err, ok := <-errChan:
+		if ok {
+			assert.Fail(t, "unexpected error from async download channel: "+err.Error())
+		}
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "failed to download from mock server for 1 second")
+	}
+
+	writtenFile, _ := os.Open(mockFileCheckerInstance.tempFile.Name())
+	writtenData, _ := ioutil.ReadAll(writtenFile)
+	assert.Equal(t, "test data", string(writtenData))
+
+	// Teardown
+	fileCheckerInstance = oldFileChecker
+}
+
+func TestDefaultAsyncDownloader_Credentials(t *testing.T) {
+	// Setup
+	var otherAuth, otherKey string
+	otherServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		otherAuth, otherKey = r.Header.Get("Authorization"), r.Header.Get("X-Api-Key")
+		w.Write([]byte("test data"))
+	}))
+	defer otherServer.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, r, otherServer.URL+"/signed/file1.txt", http.StatusFound)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	otherURL, _ := url.Parse(otherServer.URL)
+	inputSource := config.InputSource{
+		FileName: "file1.txt",
+		URL:      server.URL + "/file1.txt",
+		Credentials: []config.Credential{
+			{Hosts: []string{serverURL.Host}, HTTPHosts: []string{serverURL.Host}, Headers: map[string]string{"Authorization": "Bearer test-token"}},
+			{Hosts: []string{otherURL.Host}, HTTPHosts: []string{otherURL.Host}, Headers: map[string]string{"X-Api-Key": "test-key"}},
+		},
+	}
+
+	// Tested code
+	data, err := fetchToTempFile(t, defaultAsyncDownloader{}, inputSource)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, "test data", data)
+	assert.Empty(t, otherAuth)
+	assert.Equal(t, "test-key", otherKey)
+}
+
+// waitForDownload returns the result of an async download, failing the test if it takes too long
+func waitForDownload(t *testing.T, errChan chan error) error {
+	select {
+	case err := <-errChan:
+		return err
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "download did not finish within 5 seconds")
+		return nil
+	}
+}
+
+func TestDefaultAsyncDownloader_CredentialsNotDowngraded(t *testing.T) {
+	// Setup: an https server redirects to plain http on the same host
+	var plainAuth string
+	plainServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		plainAuth = r.Header.Get("Authorization")
+		w.Write([]byte("test data"))
+	}))
+	defer plainServer.Close()
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, r, plainServer.URL+"/file1.txt", http.StatusFound)
+	}))
+	defer tlsServer.Close()
+	oldTransport := httpClient.Transport
+	httpClient.Transport = tlsServer.Client().Transport
+	defer func() { httpClient.Transport = oldTransport }()
+	tlsURL, _ := url.Parse(tlsServer.URL)
+	inputSource := config.InputSource{
+		FileName:    "file1.txt",
+		URL:         tlsServer.URL + "/file1.txt",
+		Credentials: []config.Credential{{Hosts: []string{tlsURL.Hostname()}, Headers: map[string]string{"Authorization": "Bearer test-token"}}},
+	}
+
+	// Tested code
+	data, err := fetchToTempFile(t, defaultAsyncDownloader{}, inputSource)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, "test data", data)
+	assert.Empty(t, plainAuth)
+}
+
+func TestDefaultAsyncDownloader_RetriesServerError(t *testing.T) {
+	// Setup
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("test data"))
+	}))
+	defer server.Close()
+
+	mockFileCheckerInstance := newMockFileChecker(nil)
+	defer os.Remove(mockFileCheckerInstance.tempFile.Name())
+	oldFileChecker := fileCheckerInstance
+	fileCheckerInstance = mockFileCheckerInstance
+	defer func() { fileCheckerInstance = oldFileChecker }()
+
+	// Tested code
+	downloader := defaultAsyncDownloader{Retries: 3, BackoffBase: time.Millisecond}
+	err := waitForDownload(t, downloader.DownloadInputAsync(config.InputSource{FileName: "file1.txt", URL: server.URL}, nil))
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, 3, requests)
+	writtenData, _ := ioutil.ReadFile(mockFileCheckerInstance.tempFile.Name())
+	assert.Equal(t, "test data", string(writtenData))
+}
+
+func TestDefaultAsyncDownloader_RetryAfterCapped(t *testing.T) {
+	// Setup: the server asks for an hour's wait before the retry
+	requests := 0
+	var acceptEncoding []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		acceptEncoding = append(acceptEncoding, r.Header.Get("Accept-Encoding"))
+		if requests == 1 {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("test data"))
+	}))
+	defer server.Close()
+
+	mockFileCheckerInstance := newMockFileChecker(nil)
+	defer os.Remove(mockFileCheckerInstance.tempFile.Name())
+	oldFileChecker := fileCheckerInstance
+	fileCheckerInstance = mockFileCheckerInstance
+	defer func() { fileCheckerInstance = oldFileChecker }()
+
+	// Tested code
+	downloader := defaultAsyncDownloader{Retries: 1, BackoffBase: time.Millisecond, BackoffMax: 10 * time.Millisecond}
+	err := waitForDownload(t, downloader.DownloadInputAsync(config.InputSource{FileName: "file1.txt", URL: server.URL}, nil))
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, []string{"identity", "identity"}, acceptEncoding)
+}
+
+func TestDefaultAsyncDownloader_NoRetryOnFatalStatus(t *testing.T) {
+	// Setup
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	mockFileCheckerInstance := newMockFileChecker(nil)
+	defer os.Remove(mockFileCheckerInstance.tempFile.Name())
+	oldFileChecker := fileCheckerInstance
+	fileCheckerInstance = mockFileCheckerInstance
+	defer func() { fileCheckerInstance = oldFileChecker }()
+
+	// Tested code
+	downloader := defaultAsyncDownloader{Retries: 3}
+	err := waitForDownload(t, downloader.DownloadInputAsync(config.InputSource{FileName: "file1.txt", URL: server.URL}, nil))
+
+	// Asserts
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "403")
+	assert.Equal(t, 1, requests)
+}
+
+func TestDefaultAsyncDownloader_ResumesWithRange(t *testing.T) {
+	// Setup: the first response breaks off partway, and the second has to resume it
+	ranges := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if len(ranges) == 1 {
+			w.Header().Set("Content-Length", "9")
+			w.Write([]byte("test"))
+			return
+		}
+		w.Header().Set("Content-Range", "bytes 4-8/9")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(" data"))
+	}))
+	defer server.Close()
+
+	mockFileCheckerInstance := newMockFileChecker(nil)
+	defer os.Remove(mockFileCheckerInstance.tempFile.Name())
+	oldFileChecker := fileCheckerInstance
+	fileCheckerInstance = mockFileCheckerInstance
+	defer func() { fileCheckerInstance = oldFileChecker }()
+
+	// Tested code
+	downloader := defaultAsyncDownloader{Retries: 1}
+	err := waitForDownload(t, downloader.DownloadInputAsync(config.InputSource{FileName: "file1.txt", URL: server.URL}, nil))
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"", "bytes=4-"}, ranges)
+	writtenData, _ := ioutil.ReadFile(mockFileCheckerInstance.tempFile.Name())
+	assert.Equal(t, "test data", string(writtenData))
+}
+
+func TestDefaultAsyncDownloader_RangeIgnored(t *testing.T) {
+	// Setup: the server does not support ranges, so the retry sends the whole file again
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Length", "9")
+		if requests == 1 {
+			w.Write([]byte("test"))
+			return
+		}
+		w.Write([]byte("test data"))
+	}))
+	defer server.Close()
+
+	mockFileCheckerInstance := newMockFileChecker(nil)
+	defer os.Remove(mockFileCheckerInstance.tempFile.Name())
+	oldFileChecker := fileCheckerInstance
+	fileCheckerInstance = mockFileCheckerInstance
+	defer func() { fileCheckerInstance = oldFileChecker }()
+
+	// Tested code
+	downloader := defaultAsyncDownloader{Retries: 1}
+	err := waitForDownload(t, downloader.DownloadInputAsync(config.InputSource{FileName: "file1.txt", URL: server.URL}, nil))
+
+	// Asserts
+	assert.Nil(t, err)
+	writtenData, _ := ioutil.ReadFile(mockFileCheckerInstance.tempFile.Name())
+	assert.Equal(t, "test data", string(writtenData))
+}
+
+func TestDefaultAsyncDownloader_IdleTimeout(t *testing.T) {
+	// Setup: the first response stalls after some data, and the retry resumes it
+	release := make(chan bool)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Content-Length", "9")
+			w.Write([]byte("test"))
+			w.(http.Flusher).Flush()
+			<-release
+			return
+		}
+		w.Header().Set("Content-Range", "bytes 4-8/9")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(" data"))
+	}))
+	defer server.Close()
+	defer close(release) // before the server closes, which waits for the stalled handler
+
+	mockFileCheckerInstance := newMockFileChecker(nil)
+	defer os.Remove(mockFileCheckerInstance.tempFile.Name())
+	oldFileChecker := fileCheckerInstance
+	fileCheckerInstance = mockFileCheckerInstance
+	defer func() { fileCheckerInstance = oldFileChecker }()
+
+	// Tested code
+	downloader := defaultAsyncDownloader{Retries: 1, IdleTimeout: 100 * time.Millisecond}
+	err := waitForDownload(t, downloader.DownloadInputAsync(config.InputSource{FileName: "file1.txt", URL: server.URL}, nil))
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, 2, requests)
+	writtenData, _ := ioutil.ReadFile(mockFileCheckerInstance.tempFile.Name())
+	assert.Equal(t, "test data", string(writtenData))
+}
+
+func TestDefaultAsyncDownloader_BackoffDelay(t *testing.T) {
+	downloader := defaultAsyncDownloader{BackoffBase: time.Second, BackoffMax: 10 * time.Second}
+
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		delay := downloader.backoffDelay(attempt)
+		assert.True(t, delay >= max/2 && delay <= max, "attempt %d delay %v", attempt, delay)
+	}
+	delay := downloader.backoffDelay(100) // no overflow for many attempts
+	assert.True(t, delay >= 5*time.Second && delay <= 10*time.Second, "attempt 100 delay %v", delay)
+	assert.Equal(t, time.Duration(0), defaultAsyncDownloader{}.backoffDelay(3))
+}
+
+func TestDefaultAsyncDownloader_Size(t *testing.T) {
+	// Setup: one file has a size, and the server never answers for the other
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow.tif" {
+			<-release
+			return
+		}
+		w.Header().Set("Content-Length", "9")
+	}))
+	defer server.Close()
+	defer close(release)
+	oldTimeout := sizeHeadTimeout
+	sizeHeadTimeout = 50 * time.Millisecond
+	defer func() { sizeHeadTimeout = oldTimeout }()
+
+	// Tested code
+	downloader := defaultAsyncDownloader{}
+	size, err := downloader.Size(server.URL+"/in.tif", nil)
+	_, errSlow := downloader.Size(server.URL+"/slow.tif", nil)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, int64(9), size)
+	assert.NotNil(t, errSlow)
+}
+
+func TestParseContentRange(t *testing.T) {
+	start, size, ok := parseContentRange("bytes 100-199/1000")
+	assert.True(t, ok)
+	assert.Equal(t, int64(100), start)
+	assert.Equal(t, int64(1000), size)
+
+	start, size, ok = parseContentRange("bytes */1000")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1000), size)
+
+	_, size, ok = parseContentRange("bytes 0-99/*")
+	assert.True(t, ok)
+	assert.Equal(t, int64(-1), size)
+
+	_, _, ok = parseContentRange("items 0-99/100")
+	assert.False(t, ok)
+}
+
+func TestDefaultAsyncDownloader_Staging(t *testing.T) {
+	// Setup
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		if r.URL.Path == "/file1.txt" {
+			w.Header().Set("Location", "/staged/file1.txt")
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		if len(requests) < 4 {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Write([]byte("test data"))
+	}))
+	defer server.Close()
+	downloader := defaultAsyncDownloader{BackoffBase: time.Millisecond, StagingTimeout: 5 * time.Second}
+
+	// Tested code
+	data, err := fetchToTempFile(t, downloader, config.InputSource{FileName: "file1.txt", URL: server.URL + "/file1.txt", RetryOn202: true})
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, "test data", data)
+	assert.Equal(t, []string{"/file1.txt", "/staged/file1.txt", "/staged/file1.txt", "/staged/file1.txt"}, requests)
+}
+
+func TestDefaultAsyncDownloader_StagingTimeout(t *testing.T) {
+	// Setup
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	downloader := defaultAsyncDownloader{BackoffBase: 10 * time.Millisecond, StagingTimeout: 50 * time.Millisecond}
+
+	// Tested code
+	_, errStaging := fetchToTempFile(t, downloader, config.InputSource{FileName: "file1.txt", URL: server.URL, RetryOn202: true})
+	_, errNoRetry := fetchToTempFile(t, downloader, config.InputSource{FileName: "file1.txt", URL: server.URL})
+
+	// Asserts
+	assert.Contains(t, errStaging.Error(), "input was still being staged by the server after 50ms")
+	assert.Contains(t, errNoRetry.Error(), "unexpected status downloading input (202)")
+}
+
+func TestRetryAfter(t *testing.T) {
+	seconds := &http.Response{Header: http.Header{"Retry-After": []string{"120"}}}
+	date := &http.Response{Header: http.Header{"Retry-After": []string{time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}}}
+	past := &http.Response{Header: http.Header{"Retry-After": []string{"Mon, 02 Jan 2006 15:04:05 GMT"}}}
+
+	assert.Equal(t, 120*time.Second, retryAfter(seconds))
+	assert.True(t, retryAfter(date) > 59*time.Minute, "date delay %v", retryAfter(date))
+	assert.Equal(t, time.Duration(0), retryAfter(past))
+	assert.Equal(t, time.Duration(0), retryAfter(&http.Response{Header: http.Header{}}))
+}
@@ -0,0 +1,255 @@
+// Copyright 2018, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/venicegeo/pzsvc-exec/worker/config"
+	"github.com/venicegeo/pzsvc-exec/worker/log"
+)
+
+// extractLimits bound what extracting one archive may write, so that a decompression bomb
+// cannot fill the task's disk
+type extractLimits struct {
+	MaxBytes int64 // Most bytes the extracted files may hold in total
+	MaxRatio int64 // Most times larger than the archive the extracted files may be
+	MaxFiles int   // Most files and directories the archive may hold
+}
+
+var defaultExtractLimits = extractLimits{
+	MaxBytes: int64(getEnvInt("EXTRACT_MAX_MB", 10240)) << 20,
+	MaxRatio: int64(getEnvInt("EXTRACT_MAX_RATIO", 100)),
+	MaxFiles: getEnvInt("EXTRACT_MAX_FILES", 10000),
+}
+
+// extractInputs unpacks each input that asks for it into its ExtractTo directory
+func extractInputs(cfg config.WorkerConfig, inputs []config.InputSource) error {
+	for _, source := range inputs {
+		if source.ExtractTo == "" {
+			continue
+		}
+		archivePath, err := cfg.WorkPath(source.FileName)
+		if err != nil {
+			return err
+		}
+		targetDir, err := cfg.WorkPath(source.ExtractTo)
+		if err != nil {
+			return err
+		}
+		workerlog.Info(cfg, fmt.Sprintf("extracting input %s into %s", source.FileName, source.ExtractTo))
+		if err := extractArchive(archivePath, targetDir, defaultExtractLimits); err != nil {
+			return fmt.Errorf("error extracting input %s: %v", source.FileName, err)
+		}
+	}
+	return nil
+}
+
+// extractArchive unpacks a zip, tar, gzipped tar, or gzipped file into the target directory.
+// The format is found from the content of the file, rather than its name.
+func extractArchive(archivePath, targetDir string, limits extractLimits) error {
+	archiveFile, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer archiveFile.Close()
+	info, err := archiveFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	extractor := newLimitedExtractor(targetDir, info.Size(), limits)
+	if err = os.MkdirAll(targetDir, 0777); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(archiveFile)
+	magic, _ := reader.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		return extractor.extractZip(archiveFile, info.Size())
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		unzipper, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		defer unzipper.Close()
+		inner := bufio.NewReader(unzipper)
+		if isTar(inner) {
+			return extractor.extractTar(inner)
+		}
+		// A single gzipped file is extracted under its name without the .gz
+		name := strings.TrimSuffix(filepath.Base(archivePath), filepath.Ext(archivePath))
+		if unzipper.Name != "" {
+			name = unzipper.Name
+		}
+		return extractor.extractFile(name, 0666, inner)
+	case isTar(reader):
+		return extractor.extractTar(reader)
+	}
+	return errors.New("not a recognised archive; expected zip, tar, tar.gz or gz")
+}
+
+// isTar reports whether the buffered data starts with a tar header
+func isTar(reader *bufio.Reader) bool {
+	header, err := reader.Peek(262)
+	return err == nil && bytes.HasPrefix(header[257:], []byte("ustar"))
+}
+
+// limitedExtractor writes the entries of an archive into a directory, refusing any entry
+// that would land outside of it, and stopping once the limits are reached
+type limitedExtractor struct {
+	targetDir string
+	maxBytes  int64
+	maxFiles  int
+	written   int64
+	files     int
+}
+
+func newLimitedExtractor(targetDir string, archiveSize int64, limits extractLimits) *limitedExtractor {
+	maxBytes := limits.MaxBytes
+	if limits.MaxRatio > 0 && archiveSize*limits.MaxRatio < maxBytes {
+		maxBytes = archiveSize * limits.MaxRatio
+	}
+	return &limitedExtractor{targetDir: targetDir, maxBytes: maxBytes, maxFiles: limits.MaxFiles}
+}
+
+// entryPath returns where an archive entry is to be written, or an error if its name would
+// escape the target directory ("zip slip")
+func (e *limitedExtractor) entryPath(name string) (string, error) {
+	cleaned := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("archive entry %s would be written outside of the extraction directory", name)
+	}
+	return filepath.Join(e.targetDir, cleaned), nil
+}
+
+func (e *limitedExtractor) countFile() error {
+	e.files++
+	if e.maxFiles > 0 && e.files > e.maxFiles {
+		return fmt.Errorf("archive holds more than %d files", e.maxFiles)
+	}
+	return nil
+}
+
+func (e *limitedExtractor) extractDir(name string) error {
+	if err := e.countFile(); err != nil {
+		return err
+	}
+	path, err := e.entryPath(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(path, 0777)
+}
+
+// extractFile writes one file of the archive, counting its actual bytes against the limit
+// rather than trusting the size the archive declares
+func (e *limitedExtractor) extractFile(name string, mode os.FileMode, content io.Reader) error {
+	if err := e.countFile(); err != nil {
+		return err
+	}
+	path, err := e.entryPath(name)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	remaining := e.maxBytes - e.written
+	copied, err := io.Copy(file, io.LimitReader(content, remaining+1))
+	e.written += copied
+	if err != nil {
+		return err
+	}
+	if copied > remaining {
+		return fmt.Errorf("archive expands to more than %d bytes", e.maxBytes)
+	}
+	return nil
+}
+
+func (e *limitedExtractor) extractTar(reader io.Reader) error {
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = e.extractDir(header.Name)
+		case tar.TypeReg, tar.TypeRegA:
+			err = e.extractFile(header.Name, os.FileMode(header.Mode), tarReader)
+		case tar.TypeSymlink, tar.TypeLink:
+			err = fmt.Errorf("archive entry %s is a link, which is not extracted", header.Name)
+		default:
+			continue // Devices, FIFOs and extended headers have no content to extract
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (e *limitedExtractor) extractZip(archiveFile *os.File, size int64) error {
+	zipReader, err := zip.NewReader(archiveFile, size)
+	if err != nil {
+		return err
+	}
+	for _, entry := range zipReader.File {
+		mode := entry.Mode()
+		switch {
+		case mode.IsDir():
+			err = e.extractDir(entry.Name)
+		case mode&os.ModeSymlink != 0:
+			err = fmt.Errorf("archive entry %s is a link, which is not extracted", entry.Name)
+		default:
+			err = e.extractZipEntry(entry)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *limitedExtractor) extractZipEntry(entry *zip.File) error {
+	content, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	return e.extractFile(entry.Name, entry.Mode(), content)
+}
@@ -0,0 +1,227 @@
+package input
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/pzsvc-exec/worker/config"
+)
+
+var testExtractLimits = extractLimits{MaxBytes: 1 << 20, MaxRatio: 100, MaxFiles: 10}
+
+type testArchiveEntry struct {
+	name     string
+	body     string
+	linkname string // Makes the entry a symlink
+}
+
+func makeTestZip(t *testing.T, entries []testArchiveEntry) []byte {
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		header.SetMode(0644)
+		body := entry.body
+		if entry.linkname != "" {
+			header.SetMode(os.ModeSymlink | 0777)
+			body = entry.linkname
+		}
+		writer, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.Write([]byte(body))
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeTestTar(t *testing.T, entries []testArchiveEntry) []byte {
+	var buf bytes.Buffer
+	tarWriter := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.body)), Typeflag: tar.TypeReg}
+		if entry.linkname != "" {
+			header = &tar.Header{Name: entry.name, Mode: 0777, Linkname: entry.linkname, Typeflag: tar.TypeSymlink}
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		tarWriter.Write([]byte(entry.body))
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	gzipWriter.Write(data)
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// setupExtract writes the archive into a new directory, and returns the directory and archive path
+func setupExtract(t *testing.T, archiveName string, archive []byte) (string, string) {
+	dir, err := ioutil.TempDir("", "extract_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archivePath := filepath.Join(dir, archiveName)
+	if err = ioutil.WriteFile(archivePath, archive, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return dir, archivePath
+}
+
+func assertExtractedFile(t *testing.T, path string, expected string) {
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, string(content))
+}
+
+func TestExtractArchive_Formats(t *testing.T) {
+	// Setup
+	entries := []testArchiveEntry{{name: "a.txt", body: "file a"}, {name: "sub/b.txt", body: "file b"}}
+	archives := map[string][]byte{
+		"scene.zip":    makeTestZip(t, entries),
+		"scene.tar":    makeTestTar(t, entries),
+		"scene.tar.gz": gzipBytes(t, makeTestTar(t, entries)),
+		"scene.bin":    makeTestZip(t, entries), // The format is found from the content, not the name
+	}
+
+	for archiveName, archive := range archives {
+		dir, archivePath := setupExtract(t, archiveName, archive)
+
+		// Tested code
+		err := extractArchive(archivePath, filepath.Join(dir, "out"), testExtractLimits)
+
+		// Asserts
+		assert.Nil(t, err, archiveName)
+		assertExtractedFile(t, filepath.Join(dir, "out", "a.txt"), "file a")
+		assertExtractedFile(t, filepath.Join(dir, "out", "sub", "b.txt"), "file b")
+		os.RemoveAll(dir)
+	}
+}
+
+func TestExtractArchive_Gzip(t *testing.T) {
+	// Setup
+	dir, archivePath := setupExtract(t, "image.tif.gz", gzipBytes(t, []byte("image data")))
+	defer os.RemoveAll(dir)
+
+	// Tested code
+	err := extractArchive(archivePath, filepath.Join(dir, "out"), testExtractLimits)
+
+	// Asserts
+	assert.Nil(t, err)
+	assertExtractedFile(t, filepath.Join(dir, "out", "image.tif"), "image data")
+}
+
+func TestExtractArchive_NotAnArchive(t *testing.T) {
+	// Setup
+	dir, archivePath := setupExtract(t, "image.tif", []byte("image data"))
+	defer os.RemoveAll(dir)
+
+	// Tested code
+	err := extractArchive(archivePath, filepath.Join(dir, "out"), testExtractLimits)
+
+	// Asserts
+	assert.Contains(t, err.Error(), "not a recognised archive")
+}
+
+func TestExtractArchive_ZipSlip(t *testing.T) {
+	for _, name := range []string{"../escaped.txt", "sub/../../escaped.txt", "/escaped.txt"} {
+		// Setup
+		entries := []testArchiveEntry{{name: name, body: "escaped"}}
+		for archiveName, archive := range map[string][]byte{"slip.zip": makeTestZip(t, entries), "slip.tar": makeTestTar(t, entries)} {
+			dir, archivePath := setupExtract(t, archiveName, archive)
+
+			// Tested code
+			err := extractArchive(archivePath, filepath.Join(dir, "out"), testExtractLimits)
+
+			// Asserts
+			assert.Contains(t, err.Error(), "would be written outside of the extraction directory", archiveName)
+			_, statErr := os.Stat(filepath.Join(dir, "escaped.txt"))
+			assert.True(t, os.IsNotExist(statErr), archiveName)
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+func TestExtractArchive_Links(t *testing.T) {
+	// Setup
+	entries := []testArchiveEntry{{name: "passwd", linkname: "/etc/passwd"}}
+	for archiveName, archive := range map[string][]byte{"link.zip": makeTestZip(t, entries), "link.tar": makeTestTar(t, entries)} {
+		dir, archivePath := setupExtract(t, archiveName, archive)
+
+		// Tested code
+		err := extractArchive(archivePath, filepath.Join(dir, "out"), testExtractLimits)
+
+		// Asserts
+		assert.Contains(t, err.Error(), "archive entry passwd is a link", archiveName)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestExtractArchive_Bomb(t *testing.T) {
+	// Setup
+	zeros := strings.Repeat("\x00", 2<<20)
+	dir, archivePath := setupExtract(t, "bomb.gz", gzipBytes(t, []byte(zeros)))
+	defer os.RemoveAll(dir)
+
+	// Tested code
+	errBytes := extractArchive(archivePath, filepath.Join(dir, "bytes"), extractLimits{MaxBytes: 1 << 20})
+	errRatio := extractArchive(archivePath, filepath.Join(dir, "ratio"), extractLimits{MaxBytes: 1 << 30, MaxRatio: 10})
+
+	// Asserts
+	assert.Contains(t, errBytes.Error(), "archive expands to more than 1048576 bytes")
+	assert.Contains(t, errRatio.Error(), "archive expands to more than")
+}
+
+func TestExtractArchive_TooManyFiles(t *testing.T) {
+	// Setup
+	entries := []testArchiveEntry{}
+	for _, name := range []string{"a", "b", "c"} {
+		entries = append(entries, testArchiveEntry{name: name, body: name})
+	}
+	dir, archivePath := setupExtract(t, "many.zip", makeTestZip(t, entries))
+	defer os.RemoveAll(dir)
+
+	// Tested code
+	err := extractArchive(archivePath, filepath.Join(dir, "out"), extractLimits{MaxBytes: 1 << 20, MaxFiles: 2})
+
+	// Asserts
+	assert.Contains(t, err.Error(), "archive holds more than 2 files")
+}
+
+func TestExtractInputs(t *testing.T) {
+	// Setup
+	dir, _ := setupExtract(t, "scene.zip", makeTestZip(t, []testArchiveEntry{{name: "band1.tif", body: "band 1"}}))
+	defer os.RemoveAll(dir)
+	workerConfig := config.WorkerConfig{MuteLogs: true, WorkDir: dir}
+	inputs := []config.InputSource{
+		config.InputSource{FileName: "scene.zip", ExtractTo: "scene"},
+		config.InputSource{FileName: "other.tif"},
+	}
+
+	// Tested code
+	err := extractInputs(workerConfig, inputs)
+
+	// Asserts
+	assert.Nil(t, err)
+	assertExtractedFile(t, filepath.Join(dir, "scene", "band1.tif"), "band 1")
+}
@@ -16,6 +16,9 @@ package input
 
 import (
 	"fmt"
+	"net/http"
+	"os"
+	"time"
 
 	"github.com/venicegeo/pzsvc-exec/worker/config"
 	"github.com/venicegeo/pzsvc-exec/worker/log"
@@ -23,11 +26,42 @@ import (
 
 // FetchInputs recovers and writes input files, using the input source configuration
 func FetchInputs(cfg config.WorkerConfig, inputs []config.InputSource) error {
+	for _, source := range inputs {
+		if source.DataID != "" && !cfg.PzSEConfig.CanDownlPz {
+			return fmt.Errorf("input %s is Piazza data %s, but this service is not permitted to download from Piazza (CanDownlPz)", source.FileName, source.DataID)
+		}
+		if source.DataID == "" && !cfg.PzSEConfig.CanDownlExt {
+			return fmt.Errorf("input %s is external, but this service is not permitted to download external files (CanDownlExt)", source.FileName)
+		}
+		if _, err := cfg.WorkPath(source.FileName); err != nil {
+			return err
+		}
+	}
+
+	// Downloads beyond the limit wait for a slot, rather than all opening connections at once
+	slots := make(chan bool, maxParallelDownloads())
 	inputResults := []chan error{}
 	for _, source := range inputs {
-		errChan := asyncDownloaderInstance.DownloadInputAsync(source)
+		header := http.Header{}
+		if source.DataID != "" {
+			// Piazza data is downloaded from the Piazza file endpoint, using the job's Piazza credentials
+			source.URL = fmt.Sprintf("%s/file/%s", cfg.PiazzaBaseURL, source.DataID)
+			header.Set("Authorization", cfg.Session.PzAuth)
+		} else {
+			source.Credentials = cfg.CredentialsFor(source.FileName)
+			source.RetryOn202 = cfg.PzSEConfig.ExtRetryOn202
+		}
+		// Inputs are written into the job's working directory; their names were checked above
+		source.FileName, _ = cfg.WorkPath(source.FileName)
+		slots <- true
+		errChan := asyncDownloaderInstance.DownloadInputAsync(source, header)
 		workerlog.Info(cfg, fmt.Sprintf("async downloading input: %s; from: %s", source.FileName, source.URL))
-		inputResults = append(inputResults, errChan)
+		resultChan := make(chan error, 1)
+		go func(fileName string) {
+			resultChan <- watchDownload(cfg, fileName, errChan)
+			<-slots
+		}(source.FileName)
+		inputResults = append(inputResults, resultChan)
 	}
 
 	errors := []error{}
@@ -35,14 +69,65 @@ func FetchInputs(cfg config.WorkerConfig, inputs []config.InputSource) error {
 	for i, errChan := range inputResults {
 		err := <-errChan
 		if err != nil {
-			errors = append(errors, fmt.Errorf("error downloading source imagery;"))
-		} else {
-			workerlog.Info(cfg, fmt.Sprintf("downloaded input: %s", inputs[i].FileName))
+			errors = append(errors, fmt.Errorf("error downloading source imagery %s: %v;", inputs[i].FileName, err))
 		}
 	}
 
 	if len(errors) > 0 {
 		return fmt.Errorf("%v", errors)
 	}
-	return nil
+	return extractInputs(cfg, inputs)
+}
+
+// maxParallelDownloads returns how many inputs of a job may be downloaded at once
+func maxParallelDownloads() int {
+	if limit := getEnvInt("DOWNLOAD_CONCURRENCY", 4); limit > 0 {
+		return limit
+	}
+	return 1
+}
+
+// watchDownload waits for a download to finish, logging how much of the file has been
+// written, and how fast, every DOWNLOAD_PROGRESS_INTERVAL seconds until it does
+func watchDownload(cfg config.WorkerConfig, fileName string, errChan chan error) error {
+	interval := time.Duration(getEnvInt("DOWNLOAD_PROGRESS_INTERVAL", 10)) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	start := time.Now()
+	var lastSize int64
+
+	for {
+		select {
+		case err := <-errChan:
+			if err == nil {
+				size := fileSize(fileName)
+				elapsed := time.Since(start)
+				workerlog.Info(cfg, fmt.Sprintf("downloaded input: %s; %d bytes in %v (%s)", fileName, size, elapsed.Round(time.Millisecond), throughput(size, elapsed)))
+			}
+			return err
+		case <-ticker.C:
+			size := fileSize(fileName)
+			workerlog.Info(cfg, fmt.Sprintf("downloading input: %s; %d bytes so far (%s)", fileName, size, throughput(size-lastSize, interval)))
+			lastSize = size
+		}
+	}
+}
+
+// fileSize returns the bytes written to a file so far, or 0 if it does not exist yet
+func fileSize(fileName string) int64 {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func throughput(bytes int64, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return "- MB/s"
+	}
+	return fmt.Sprintf("%.2f MB/s", float64(bytes)/1000000/elapsed.Seconds())
 }
@@ -2,19 +2,25 @@ package input
 
 import (
 	"errors"
+	"net/http"
+	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/pzsvc-exec/pzsvc"
 	"github.com/venicegeo/pzsvc-exec/worker/config"
 )
 
 type mockAsyncDownloader struct {
 	ReturnErrors chan error
 	Calls        []config.InputSource
+	Headers      []http.Header
 }
 
 func newMockAsyncDownloader(errors []error) *mockAsyncDownloader {
-	dl := &mockAsyncDownloader{make(chan error), []config.InputSource{}}
+	dl := &mockAsyncDownloader{make(chan error), []config.InputSource{}, []http.Header{}}
 	go func() {
 		for _, err := range errors {
 			dl.ReturnErrors <- err
@@ -24,8 +30,9 @@ func newMockAsyncDownloader(errors []error) *mockAsyncDownloader {
 	return dl
 }
 
-func (dl *mockAsyncDownloader) DownloadInputAsync(source config.InputSource) chan error {
+func (dl *mockAsyncDownloader) DownloadInputAsync(source config.InputSource, header http.Header) chan error {
 	dl.Calls = append(dl.Calls, source)
+	dl.Headers = append(dl.Headers, header)
 	returnErrChan := make(chan error)
 	go func() {
 		defer close(returnErrChan)
@@ -43,7 +50,7 @@ func TestFetchInputs_NoErrors(t *testing.T) {
 	mockAsyncDownloader := newMockAsyncDownloader([]error{})
 	oldAsyncDownloaderInstance := asyncDownloaderInstance
 	asyncDownloaderInstance = mockAsyncDownloader
-	workerConfig := config.WorkerConfig{MuteLogs: true}
+	workerConfig := config.WorkerConfig{MuteLogs: true, PzSEConfig: pzsvc.Config{CanDownlExt: true}}
 	inputs := []config.InputSource{
 		config.InputSource{FileName: "text.txt", URL: "http://example.localdomain/foobar.txt"},
 		config.InputSource{FileName: "image.tif", URL: "https://example2.localdomain/foobar.tif"},
@@ -56,11 +63,7 @@ func TestFetchInputs_NoErrors(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Len(t, mockAsyncDownloader.Calls, len(inputs))
 	for _, input := range inputs {
-		foundInputInCalls := false
-		for _, call := range mockAsyncDownloader.Calls {
-			foundInputInCalls = foundInputInCalls || (call == input)
-		}
-		assert.True(t, foundInputInCalls)
+		assert.Contains(t, mockAsyncDownloader.Calls, input)
 	}
 
 	// Teardown
@@ -72,7 +75,7 @@ func TestFetchInputs_Errors(t *testing.T) {
 	mockAsyncDownloader := newMockAsyncDownloader([]error{nil, errors.New("test error text"), nil})
 	oldAsyncDownloaderInstance := asyncDownloaderInstance
 	asyncDownloaderInstance = mockAsyncDownloader
-	workerConfig := config.WorkerConfig{MuteLogs: true}
+	workerConfig := config.WorkerConfig{MuteLogs: true, PzSEConfig: pzsvc.Config{CanDownlExt: true}}
 	inputs := []config.InputSource{
 		config.InputSource{FileName: "text.txt", URL: "http://example.localdomain/foobar.txt"},
 		config.InputSource{FileName: "image.tif", URL: "https://example2.localdomain/foobar.tif"},
@@ -88,13 +91,225 @@ func TestFetchInputs_Errors(t *testing.T) {
 	assert.Len(t, mockAsyncDownloader.Calls, len(inputs))
 
 	for _, input := range inputs {
-		foundInputInCalls := false
-		for _, call := range mockAsyncDownloader.Calls {
-			foundInputInCalls = foundInputInCalls || (call == input)
-		}
-		assert.True(t, foundInputInCalls)
+		assert.Contains(t, mockAsyncDownloader.Calls, input)
+	}
+
+	// Teardown
+	asyncDownloaderInstance = oldAsyncDownloaderInstance
+}
+
+func TestFetchInputs_PiazzaData(t *testing.T) {
+	// Setup
+	mockAsyncDownloader := newMockAsyncDownloader([]error{})
+	oldAsyncDownloaderInstance := asyncDownloaderInstance
+	asyncDownloaderInstance = mockAsyncDownloader
+	workerConfig := config.WorkerConfig{
+		Session:       &pzsvc.Session{PzAuth: "test-auth"},
+		PiazzaBaseURL: "https://piazza.localdomain",
+		PzSEConfig:    pzsvc.Config{CanDownlPz: true},
+		MuteLogs:      true,
+	}
+	inputs := []config.InputSource{
+		config.InputSource{FileName: "image.tif", DataID: "test-data-id"},
+	}
+
+	// Tested code
+	err := FetchInputs(workerConfig, inputs)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Len(t, mockAsyncDownloader.Calls, 1)
+	assert.Equal(t, "https://piazza.localdomain/file/test-data-id", mockAsyncDownloader.Calls[0].URL)
+	assert.Equal(t, "test-auth", mockAsyncDownloader.Headers[0].Get("Authorization"))
+
+	// Teardown
+	asyncDownloaderInstance = oldAsyncDownloaderInstance
+}
+
+func TestFetchInputs_PiazzaDataNotPermitted(t *testing.T) {
+	// Setup
+	mockAsyncDownloader := newMockAsyncDownloader([]error{})
+	oldAsyncDownloaderInstance := asyncDownloaderInstance
+	asyncDownloaderInstance = mockAsyncDownloader
+	workerConfig := config.WorkerConfig{
+		Session:    &pzsvc.Session{PzAuth: "test-auth"},
+		PzSEConfig: pzsvc.Config{CanDownlPz: false, CanDownlExt: true},
+		MuteLogs:   true,
+	}
+	inputs := []config.InputSource{
+		config.InputSource{FileName: "text.txt", URL: "http://example.localdomain/foobar.txt"},
+		config.InputSource{FileName: "image.tif", DataID: "test-data-id"},
 	}
 
+	// Tested code
+	err := FetchInputs(workerConfig, inputs)
+
+	// Asserts
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "CanDownlPz")
+	assert.Empty(t, mockAsyncDownloader.Calls)
+
 	// Teardown
 	asyncDownloaderInstance = oldAsyncDownloaderInstance
 }
+
+func TestFetchInputs_WorkDir(t *testing.T) {
+	// Setup
+	mockAsyncDownloader := newMockAsyncDownloader([]error{})
+	oldAsyncDownloaderInstance := asyncDownloaderInstance
+	asyncDownloaderInstance = mockAsyncDownloader
+	defer func() { asyncDownloaderInstance = oldAsyncDownloaderInstance }()
+	workerConfig := config.WorkerConfig{MuteLogs: true, WorkDir: "/tmp/job-1", PzSEConfig: pzsvc.Config{CanDownlExt: true}}
+	inputs := []config.InputSource{
+		config.InputSource{FileName: "text.txt", URL: "http://example.localdomain/foobar.txt"},
+	}
+
+	// Tested code
+	err := FetchInputs(workerConfig, inputs)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Len(t, mockAsyncDownloader.Calls, 1)
+	assert.Equal(t, "/tmp/job-1/text.txt", mockAsyncDownloader.Calls[0].FileName)
+	assert.Equal(t, "text.txt", inputs[0].FileName)
+}
+
+func TestFetchInputs_ExternalNotPermitted(t *testing.T) {
+	// Setup
+	mockAsyncDownloader := newMockAsyncDownloader([]error{})
+	oldAsyncDownloaderInstance := asyncDownloaderInstance
+	asyncDownloaderInstance = mockAsyncDownloader
+	defer func() { asyncDownloaderInstance = oldAsyncDownloaderInstance }()
+	workerConfig := config.WorkerConfig{MuteLogs: true, PzSEConfig: pzsvc.Config{CanDownlExt: false}}
+	inputs := []config.InputSource{
+		config.InputSource{FileName: "text.txt", URL: "http://example.localdomain/foobar.txt"},
+	}
+
+	// Tested code
+	err := FetchInputs(workerConfig, inputs)
+
+	// Asserts
+	assert.Contains(t, err.Error(), "CanDownlExt")
+	assert.Empty(t, mockAsyncDownloader.Calls)
+}
+
+func TestFetchInputs_Credentials(t *testing.T) {
+	// Setup
+	mockAsyncDownloader := newMockAsyncDownloader([]error{})
+	oldAsyncDownloaderInstance := asyncDownloaderInstance
+	asyncDownloaderInstance = mockAsyncDownloader
+	defer func() { asyncDownloaderInstance = oldAsyncDownloaderInstance }()
+	all := config.Credential{Hosts: []string{"example.localdomain"}, Headers: map[string]string{"Authorization": "test-auth"}}
+	one := config.Credential{Hosts: []string{"example.localdomain"}, Input: "image.tif", Headers: map[string]string{"X-Api-Key": "test-key"}}
+	workerConfig := config.WorkerConfig{MuteLogs: true, PzSEConfig: pzsvc.Config{CanDownlExt: true}, Credentials: []config.Credential{all, one}}
+	inputs := []config.InputSource{
+		config.InputSource{FileName: "image.tif", URL: "http://example.localdomain/foobar.tif"},
+	}
+
+	// Tested code
+	err := FetchInputs(workerConfig, inputs)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Len(t, mockAsyncDownloader.Calls, 1)
+	assert.Equal(t, []config.Credential{all, one}, mockAsyncDownloader.Calls[0].Credentials)
+}
+
+func TestFetchInputs_RetryOn202(t *testing.T) {
+	// Setup
+	mockAsyncDownloader := newMockAsyncDownloader([]error{})
+	oldAsyncDownloaderInstance := asyncDownloaderInstance
+	asyncDownloaderInstance = mockAsyncDownloader
+	defer func() { asyncDownloaderInstance = oldAsyncDownloaderInstance }()
+	workerConfig := config.WorkerConfig{
+		Session:       &pzsvc.Session{PzAuth: "test-auth"},
+		PiazzaBaseURL: "https://piazza.localdomain",
+		PzSEConfig:    pzsvc.Config{CanDownlExt: true, CanDownlPz: true, ExtRetryOn202: true},
+		MuteLogs:      true,
+	}
+	inputs := []config.InputSource{
+		config.InputSource{FileName: "text.txt", URL: "http://example.localdomain/foobar.txt"},
+		config.InputSource{FileName: "image.tif", DataID: "test-data-id"},
+	}
+
+	// Tested code
+	err := FetchInputs(workerConfig, inputs)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Len(t, mockAsyncDownloader.Calls, 2)
+	for _, call := range mockAsyncDownloader.Calls {
+		assert.Equal(t, call.DataID == "", call.RetryOn202, call.FileName)
+	}
+}
+
+// slowAsyncDownloader takes a while over each download, recording how many run at once
+type slowAsyncDownloader struct {
+	mutex     sync.Mutex
+	active    int
+	maxActive int
+	calls     int
+}
+
+func (dl *slowAsyncDownloader) DownloadInputAsync(source config.InputSource, header http.Header) chan error {
+	dl.mutex.Lock()
+	dl.calls++
+	dl.active++
+	if dl.active > dl.maxActive {
+		dl.maxActive = dl.active
+	}
+	dl.mutex.Unlock()
+	errChan := make(chan error)
+	go func() {
+		defer close(errChan)
+		time.Sleep(20 * time.Millisecond)
+		dl.mutex.Lock()
+		dl.active--
+		dl.mutex.Unlock()
+	}()
+	return errChan
+}
+
+func TestFetchInputs_Concurrency(t *testing.T) {
+	// Setup
+	oldConcurrency := os.Getenv("DOWNLOAD_CONCURRENCY")
+	defer os.Setenv("DOWNLOAD_CONCURRENCY", oldConcurrency)
+	os.Setenv("DOWNLOAD_CONCURRENCY", "2")
+	downloader := &slowAsyncDownloader{}
+	oldAsyncDownloaderInstance := asyncDownloaderInstance
+	asyncDownloaderInstance = downloader
+	defer func() { asyncDownloaderInstance = oldAsyncDownloaderInstance }()
+	workerConfig := config.WorkerConfig{MuteLogs: true, PzSEConfig: pzsvc.Config{CanDownlExt: true}}
+	inputs := []config.InputSource{}
+	for _, name := range []string{"a.tif", "b.tif", "c.tif", "d.tif", "e.tif"} {
+		inputs = append(inputs, config.InputSource{FileName: name, URL: "http://example.localdomain/" + name})
+	}
+
+	// Tested code
+	err := FetchInputs(workerConfig, inputs)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, 5, downloader.calls)
+	assert.Equal(t, 2, downloader.maxActive)
+}
+
+func TestFetchInputs_EscapingFileName(t *testing.T) {
+	// Setup
+	mockAsyncDownloader := newMockAsyncDownloader([]error{})
+	oldAsyncDownloaderInstance := asyncDownloaderInstance
+	asyncDownloaderInstance = mockAsyncDownloader
+	defer func() { asyncDownloaderInstance = oldAsyncDownloaderInstance }()
+	workerConfig := config.WorkerConfig{MuteLogs: true, WorkDir: "/tmp/job-1", PzSEConfig: pzsvc.Config{CanDownlExt: true}}
+	inputs := []config.InputSource{
+		config.InputSource{FileName: "text.txt", URL: "http://example.localdomain/foobar.txt"},
+		config.InputSource{FileName: "../escaped.txt", URL: "http://example.localdomain/foobar.txt"},
+	}
+
+	// Tested code
+	err := FetchInputs(workerConfig, inputs)
+
+	// Asserts
+	assert.Contains(t, err.Error(), "must be relative to the working directory")
+	assert.Empty(t, mockAsyncDownloader.Calls)
+}
@@ -0,0 +1,338 @@
+// Copyright 2018, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/venicegeo/pzsvc-exec/worker/config"
+)
+
+// inputFetcher gets input files from the locations of one URL scheme
+type inputFetcher interface {
+	// Fetch writes the file at the source's URL into the target file, returning any checksums
+	// the server reported for it
+	Fetch(source config.InputSource, header http.Header, targetFile *os.File) (serverChecksums, error)
+	// Size returns the size in bytes of the file at a URL
+	Size(url string, header http.Header) (int64, error)
+}
+
+// inputFetchers holds the fetcher of each URL scheme inputs may use, other than HTTP(S),
+// which the downloader handles itself
+var inputFetchers = map[string]inputFetcher{
+	"file": fileFetcher{Roots: filepath.SplitList(os.Getenv("INPUT_FILE_ROOTS"))},
+	"data": dataFetcher{},
+	"s3":   newS3Fetcher(defaultDownloader),
+}
+
+// urlScheme returns the lower-cased scheme of a URL, or "" if it has none
+func urlScheme(rawURL string) string {
+	parts := strings.SplitN(rawURL, ":", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	return strings.ToLower(parts[0])
+}
+
+func (dl defaultAsyncDownloader) fetcherFor(rawURL string) (inputFetcher, error) {
+	scheme := urlScheme(rawURL)
+	if scheme == "http" || scheme == "https" {
+		return dl, nil
+	}
+	if fetcher, ok := inputFetchers[scheme]; ok {
+		return fetcher, nil
+	}
+	return nil, fmt.Errorf("unsupported input URL scheme %q", scheme)
+}
+
+// InputSize returns the size in bytes of the input file at a URL of any supported scheme
+func InputSize(rawURL string) (int64, error) {
+	fetcher, err := defaultDownloader.fetcherFor(rawURL)
+	if err != nil {
+		return 0, err
+	}
+	return fetcher.Size(rawURL, http.Header{})
+}
+
+// fileFetcher copies files from the local filesystem, such as from a mounted volume.  Only
+// files under one of its roots may be read, so that a job cannot read the Worker's own files.
+type fileFetcher struct {
+	Roots []string
+}
+
+// path returns the local path of a file URL, checking that it is under one of the roots
+func (f fileFetcher) path(rawURL string) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Host != "" && parsed.Host != "localhost" {
+		return "", fmt.Errorf("file URL %s is not on this host", rawURL)
+	}
+	path, err := filepath.EvalSymlinks(filepath.Clean(parsed.Path))
+	if err != nil {
+		return "", err
+	}
+	for _, root := range f.Roots {
+		if root == "" {
+			continue
+		}
+		if root, err = filepath.EvalSymlinks(filepath.Clean(root)); err != nil {
+			continue
+		}
+		if relative, err := filepath.Rel(root, path); err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("file URL %s is not under a directory in INPUT_FILE_ROOTS", rawURL)
+}
+
+func (f fileFetcher) Fetch(source config.InputSource, header http.Header, targetFile *os.File) (serverChecksums, error) {
+	path, err := f.path(source.URL)
+	if err != nil {
+		return serverChecksums{}, err
+	}
+	sourceFile, err := os.Open(path)
+	if err != nil {
+		return serverChecksums{}, err
+	}
+	defer sourceFile.Close()
+	_, err = io.Copy(targetFile, sourceFile)
+	return serverChecksums{}, err
+}
+
+func (f fileFetcher) Size(rawURL string, header http.Header) (int64, error) {
+	path, err := f.path(rawURL)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// dataFetcher writes out small files given inline as data: URIs, such as
+// "data:text/plain;base64,dGVzdCBkYXRh" or "data:,test%20data"
+type dataFetcher struct{}
+
+// maxDataURIBytes is the most data a data: URI may hold once decoded.  The URI travels in the
+// job spec, which is part of the task's command, so larger files belong at a URL.
+var maxDataURIBytes = getEnvInt("DATA_URI_MAX_BYTES", 65536)
+
+func (f dataFetcher) decode(rawURL string) ([]byte, error) {
+	parts := strings.SplitN(strings.SplitN(rawURL, ":", 2)[1], ",", 2)
+	if len(parts) < 2 {
+		return nil, errors.New("data URI has no comma before its data")
+	}
+	var data []byte
+	var err error
+	if strings.HasSuffix(strings.ToLower(parts[0]), ";base64") {
+		// Checked before decoding, so that an oversized URI is not decoded into memory
+		if base64.StdEncoding.DecodedLen(len(parts[1])) > maxDataURIBytes+2 {
+			return nil, fmt.Errorf("data URI holds more than the limit of %d bytes", maxDataURIBytes)
+		}
+		data, err = base64.StdEncoding.DecodeString(parts[1])
+	} else {
+		var unescaped string
+		unescaped, err = url.PathUnescape(parts[1])
+		data = []byte(unescaped)
+	}
+	if err == nil && len(data) > maxDataURIBytes {
+		return nil, fmt.Errorf("data URI holds more than the limit of %d bytes", maxDataURIBytes)
+	}
+	return data, err
+}
+
+// CheckDataURI checks that an input URL, if it is a data: URI, is well formed and within the
+// size limit.  URLs of other schemes are not checked.
+func CheckDataURI(rawURL string) error {
+	if urlScheme(rawURL) != "data" {
+		return nil
+	}
+	_, err := dataFetcher{}.decode(rawURL)
+	return err
+}
+
+func (f dataFetcher) Fetch(source config.InputSource, header http.Header, targetFile *os.File) (serverChecksums, error) {
+	data, err := f.decode(source.URL)
+	if err != nil {
+		return serverChecksums{}, err
+	}
+	_, err = targetFile.Write(data)
+	return serverChecksums{}, err
+}
+
+func (f dataFetcher) Size(rawURL string, header http.Header) (int64, error) {
+	data, err := f.decode(rawURL)
+	return int64(len(data)), err
+}
+
+// s3Fetcher downloads s3://bucket/key URLs from an S3-compatible service, with the retries and
+// resumption of HTTP downloads.  Requests are signed with AWS Signature Version 4 when
+// credentials are set, and are otherwise anonymous, as for public buckets.
+type s3Fetcher struct {
+	Endpoint        string // Base URL of the service; buckets are addressed as paths under it
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	downloader      defaultAsyncDownloader
+}
+
+func newS3Fetcher(downloader defaultAsyncDownloader) s3Fetcher {
+	f := s3Fetcher{
+		Endpoint:        strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/"),
+		Region:          os.Getenv("AWS_REGION"),
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		downloader:      downloader,
+	}
+	if f.Endpoint == "" {
+		f.Endpoint = "https://s3.amazonaws.com"
+	}
+	if f.Region == "" {
+		f.Region = "us-east-1"
+	}
+	return f
+}
+
+// httpDownloader returns the downloader with the fetcher's signing added
+func (f s3Fetcher) httpDownloader() defaultAsyncDownloader {
+	dl := f.downloader
+	dl.Sign = f.sign
+	return dl
+}
+
+// objectURL turns an s3://bucket/key URL into the URL of the object at the endpoint
+func (f s3Fetcher) objectURL(rawURL string) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Host == "" || strings.Trim(parsed.Path, "/") == "" {
+		return "", fmt.Errorf("S3 URL %s must be of the form s3://bucket/key", rawURL)
+	}
+	return f.Endpoint + awsURIEncode("/"+parsed.Host+parsed.Path), nil
+}
+
+func (f s3Fetcher) Fetch(source config.InputSource, header http.Header, targetFile *os.File) (serverChecksums, error) {
+	objectURL, err := f.objectURL(source.URL)
+	if err != nil {
+		return serverChecksums{}, err
+	}
+	// The service is reached with the fetcher's own credentials, not any issued with the job
+	source.URL = objectURL
+	source.Credentials = nil
+	return f.httpDownloader().Fetch(source, http.Header{}, targetFile)
+}
+
+func (f s3Fetcher) Size(rawURL string, header http.Header) (int64, error) {
+	objectURL, err := f.objectURL(rawURL)
+	if err != nil {
+		return 0, err
+	}
+	return f.httpDownloader().Size(objectURL, http.Header{})
+}
+
+// awsURIEncode escapes each segment of a path as AWS signatures expect, which is every byte
+// other than letters, digits, and "-._~"
+func awsURIEncode(path string) string {
+	var encoded bytes.Buffer
+	for _, b := range []byte(path) {
+		switch {
+		case b >= 'A' && b <= 'Z', b >= 'a' && b <= 'z', b >= '0' && b <= '9', strings.IndexByte("-._~/", b) >= 0:
+			encoded.WriteByte(b)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds an AWS Signature Version 4 to a GET or HEAD request, if the fetcher has credentials
+func (f s3Fetcher) sign(req *http.Request) {
+	f.signAt(req, time.Now().UTC())
+}
+
+func (f s3Fetcher) signAt(req *http.Request, now time.Time) {
+	if f.AccessKeyID == "" {
+		return
+	}
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	if f.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", f.SessionToken)
+	}
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if f.SessionToken != "" {
+		signedHeaders = append(signedHeaders, "x-amz-security-token")
+	}
+	sort.Strings(signedHeaders)
+	canonicalHeaders := ""
+	for _, name := range signedHeaders {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders += name + ":" + strings.TrimSpace(value) + "\n"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		strings.Join(signedHeaders, ";"),
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	requestDigest := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + f.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestDigest[:])
+
+	key := hmacSHA256([]byte("AWS4"+f.SecretAccessKey), date)
+	key = hmacSHA256(key, f.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		f.AccessKeyID, scope, strings.Join(signedHeaders, ";"), signature))
+}
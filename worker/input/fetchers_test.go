@@ -0,0 +1,180 @@
+package input
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/pzsvc-exec/worker/config"
+)
+
+// fetchToTempFile fetches the source with the downloader into a new file, and returns what was written
+func fetchToTempFile(t *testing.T, dl defaultAsyncDownloader, source config.InputSource) (string, error) {
+	mockFileCheckerInstance := newMockFileChecker(nil)
+	defer os.Remove(mockFileCheckerInstance.tempFile.Name())
+	oldFileChecker := fileCheckerInstance
+	fileCheckerInstance = mockFileCheckerInstance
+	defer func() { fileCheckerInstance = oldFileChecker }()
+
+	if err := waitForDownload(t, dl.DownloadInputAsync(source, http.Header{})); err != nil {
+		return "", err
+	}
+	written, _ := ioutil.ReadFile(mockFileCheckerInstance.tempFile.Name())
+	return string(written), nil
+}
+
+func TestDefaultAsyncDownloader_UnsupportedScheme(t *testing.T) {
+	// Tested code
+	_, err := fetchToTempFile(t, defaultAsyncDownloader{}, config.InputSource{FileName: "file1.txt", URL: "ftp://example.localdomain/file1.txt"})
+
+	// Asserts
+	assert.Contains(t, err.Error(), `unsupported input URL scheme "ftp"`)
+}
+
+func TestDataFetcher(t *testing.T) {
+	// Tested code
+	base64Data, errBase64 := fetchToTempFile(t, defaultAsyncDownloader{}, config.InputSource{FileName: "in.txt", URL: "data:text/plain;base64,dGVzdCBkYXRh"})
+	plainData, errPlain := fetchToTempFile(t, defaultAsyncDownloader{}, config.InputSource{FileName: "in.txt", URL: "DATA:,test%20data", Checksum: "sha256:" + testDataSHA256})
+	_, errNoComma := fetchToTempFile(t, defaultAsyncDownloader{}, config.InputSource{FileName: "in.txt", URL: "data:test data"})
+	size, errSize := InputSize("data:;base64,dGVzdCBkYXRh")
+
+	// Asserts
+	assert.Nil(t, errBase64)
+	assert.Equal(t, "test data", base64Data)
+	assert.Nil(t, errPlain)
+	assert.Equal(t, "test data", plainData)
+	assert.Contains(t, errNoComma.Error(), "data URI has no comma")
+	assert.Nil(t, errSize)
+	assert.Equal(t, int64(9), size)
+}
+
+func TestDataFetcher_TooLarge(t *testing.T) {
+	// Setup
+	oldMax := maxDataURIBytes
+	maxDataURIBytes = 8
+	defer func() { maxDataURIBytes = oldMax }()
+
+	// Tested code
+	_, errBase64 := fetchToTempFile(t, defaultAsyncDownloader{}, config.InputSource{FileName: "in.txt", URL: "data:;base64,dGVzdCBkYXRh"})
+	_, errPlain := fetchToTempFile(t, defaultAsyncDownloader{}, config.InputSource{FileName: "in.txt", URL: "data:,test%20data"})
+	smallData, errSmall := fetchToTempFile(t, defaultAsyncDownloader{}, config.InputSource{FileName: "in.txt", URL: "data:;base64,dGVzdA=="})
+
+	// Asserts
+	assert.Contains(t, errBase64.Error(), "data URI holds more than the limit of 8 bytes")
+	assert.Contains(t, errPlain.Error(), "data URI holds more than the limit of 8 bytes")
+	assert.Nil(t, errSmall)
+	assert.Equal(t, "test", smallData)
+	assert.NotNil(t, CheckDataURI("data:,test%20data"))
+	assert.Nil(t, CheckDataURI("https://example.localdomain/test%20data"))
+}
+
+func TestFileFetcher(t *testing.T) {
+	// Setup
+	root, _ := ioutil.TempDir("", "file_fetcher_root")
+	defer os.RemoveAll(root)
+	outside, _ := ioutil.TempDir("", "file_fetcher_outside")
+	defer os.RemoveAll(outside)
+	ioutil.WriteFile(filepath.Join(root, "in.txt"), []byte("test data"), 0666)
+	ioutil.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0666)
+	os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "link.txt"))
+	fetcher := fileFetcher{Roots: []string{root}}
+	targetFile, _ := ioutil.TempFile("", "file_fetcher_target")
+	defer os.Remove(targetFile.Name())
+	defer targetFile.Close()
+
+	// Tested code
+	_, errFetch := fetcher.Fetch(config.InputSource{URL: "file://" + filepath.Join(root, "in.txt")}, nil, targetFile)
+	size, errSize := fetcher.Size("file://"+filepath.Join(root, "in.txt"), nil)
+	_, errOutside := fetcher.Size("file://"+filepath.Join(outside, "secret.txt"), nil)
+	_, errDotDot := fetcher.Size("file://"+root+"/../"+filepath.Base(outside)+"/secret.txt", nil)
+	_, errLink := fetcher.Size("file://"+filepath.Join(root, "link.txt"), nil)
+	_, errNoRoots := fileFetcher{}.Size("file://"+filepath.Join(root, "in.txt"), nil)
+	_, errHost := fetcher.Size("file://otherhost"+filepath.Join(root, "in.txt"), nil)
+
+	// Asserts
+	assert.Nil(t, errFetch)
+	written, _ := ioutil.ReadFile(targetFile.Name())
+	assert.Equal(t, "test data", string(written))
+	assert.Nil(t, errSize)
+	assert.Equal(t, int64(9), size)
+	for _, err := range []error{errOutside, errDotDot, errLink, errNoRoots} {
+		assert.Contains(t, err.Error(), "is not under a directory in INPUT_FILE_ROOTS")
+	}
+	assert.Contains(t, errHost.Error(), "is not on this host")
+}
+
+func TestS3Fetcher(t *testing.T) {
+	// Setup
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		if r.URL.EscapedPath() != "/landsat/LC08/scene%201.tif" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("test data"))
+	}))
+	defer server.Close()
+	fetcher := s3Fetcher{Endpoint: server.URL, Region: "us-east-1", AccessKeyID: "testkey", SecretAccessKey: "testsecret"}
+	oldS3Fetcher := inputFetchers["s3"]
+	inputFetchers["s3"] = fetcher
+	defer func() { inputFetchers["s3"] = oldS3Fetcher }()
+
+	// Tested code
+	data, err := fetchToTempFile(t, defaultAsyncDownloader{}, config.InputSource{FileName: "scene.tif", URL: "s3://landsat/LC08/scene 1.tif"})
+	size, errSize := InputSize("s3://landsat/LC08/scene%201.tif")
+	_, errMissing := fetchToTempFile(t, defaultAsyncDownloader{}, config.InputSource{FileName: "scene.tif", URL: "s3://landsat/missing.tif"})
+	_, errNoKey := fetchToTempFile(t, defaultAsyncDownloader{}, config.InputSource{FileName: "scene.tif", URL: "s3://landsat"})
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, "test data", data)
+	assert.Nil(t, errSize)
+	assert.Equal(t, int64(9), size)
+	assert.Contains(t, errMissing.Error(), "unexpected status downloading input (404)")
+	assert.Contains(t, errNoKey.Error(), "must be of the form s3://bucket/key")
+	assert.Equal(t, "HEAD", requests[1].Method)
+	for _, r := range requests {
+		assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=testkey/"))
+	}
+}
+
+func TestS3Fetcher_Anonymous(t *testing.T) {
+	// Setup
+	fetcher := s3Fetcher{Endpoint: "https://s3.amazonaws.localdomain", Region: "us-east-1"}
+	req, _ := http.NewRequest("GET", "https://s3.amazonaws.localdomain/landsat/scene.tif", nil)
+
+	// Tested code
+	fetcher.sign(req)
+
+	// Asserts
+	assert.Empty(t, req.Header.Get("Authorization"))
+}
+
+func TestS3Fetcher_Signature(t *testing.T) {
+	// Setup
+	fetcher := s3Fetcher{Endpoint: "http://127.0.0.1:9000", Region: "us-east-1", AccessKeyID: "testkey", SecretAccessKey: "testsecret"}
+	objectURL, err := fetcher.objectURL("s3://landsat/LC08/scene 1.tif")
+	assert.Nil(t, err)
+	req, _ := http.NewRequest("GET", objectURL, nil)
+
+	// Tested code
+	fetcher.signAt(req, time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC))
+
+	// Asserts
+	assert.Equal(t, "http://127.0.0.1:9000/landsat/LC08/scene%201.tif", objectURL)
+	assert.Equal(t, "20180601T120000Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=testkey/20180601/us-east-1/s3/aws4_request, "+
+		"SignedHeaders=host;x-amz-content-sha256;x-amz-date, "+
+		"Signature=fd478ae9ac2f6abdc7098fd1cc1561f4c1185b4f157abeb13ec53e6cd9cdd331", req.Header.Get("Authorization"))
+}
+
+func TestAWSURIEncode(t *testing.T) {
+	assert.Equal(t, "/bucket/a%20b/c%2Bd~e_f.g-h", awsURIEncode("/bucket/a b/c+d~e_f.g-h"))
+}
@@ -11,7 +11,8 @@ type fileChecker interface {
 
 type defaultFileChecker struct{}
 
-// CheckAndOpen checks that a file of the given name does not already exist, then opens it for writing
+// CheckAndOpen checks that a file of the given name does not already exist, then opens it for
+// writing.  It is opened for reading too, so that the download can be verified afterward.
 func (dfc defaultFileChecker) CheckAndOpen(fileName string, fileMode os.FileMode) (*os.File, error) {
 	_, fStatErr := os.Stat(fileName)
 	if fStatErr == nil {
@@ -20,7 +21,7 @@ func (dfc defaultFileChecker) CheckAndOpen(fileName string, fileMode os.FileMode
 		return nil, fmt.Errorf("Error statting file: %v; %v", fileName, fStatErr)
 	}
 
-	return os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileMode)
+	return os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fileMode)
 }
 
 var fileCheckerInstance fileChecker = defaultFileChecker{}
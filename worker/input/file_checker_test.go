@@ -25,6 +25,9 @@ func TestDefaultFileChecker_OK(t *testing.T) {
 		return
 	}
 	assert.Equal(t, fileName, openedFile.Name())
+	openedFile.Write([]byte("test data"))
+	_, err = openedFile.ReadAt(make([]byte, 4), 0)
+	assert.Nil(t, err)
 
 	// Teardown
 	openedFile.Close()
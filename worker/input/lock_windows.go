@@ -0,0 +1,56 @@
+// Copyright 2018, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"os"
+	"time"
+)
+
+// fileLock is an exclusive lock on a file, held across processes.  Windows has no flock, so
+// the lock is the existence of the file itself, which a crashed holder can leave behind.
+type fileLock struct {
+	path string
+	file *os.File
+}
+
+// lockFile takes the lock on the named file, and waits until it is free
+func lockFile(path string) (*fileLock, error) {
+	for {
+		lock, err := tryLockFile(path)
+		if lock != nil || err != nil {
+			return lock, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// tryLockFile takes the lock on the named file if it is free, and otherwise returns nil
+func tryLockFile(path string) (*fileLock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &fileLock{path, file}, nil
+}
+
+// Unlock releases the lock by removing the file
+func (l *fileLock) Unlock() error {
+	l.file.Close()
+	return os.Remove(l.path)
+}
@@ -0,0 +1,79 @@
+// Copyright 2018, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// bandwidthLimiter caps the bytes per second read by all of the downloads sharing it, so that
+// the inputs of a job cannot saturate the task's network
+type bandwidthLimiter struct {
+	bytesPerSec int64
+	mutex       sync.Mutex
+	next        time.Time // Time the bytes already read are paid for
+}
+
+var downloadLimiter = newBandwidthLimiter(int64(getEnvInt("DOWNLOAD_MAX_BYTES_PER_SEC", 0)))
+
+// newBandwidthLimiter returns a limiter for the rate, or nil, which does not limit, if the rate is 0
+func newBandwidthLimiter(bytesPerSec int64) *bandwidthLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &bandwidthLimiter{bytesPerSec: bytesPerSec}
+}
+
+// Reader wraps a reader, so that reading from it counts against the limit
+func (l *bandwidthLimiter) Reader(reader io.Reader) io.Reader {
+	if l == nil {
+		return reader
+	}
+	return throttledReader{reader, l}
+}
+
+// wait blocks until the bytes just read fit within the limit, taking its turn after the
+// bytes that other readers have read before it
+func (l *bandwidthLimiter) wait(n int) {
+	l.mutex.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSec))
+	delay := l.next.Sub(now)
+	l.mutex.Unlock()
+	time.Sleep(delay)
+}
+
+type throttledReader struct {
+	reader  io.Reader
+	limiter *bandwidthLimiter
+}
+
+func (r throttledReader) Read(p []byte) (int, error) {
+	// Reading no more than a second's worth at a time keeps each wait short, so that reads
+	// stay frequent enough not to trip the idle timeout of a download
+	if int64(len(p)) > r.limiter.bytesPerSec {
+		p = p[:r.limiter.bytesPerSec]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.limiter.wait(n)
+	}
+	return n, err
+}
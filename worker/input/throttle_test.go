@@ -0,0 +1,43 @@
+package input
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBandwidthLimiter(t *testing.T) {
+	// Setup
+	limiter := newBandwidthLimiter(10000)
+	var wg sync.WaitGroup
+	start := time.Now()
+
+	// Tested code
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := ioutil.ReadAll(limiter.Reader(bytes.NewReader(make([]byte, 1500))))
+			assert.Nil(t, err)
+			assert.Len(t, data, 1500)
+		}()
+	}
+	wg.Wait()
+
+	// Asserts
+	// The two readers share the limit, so together they take 0.3 seconds rather than 0.15
+	assert.True(t, time.Since(start) >= 250*time.Millisecond, "elapsed %v", time.Since(start))
+}
+
+func TestBandwidthLimiter_Unlimited(t *testing.T) {
+	// Setup
+	reader := bytes.NewReader([]byte("test data"))
+
+	// Tested code & Asserts
+	assert.Nil(t, newBandwidthLimiter(0))
+	assert.Equal(t, reader, newBandwidthLimiter(0).Reader(reader))
+}
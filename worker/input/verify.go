@@ -0,0 +1,139 @@
+// Copyright 2018, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/venicegeo/pzsvc-exec/worker/config"
+)
+
+// verifyServerChecksums is whether downloads are checked against the MD5 digests servers report
+var verifyServerChecksums = getVerifyServerChecksums()
+
+func getVerifyServerChecksums() bool {
+	verify := true
+	if envVerify := os.Getenv("VERIFY_SERVER_CHECKSUMS"); envVerify != "" {
+		if parsed, err := strconv.ParseBool(envVerify); err == nil {
+			verify = parsed
+		}
+	}
+	return verify
+}
+
+// md5ETagPattern matches the ETags that are a plain MD5 digest of the file, as S3 gives for
+// files not uploaded in parts.  Other ETags, such as those of multipart uploads, are opaque.
+var md5ETagPattern = regexp.MustCompile(`^"?([0-9a-fA-F]{32})"?$`)
+
+// serverChecksums holds what the server reported about the file in its download responses
+type serverChecksums struct {
+	ETag       string // Strong ETag of the file, used to resume only the same version of it
+	ETagMD5    string // MD5 digest from the ETag, if it is one
+	ContentMD5 string // MD5 digest from the Content-MD5 header of a whole-file response
+}
+
+// update records the checksums of a download response.  A whole-file response replaces any
+// earlier ones, since the file may have changed; Content-MD5 is only meaningful for those.
+func (s *serverChecksums) update(resp *http.Response) {
+	etag := resp.Header.Get("ETag")
+	if strings.HasPrefix(etag, "W/") {
+		etag = "" // Weak ETags do not identify the bytes
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		*s = serverChecksums{}
+		if decoded, err := base64.StdEncoding.DecodeString(resp.Header.Get("Content-MD5")); err == nil && len(decoded) == md5.Size {
+			s.ContentMD5 = hex.EncodeToString(decoded)
+		}
+	}
+	if etag != "" {
+		s.ETag = etag
+		s.ETagMD5 = ""
+		if match := md5ETagPattern.FindStringSubmatch(etag); match != nil {
+			s.ETagMD5 = strings.ToLower(match[1])
+		}
+	}
+}
+
+// verifyDownload checks a downloaded file against the size and checksum of its input spec,
+// and against the MD5 digests the server reported, if any
+func verifyDownload(source config.InputSource, file *os.File, server serverChecksums) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if source.Size > 0 && info.Size() != source.Size {
+		return fmt.Errorf("input %s is %d bytes, but %d were expected", source.FileName, info.Size(), source.Size)
+	}
+
+	type expectedDigest struct {
+		algorithm, digest, from string
+	}
+	expected := []expectedDigest{}
+	if source.Checksum != "" {
+		algorithm, digest, err := config.ParseChecksum(source.Checksum)
+		if err != nil {
+			return err
+		}
+		expected = append(expected, expectedDigest{algorithm, digest, "the job's checksum"})
+	}
+	if verifyServerChecksums && server.ContentMD5 != "" {
+		expected = append(expected, expectedDigest{"md5", server.ContentMD5, "the server's Content-MD5"})
+	}
+	if verifyServerChecksums && server.ETagMD5 != "" {
+		expected = append(expected, expectedDigest{"md5", server.ETagMD5, "the server's ETag"})
+	}
+	if len(expected) == 0 {
+		return nil
+	}
+
+	// Hash the file once, with each algorithm needed
+	hashes := map[string]hash.Hash{}
+	writers := []io.Writer{}
+	for _, exp := range expected {
+		if _, ok := hashes[exp.algorithm]; !ok {
+			if exp.algorithm == "sha256" {
+				hashes[exp.algorithm] = sha256.New()
+			} else {
+				hashes[exp.algorithm] = md5.New()
+			}
+			writers = append(writers, hashes[exp.algorithm])
+		}
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err = io.Copy(io.MultiWriter(writers...), file); err != nil {
+		return err
+	}
+
+	for _, exp := range expected {
+		if actual := hex.EncodeToString(hashes[exp.algorithm].Sum(nil)); actual != exp.digest {
+			return fmt.Errorf("input %s does not match %s: its %s is %s, but %s was expected", source.FileName, exp.from, exp.algorithm, actual, exp.digest)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package input
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/pzsvc-exec/worker/config"
+)
+
+// "test data" digests
+const (
+	testDataSHA256    = "916f0027a575074ce72a331777c3478d6513f786a591bd892da1a577bf2335f9"
+	testDataMD5       = "eb733a00c0c9d336e65691a37ab54293"
+	testDataMD5Base64 = "63M6AMDJ0zbmVpGjerVCkw=="
+)
+
+func writeTestDataFile(t *testing.T) *os.File {
+	file, err := ioutil.TempFile("", "verify_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("test data"))
+	return file
+}
+
+func TestVerifyDownload(t *testing.T) {
+	// Setup
+	file := writeTestDataFile(t)
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	// Tested code / Asserts
+	assert.Nil(t, verifyDownload(config.InputSource{FileName: "in.txt"}, file, serverChecksums{}))
+	assert.Nil(t, verifyDownload(config.InputSource{FileName: "in.txt", Size: 9, Checksum: "sha256:" + testDataSHA256}, file, serverChecksums{}))
+	assert.Nil(t, verifyDownload(config.InputSource{FileName: "in.txt", Checksum: "MD5:" + testDataMD5}, file, serverChecksums{ETagMD5: testDataMD5, ContentMD5: testDataMD5}))
+
+	err := verifyDownload(config.InputSource{FileName: "in.txt", Size: 10}, file, serverChecksums{})
+	assert.Contains(t, err.Error(), "input in.txt is 9 bytes, but 10 were expected")
+
+	err = verifyDownload(config.InputSource{FileName: "in.txt", Checksum: "sha256:" + testDataSHA256[1:] + "0"}, file, serverChecksums{})
+	assert.Contains(t, err.Error(), "input in.txt does not match the job's checksum")
+
+	err = verifyDownload(config.InputSource{FileName: "in.txt"}, file, serverChecksums{ETagMD5: "00000000000000000000000000000000"})
+	assert.Contains(t, err.Error(), "does not match the server's ETag")
+
+	err = verifyDownload(config.InputSource{FileName: "in.txt"}, file, serverChecksums{ContentMD5: "00000000000000000000000000000000"})
+	assert.Contains(t, err.Error(), "does not match the server's Content-MD5")
+}
+
+func TestVerifyDownload_ServerChecksumsDisabled(t *testing.T) {
+	// Setup
+	file := writeTestDataFile(t)
+	defer os.Remove(file.Name())
+	defer file.Close()
+	oldVerify := verifyServerChecksums
+	verifyServerChecksums = false
+	defer func() { verifyServerChecksums = oldVerify }()
+
+	// Tested code / Asserts
+	assert.Nil(t, verifyDownload(config.InputSource{FileName: "in.txt"}, file, serverChecksums{ETagMD5: "00000000000000000000000000000000"}))
+}
+
+func TestServerChecksums_Update(t *testing.T) {
+	newResponse := func(status int, headers map[string]string) *http.Response {
+		resp := &http.Response{StatusCode: status, Header: http.Header{}}
+		for key, value := range headers {
+			resp.Header.Set(key, value)
+		}
+		return resp
+	}
+
+	checksums := serverChecksums{}
+	checksums.update(newResponse(http.StatusOK, map[string]string{"ETag": `"` + testDataMD5 + `"`, "Content-MD5": testDataMD5Base64}))
+	assert.Equal(t, serverChecksums{ETag: `"` + testDataMD5 + `"`, ETagMD5: testDataMD5, ContentMD5: testDataMD5}, checksums)
+
+	// a part keeps the whole file's Content-MD5
+	checksums.update(newResponse(http.StatusPartialContent, map[string]string{"Content-MD5": "AAAAAAAAAAAAAAAAAAAAAA=="}))
+	assert.Equal(t, testDataMD5, checksums.ContentMD5)
+
+	// multipart and weak ETags are not digests
+	checksums = serverChecksums{}
+	checksums.update(newResponse(http.StatusOK, map[string]string{"ETag": `"` + testDataMD5 + `-3"`}))
+	assert.Equal(t, "", checksums.ETagMD5)
+	checksums = serverChecksums{}
+	checksums.update(newResponse(http.StatusOK, map[string]string{"ETag": `W/"` + testDataMD5 + `"`}))
+	assert.Equal(t, serverChecksums{}, checksums)
+}
+
+func TestDefaultAsyncDownloader_ChecksumMismatch(t *testing.T) {
+	// Setup
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"00000000000000000000000000000000"`)
+		w.Write([]byte("test data"))
+	}))
+	defer server.Close()
+
+	mockFileCheckerInstance := newMockFileChecker(nil)
+	defer os.Remove(mockFileCheckerInstance.tempFile.Name())
+	oldFileChecker := fileCheckerInstance
+	fileCheckerInstance = mockFileCheckerInstance
+	defer func() { fileCheckerInstance = oldFileChecker }()
+
+	// Tested code
+	downloader := defaultAsyncDownloader{}
+	err := waitForDownload(t, downloader.DownloadInputAsync(config.InputSource{FileName: "file1.txt", URL: server.URL}, nil))
+
+	// Asserts
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "input file1.txt does not match the server's ETag")
+}
+
+func TestDefaultAsyncDownloader_ResumeSendsIfRange(t *testing.T) {
+	// Setup
+	ifRanges := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifRanges = append(ifRanges, r.Header.Get("If-Range"))
+		w.Header().Set("ETag", `"`+testDataMD5+`"`)
+		if len(ifRanges) == 1 {
+			w.Header().Set("Content-Length", "9")
+			w.Write([]byte("test"))
+			return
+		}
+		w.Header().Set("Content-Range", "bytes 4-8/9")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(" data"))
+	}))
+	defer server.Close()
+
+	mockFileCheckerInstance := newMockFileChecker(nil)
+	defer os.Remove(mockFileCheckerInstance.tempFile.Name())
+	oldFileChecker := fileCheckerInstance
+	fileCheckerInstance = mockFileCheckerInstance
+	defer func() { fileCheckerInstance = oldFileChecker }()
+
+	// Tested code
+	downloader := defaultAsyncDownloader{Retries: 1}
+	err := waitForDownload(t, downloader.DownloadInputAsync(config.InputSource{FileName: "file1.txt", URL: server.URL, Checksum: "sha256:" + testDataSHA256}, nil))
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"", `"` + testDataMD5 + `"`}, ifRanges)
+}
+
+func TestDefaultAsyncDownloader_VerifiesWithDefaultFileChecker(t *testing.T) {
+	// Setup: the file is opened by the real file checker, which must leave it readable for verification
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"`+testDataMD5+`"`)
+		w.Write([]byte("test data"))
+	}))
+	defer server.Close()
+
+	tempDir, _ := ioutil.TempDir("", "verify_test")
+	defer os.RemoveAll(tempDir)
+
+	// Tested code
+	downloader := defaultAsyncDownloader{}
+	err := waitForDownload(t, downloader.DownloadInputAsync(config.InputSource{FileName: filepath.Join(tempDir, "good.txt"), URL: server.URL, Size: 9, Checksum: "sha256:" + testDataSHA256}, nil))
+	mismatchErr := waitForDownload(t, downloader.DownloadInputAsync(config.InputSource{FileName: filepath.Join(tempDir, "bad.txt"), URL: server.URL, Checksum: "md5:00000000000000000000000000000000"}, nil))
+
+	// Asserts
+	assert.Nil(t, err)
+	writtenData, _ := ioutil.ReadFile(filepath.Join(tempDir, "good.txt"))
+	assert.Equal(t, "test data", string(writtenData))
+	assert.NotNil(t, mismatchErr)
+	assert.Contains(t, mismatchErr.Error(), "does not match")
+}
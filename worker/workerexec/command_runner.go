@@ -15,44 +15,133 @@
 package workerexec
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
 	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/venicegeo/pzsvc-exec/worker/config"
 	"github.com/venicegeo/pzsvc-exec/worker/log"
 )
 
+// errCommandTimedOut is returned by the exec function of a commandRunner when the command overran its timeout
+var errCommandTimedOut = errors.New("command timed out")
+
+// killGracePeriod is how long a timed out command has to exit after SIGTERM, before it is sent SIGKILL
+var killGracePeriod = getKillGracePeriod()
+
+func getKillGracePeriod() time.Duration {
+	gracePeriod := 10
+	if envGracePeriod, err := strconv.Atoi(os.Getenv("KILL_GRACE_PERIOD")); envGracePeriod > 0 && err == nil {
+		gracePeriod = envGracePeriod
+	}
+	return time.Duration(gracePeriod) * time.Second
+}
+
 type commandOutput struct {
-	Stdout []byte
-	Stderr []byte
-	Error  error
+	Stdout   []byte
+	Stderr   []byte
+	Error    error
+	TimedOut bool
+}
+
+// failureStatus returns the HTTP status to report for the failed command
+func (o commandOutput) failureStatus() int {
+	if o.TimedOut {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
 }
 
 type commandRunner struct {
-	exec func(cmdName string, args ...string) ([]byte, error)
+	exec func(timeout time.Duration, dir string, stdout, stderr io.Writer, cmdName string, args ...string) error
 }
 
 func newCommandRunner() *commandRunner {
 	return &commandRunner{
-		exec: func(cmdName string, args ...string) ([]byte, error) {
-			return exec.Command(cmdName, args...).Output()
-		},
+		exec: execWithTimeout,
 	}
 }
 
-func (dcr commandRunner) Run(cfg config.WorkerConfig, command string) (out commandOutput) {
-	var err error
-	workerlog.Info(cfg, "runCommand: "+command)
+// execWithTimeout runs a command in its own process group in the given directory (the
+// current one if empty), streaming its output to the given writers.  If a timeout is given and passes, the whole group is sent SIGTERM, and then
+// SIGKILL if it has not exited after the grace period, so that no child process outlives it.
+// The group is stopped in the same way if the worker itself is told to stop.
+func execWithTimeout(timeout time.Duration, dir string, stdout, stderr io.Writer, cmdName string, args ...string) error {
+	if !runningCommands.begin() {
+		return errCommandTerminated
+	}
+	defer runningCommands.end()
+
+	cmd := exec.Command(cmdName, args...)
+	cmd.Dir = dir
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
 
-	out.Stdout, out.Error = dcr.exec("sh", "-c", command)
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+	stopErr := errCommandTimedOut
+	select {
+	case err := <-done:
+		return err
+	case <-deadline:
+	case <-runningCommands.stop:
+		stopErr = errCommandTerminated
+	}
 
-	if out.Error != nil {
-		if exitErr, ok := out.Error.(*exec.ExitError); ok {
-			workerlog.SimpleErr(cfg, "failed executing algorithm command; stderr below", exitErr)
-			workerlog.Alert(cfg, string(exitErr.Stderr))
-			out.Stderr = exitErr.Stderr
-		} else {
-			workerlog.SimpleErr(cfg, "failed executing algorithm command; stderr not available", err)
+	signalProcessGroup(cmd, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(killGracePeriod):
+		signalProcessGroup(cmd, syscall.SIGKILL)
+		<-done
+	}
+	return stopErr
+}
+
+// Run runs the command in a shell, in the job's working directory.  If onStdoutLine is given, it is called with each line of stdout as it arrives.
+func (dcr commandRunner) Run(cfg config.WorkerConfig, command string, onStdoutLine func(string)) (out commandOutput) {
+	workerlog.Info(cfg, "runCommand: "+command)
+
+	// Output is logged line by line as it arrives; only the start and end of it are kept for the result
+	stdout := newCappedBuffer(outputHeadLimit, outputTailLimit)
+	stderr := newCappedBuffer(outputHeadLimit, outputTailLimit)
+	stdoutLog := newLineWriter(func(line string) {
+		workerlog.Info(cfg, "stdout: "+line)
+		if onStdoutLine != nil {
+			onStdoutLine(line)
 		}
+	})
+	stderrLog := newLineWriter(func(line string) { workerlog.Warn(cfg, "stderr: "+line) })
+
+	// MaxRunTime bounds each command, so that a hung algorithm cannot hold its task forever
+	timeout := time.Duration(cfg.PzSEConfig.MaxRunTime) * time.Second
+	out.Error = dcr.exec(timeout, cfg.WorkDir, io.MultiWriter(stdout, stdoutLog), io.MultiWriter(stderr, stderrLog), "sh", "-c", command)
+	stdoutLog.Flush()
+	stderrLog.Flush()
+	out.Stdout = stdout.Bytes()
+	out.Stderr = stderr.Bytes()
+
+	if out.Error == errCommandTimedOut {
+		out.TimedOut = true
+		out.Error = fmt.Errorf("command timed out after the MaxRunTime of %v and was killed", timeout)
+		workerlog.SimpleErr(cfg, "algorithm command timed out", out.Error)
+	} else if out.Error != nil {
+		workerlog.SimpleErr(cfg, "failed executing algorithm command", out.Error)
 	} else {
 		workerlog.Info(cfg, "runCommandOutput success")
 	}
@@ -1,9 +1,16 @@
 package workerexec
 
 import (
+	"bytes"
 	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/venicegeo/pzsvc-exec/pzsvc"
@@ -13,17 +20,18 @@ import (
 func TestDefaultCommandRunner_Success(t *testing.T) {
 	// Setup
 	execCalls := [][]string{}
-	exec := func(cmdName string, args ...string) ([]byte, error) {
+	exec := func(timeout time.Duration, dir string, stdout, stderr io.Writer, cmdName string, args ...string) error {
 		call := append([]string{cmdName}, args...)
 		execCalls = append(execCalls, call)
-		return []byte("ok"), nil
+		stdout.Write([]byte("ok"))
+		return nil
 	}
 	workerConfig := config.WorkerConfig{MuteLogs: true, Session: &pzsvc.Session{}}
 
 	// Tested code
 	runner := newCommandRunner()
 	runner.exec = exec
-	output := runner.Run(workerConfig, "test command")
+	output := runner.Run(workerConfig, "test command", nil)
 
 	// Asserts
 	assert.Equal(t, []byte("ok"), output.Stdout)
@@ -36,17 +44,19 @@ func TestDefaultCommandRunner_Success(t *testing.T) {
 func TestDefaultCommandRunner_ExitError(t *testing.T) {
 	// Setup
 	execCalls := [][]string{}
-	exec := func(cmdName string, args ...string) ([]byte, error) {
+	exec := func(timeout time.Duration, dir string, stdout, stderr io.Writer, cmdName string, args ...string) error {
 		call := append([]string{cmdName}, args...)
 		execCalls = append(execCalls, call)
-		return []byte("stdout test error"), &exec.ExitError{Stderr: []byte("stderr test error")}
+		stdout.Write([]byte("stdout test error"))
+		stderr.Write([]byte("stderr test error"))
+		return &exec.ExitError{}
 	}
 	workerConfig := config.WorkerConfig{MuteLogs: true, Session: &pzsvc.Session{}}
 
 	// Tested code
 	runner := newCommandRunner()
 	runner.exec = exec
-	output := runner.Run(workerConfig, "test command")
+	output := runner.Run(workerConfig, "test command", nil)
 
 	// Asserts
 	assert.Equal(t, []byte("stdout test error"), output.Stdout)
@@ -59,17 +69,18 @@ func TestDefaultCommandRunner_ExitError(t *testing.T) {
 func TestDefaultCommandRunner_UnknownError(t *testing.T) {
 	// Setup
 	execCalls := [][]string{}
-	exec := func(cmdName string, args ...string) ([]byte, error) {
+	exec := func(timeout time.Duration, dir string, stdout, stderr io.Writer, cmdName string, args ...string) error {
 		call := append([]string{cmdName}, args...)
 		execCalls = append(execCalls, call)
-		return []byte("stdout test error"), errors.New("unknown error")
+		stdout.Write([]byte("stdout test error"))
+		return errors.New("unknown error")
 	}
 	workerConfig := config.WorkerConfig{MuteLogs: true, Session: &pzsvc.Session{}}
 
 	// Tested code
 	runner := newCommandRunner()
 	runner.exec = exec
-	output := runner.Run(workerConfig, "test command")
+	output := runner.Run(workerConfig, "test command", nil)
 
 	// Asserts
 	assert.Equal(t, []byte("stdout test error"), output.Stdout)
@@ -89,10 +100,149 @@ func TestDefaultCommandRunner_NativeCommand(t *testing.T) {
 
 	// Tested code
 	runner := newCommandRunner()
-	output := runner.Run(workerConfig, "echo hello")
+	output := runner.Run(workerConfig, "echo hello", nil)
 
 	// Asserts
 	assert.Equal(t, []byte("hello\n"), output.Stdout)
 	assert.Empty(t, output.Stderr)
 	assert.Nil(t, output.Error)
 }
+
+func TestDefaultCommandRunner_StderrOnSuccess(t *testing.T) {
+	// Setup
+	exec := func(timeout time.Duration, dir string, stdout, stderr io.Writer, cmdName string, args ...string) error {
+		stdout.Write([]byte("result\n"))
+		stderr.Write([]byte("warning\n"))
+		return nil
+	}
+	workerConfig := config.WorkerConfig{MuteLogs: true, Session: &pzsvc.Session{}}
+
+	// Tested code
+	runner := newCommandRunner()
+	runner.exec = exec
+	output := runner.Run(workerConfig, "test command", nil)
+
+	// Asserts
+	assert.Nil(t, output.Error)
+	assert.Equal(t, []byte("result\n"), output.Stdout)
+	assert.Equal(t, []byte("warning\n"), output.Stderr)
+}
+
+func TestDefaultCommandRunner_MaxRunTime(t *testing.T) {
+	// Setup
+	execTimeouts := []time.Duration{}
+	exec := func(timeout time.Duration, dir string, stdout, stderr io.Writer, cmdName string, args ...string) error {
+		execTimeouts = append(execTimeouts, timeout)
+		stdout.Write([]byte("partial output"))
+		return errCommandTimedOut
+	}
+	workerConfig := config.WorkerConfig{MuteLogs: true, Session: &pzsvc.Session{}}
+	workerConfig.PzSEConfig.MaxRunTime = 30
+
+	// Tested code
+	runner := newCommandRunner()
+	runner.exec = exec
+	output := runner.Run(workerConfig, "test command", nil)
+
+	// Asserts
+	assert.Equal(t, []time.Duration{30 * time.Second}, execTimeouts)
+	assert.Equal(t, []byte("partial output"), output.Stdout)
+	assert.True(t, output.TimedOut)
+	assert.Contains(t, output.Error.Error(), "timed out")
+	assert.Equal(t, http.StatusGatewayTimeout, output.failureStatus())
+}
+
+func TestExecWithTimeout_KillsProcessGroup(t *testing.T) {
+	// Availability probe
+	probeOutput, err := exec.Command("sh", "-c", "echo hello").Output()
+	if err != nil || string(probeOutput) != "hello\n" {
+		t.Skip("`sh -c` not available on this platform")
+	}
+	oldGracePeriod := killGracePeriod
+	killGracePeriod = 100 * time.Millisecond
+	defer func() { killGracePeriod = oldGracePeriod }()
+
+	var stdout, stderr bytes.Buffer
+
+	// Tested code
+	start := time.Now()
+	err = execWithTimeout(100*time.Millisecond, "", &stdout, &stderr, "sh", "-c", "trap '' TERM; echo started; sleep 10 & wait")
+
+	// Asserts
+	assert.Equal(t, errCommandTimedOut, err)
+	assert.Equal(t, "started\n", stdout.String())
+	assert.True(t, time.Since(start) < 5*time.Second) // The background sleep was killed with the group
+}
+
+func TestExecWithTimeout_Terminated(t *testing.T) {
+	// Availability probe
+	probeOutput, err := exec.Command("sh", "-c", "echo hello").Output()
+	if err != nil || string(probeOutput) != "hello\n" {
+		t.Skip("`sh -c` not available on this platform")
+	}
+	oldGracePeriod := killGracePeriod
+	killGracePeriod = 100 * time.Millisecond
+	defer func() { killGracePeriod = oldGracePeriod }()
+	oldCommands := runningCommands
+	runningCommands = newCommandTracker()
+	defer func() { runningCommands = oldCommands }()
+
+	var stdout, stderr bytes.Buffer
+	terminated := make(chan bool)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		runningCommands.terminate()
+		close(terminated)
+	}()
+
+	// Tested code
+	start := time.Now()
+	err = execWithTimeout(0, "", &stdout, &stderr, "sh", "-c", "trap '' TERM; echo started; sleep 10 & wait")
+	<-terminated
+	errAfter := execWithTimeout(0, "", &stdout, &stderr, "sh", "-c", "echo too late")
+
+	// Asserts
+	assert.Equal(t, errCommandTerminated, err)
+	assert.Equal(t, errCommandTerminated, errAfter)
+	assert.Equal(t, "started\n", stdout.String())
+	assert.True(t, time.Since(start) < 5*time.Second) // The background sleep was killed with the group
+}
+
+func TestExecWithTimeout_NoTimeout(t *testing.T) {
+	// Availability probe
+	probeOutput, err := exec.Command("sh", "-c", "echo hello").Output()
+	if err != nil || string(probeOutput) != "hello\n" {
+		t.Skip("`sh -c` not available on this platform")
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	// Tested code
+	err = execWithTimeout(0, "", &stdout, &stderr, "sh", "-c", "echo out; echo err >&2; exit 2")
+
+	// Asserts
+	assert.Equal(t, "out\n", stdout.String())
+	assert.Equal(t, "err\n", stderr.String())
+	_, ok := err.(*exec.ExitError)
+	assert.True(t, ok)
+}
+
+func TestExecWithTimeout_Dir(t *testing.T) {
+	// Availability probe
+	probeOutput, err := exec.Command("sh", "-c", "echo hello").Output()
+	if err != nil || string(probeOutput) != "hello\n" {
+		t.Skip("`sh -c` not available on this platform")
+	}
+
+	dir, _ := ioutil.TempDir("", "exec-dir-test")
+	defer os.RemoveAll(dir)
+	var stdout, stderr bytes.Buffer
+
+	// Tested code
+	err = execWithTimeout(0, dir, &stdout, &stderr, "sh", "-c", "echo output > output.txt")
+
+	// Asserts
+	assert.Nil(t, err)
+	_, statErr := os.Stat(filepath.Join(dir, "output.txt"))
+	assert.Nil(t, statErr)
+}
@@ -0,0 +1,84 @@
+// Copyright 2018, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workerexec
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/venicegeo/pzsvc-exec/worker/config"
+)
+
+// shellQuote quotes a string as a single shell word, whatever characters it contains
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+// expandCliCmd fills in the placeholders of the config's CliCmd for the job:
+//
+//	{{input "name"}}     - the path of the named input file
+//	{{extracted "name"}} - the path of the directory the named archive input was extracted into
+//	{{outputs}}          - the names of the output files, space-separated
+//	{{jobID}}            - the Piazza job ID
+//	{{workdir}}          - the path of the job's working directory
+//
+// Every value is shell-quoted, so that job data cannot add to the command.
+func expandCliCmd(cfg config.WorkerConfig) (string, error) {
+	funcs := template.FuncMap{
+		"input": func(fileName string) (string, error) {
+			for _, input := range cfg.Inputs {
+				if input.FileName == fileName {
+					path, err := cfg.WorkPath(fileName)
+					return shellQuote(path), err
+				}
+			}
+			return "", fmt.Errorf("%s is not an input of this job", fileName)
+		},
+		"extracted": func(fileName string) (string, error) {
+			for _, input := range cfg.Inputs {
+				if input.FileName == fileName && input.ExtractTo != "" {
+					path, err := cfg.WorkPath(input.ExtractTo)
+					return shellQuote(path), err
+				}
+			}
+			return "", fmt.Errorf("%s is not an extracted input of this job", fileName)
+		},
+		"outputs": func() string {
+			quoted := []string{}
+			for _, output := range cfg.Outputs {
+				quoted = append(quoted, shellQuote(output))
+			}
+			return strings.Join(quoted, " ")
+		},
+		"jobID": func() string {
+			return shellQuote(cfg.JobID)
+		},
+		"workdir": func() string {
+			return shellQuote(cfg.WorkDir)
+		},
+	}
+
+	tmpl, err := template.New("CliCmd").Funcs(funcs).Parse(cfg.PzSEConfig.CliCmd)
+	if err != nil {
+		return "", fmt.Errorf("invalid CliCmd template: %v", err)
+	}
+	var expanded bytes.Buffer
+	if err = tmpl.Execute(&expanded, nil); err != nil {
+		return "", fmt.Errorf("could not expand CliCmd: %v", err)
+	}
+	return expanded.String(), nil
+}
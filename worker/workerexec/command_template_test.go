@@ -0,0 +1,82 @@
+package workerexec
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/pzsvc-exec/worker/config"
+)
+
+func TestExpandCliCmd(t *testing.T) {
+	// Setup
+	cfg := config.WorkerConfig{
+		JobID:   "job-1",
+		WorkDir: "/tmp/work dir",
+		Inputs:  []config.InputSource{config.InputSource{FileName: "image.tif", URL: "http://example.localdomain/image.tif"}},
+		Outputs: []string{"out.geojson", "it's.txt"},
+	}
+	cfg.PzSEConfig.CliCmd = `algo --in {{input "image.tif"}} --out {{outputs}} --job {{jobID}} --dir {{workdir}}`
+
+	// Tested code
+	cmd, err := expandCliCmd(cfg)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, `algo --in '/tmp/work dir/image.tif' --out 'out.geojson' 'it'"'"'s.txt' --job 'job-1' --dir '/tmp/work dir'`, cmd)
+}
+
+func TestExpandCliCmd_Extracted(t *testing.T) {
+	// Setup
+	cfg := config.WorkerConfig{
+		WorkDir: "/tmp/workdir",
+		Inputs:  []config.InputSource{config.InputSource{FileName: "scene.zip", ExtractTo: "scene"}},
+	}
+	cfg.PzSEConfig.CliCmd = `algo --scene {{extracted "scene.zip"}}`
+
+	// Tested code
+	cmd, err := expandCliCmd(cfg)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, `algo --scene '/tmp/workdir/scene'`, cmd)
+}
+
+func TestExpandCliCmd_NoPlaceholders(t *testing.T) {
+	cfg := config.WorkerConfig{}
+	cfg.PzSEConfig.CliCmd = "python ../bfalg-ndwi.py --outdir ."
+
+	cmd, err := expandCliCmd(cfg)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "python ../bfalg-ndwi.py --outdir .", cmd)
+}
+
+func TestExpandCliCmd_Errors(t *testing.T) {
+	cfg := config.WorkerConfig{Inputs: []config.InputSource{config.InputSource{FileName: "image.tif"}}}
+
+	cfg.PzSEConfig.CliCmd = `algo {{input "other.tif"}}`
+	_, err := expandCliCmd(cfg)
+	assert.Contains(t, err.Error(), "other.tif is not an input of this job")
+
+	cfg.PzSEConfig.CliCmd = `algo {{extracted "image.tif"}}`
+	_, err = expandCliCmd(cfg)
+	assert.Contains(t, err.Error(), "image.tif is not an extracted input of this job")
+
+	cfg.PzSEConfig.CliCmd = `algo {{unknown}}`
+	_, err = expandCliCmd(cfg)
+	assert.Contains(t, err.Error(), "invalid CliCmd template")
+}
+
+func TestShellQuote(t *testing.T) {
+	// Availability probe
+	if _, err := exec.Command("sh", "-c", "true").Output(); err != nil {
+		t.Skip("`sh -c` not available on this platform")
+	}
+
+	for _, value := range []string{"plain", "with space", "it's", `"; rm -rf / #`, "$(whoami)", "`id`", ""} {
+		output, err := exec.Command("sh", "-c", "printf %s "+shellQuote(value)).Output()
+		assert.Nil(t, err)
+		assert.Equal(t, value, string(output))
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2018, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workerexec
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// outputHeadLimit and outputTailLimit are how many bytes of the start and end of
+// each command output stream are kept for the job result
+var outputHeadLimit = getOutputLimit("OUTPUT_HEAD_BYTES")
+var outputTailLimit = getOutputLimit("OUTPUT_TAIL_BYTES")
+
+// maxLogLineLength is the length at which an unterminated output line is logged anyway
+const maxLogLineLength = 4096
+
+func getOutputLimit(envVar string) int {
+	limit := 32 * 1024
+	if envLimit, err := strconv.Atoi(os.Getenv(envVar)); envLimit >= 0 && err == nil {
+		limit = envLimit
+	}
+	return limit
+}
+
+// cappedBuffer is an io.Writer that keeps only the first and last bytes written to it,
+// so that the output of a chatty command cannot exhaust memory
+type cappedBuffer struct {
+	mutex     sync.Mutex
+	headLimit int
+	tailLimit int
+	head      []byte
+	tail      []byte
+	dropped   int
+}
+
+func newCappedBuffer(headLimit, tailLimit int) *cappedBuffer {
+	return &cappedBuffer{headLimit: headLimit, tailLimit: tailLimit}
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	written := len(p)
+
+	if room := b.headLimit - len(b.head); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		b.head = append(b.head, p[:room]...)
+		p = p[room:]
+	}
+
+	b.tail = append(b.tail, p...)
+	if excess := len(b.tail) - b.tailLimit; excess > 0 {
+		b.dropped += excess
+		b.tail = append(b.tail[:0], b.tail[excess:]...)
+	}
+	return written, nil
+}
+
+// Bytes returns the kept output, with a marker where any output was dropped
+func (b *cappedBuffer) Bytes() []byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	kept := append([]byte{}, b.head...)
+	if b.dropped > 0 {
+		kept = append(kept, fmt.Sprintf("\n... [%d bytes truncated] ...\n", b.dropped)...)
+	}
+	return append(kept, b.tail...)
+}
+
+// lineWriter is an io.Writer that passes each complete line written to it to a log function
+type lineWriter struct {
+	mutex   sync.Mutex
+	logLine func(line string)
+	pending []byte
+}
+
+func newLineWriter(logLine func(line string)) *lineWriter {
+	return &lineWriter{logLine: logLine}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.pending = append(w.pending, p...)
+	for {
+		end := bytes.IndexByte(w.pending, '\n')
+		if end < 0 || end > maxLogLineLength {
+			if len(w.pending) < maxLogLineLength {
+				break
+			}
+			end = maxLogLineLength
+		}
+		w.logLine(string(bytes.TrimRight(w.pending[:end], "\r")))
+		if end < len(w.pending) && w.pending[end] == '\n' {
+			end++
+		}
+		w.pending = append(w.pending[:0], w.pending[end:]...)
+	}
+	return len(p), nil
+}
+
+// Flush logs any final line that was not terminated by a newline
+func (w *lineWriter) Flush() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if len(w.pending) > 0 {
+		w.logLine(string(w.pending))
+		w.pending = nil
+	}
+}
@@ -0,0 +1,62 @@
+package workerexec
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCappedBuffer_UnderLimit(t *testing.T) {
+	// Setup
+	buf := newCappedBuffer(10, 10)
+
+	// Tested code
+	buf.Write([]byte("hello "))
+	buf.Write([]byte("world"))
+
+	// Asserts
+	assert.Equal(t, "hello world", string(buf.Bytes()))
+}
+
+func TestCappedBuffer_Truncated(t *testing.T) {
+	// Setup
+	buf := newCappedBuffer(5, 5)
+
+	// Tested code
+	buf.Write([]byte("start"))
+	for i := 0; i < 100; i++ {
+		buf.Write([]byte("middle"))
+	}
+	buf.Write([]byte("final"))
+
+	// Asserts
+	assert.Equal(t, "start\n... [600 bytes truncated] ...\nfinal", string(buf.Bytes()))
+}
+
+func TestLineWriter(t *testing.T) {
+	// Setup
+	lines := []string{}
+	writer := newLineWriter(func(line string) { lines = append(lines, line) })
+
+	// Tested code
+	writer.Write([]byte("first li"))
+	writer.Write([]byte("ne\r\nsecond line\nthi"))
+	writer.Write([]byte("rd"))
+	writer.Flush()
+
+	// Asserts
+	assert.Equal(t, []string{"first line", "second line", "third"}, lines)
+}
+
+func TestLineWriter_LongLine(t *testing.T) {
+	// Setup
+	lines := []string{}
+	writer := newLineWriter(func(line string) { lines = append(lines, line) })
+
+	// Tested code
+	writer.Write([]byte(strings.Repeat("x", maxLogLineLength+10) + "\n"))
+
+	// Asserts
+	assert.Equal(t, []string{strings.Repeat("x", maxLogLineLength), strings.Repeat("x", 10)}, lines)
+}
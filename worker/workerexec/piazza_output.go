@@ -10,11 +10,13 @@ import (
 
 type piazzaOutputter struct {
 	sendExecResultData func(pzsvc.Session, string, string, string, pzsvc.PiazzaStatus, []byte) *pzsvc.PzCustomError
+	sendExecProgress   func(pzsvc.Session, string, string, string, pzsvc.JobProg) *pzsvc.PzCustomError
 }
 
 func newPiazzaOutputter() *piazzaOutputter {
 	return &piazzaOutputter{
 		sendExecResultData: pzsvc.SendExecResultData,
+		sendExecProgress:   pzsvc.SendExecProgress,
 	}
 }
 
@@ -0,0 +1,28 @@
+// Copyright 2018, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workerexec
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup does nothing on Windows, which has no process groups to signal
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// signalProcessGroup kills the started command itself, since Windows cannot deliver other signals
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) {
+	cmd.Process.Kill()
+}
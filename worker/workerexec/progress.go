@@ -0,0 +1,142 @@
+// Copyright 2018, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workerexec
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pzsvc-exec/pzsvc"
+	"github.com/venicegeo/pzsvc-exec/worker/config"
+	"github.com/venicegeo/pzsvc-exec/worker/log"
+)
+
+// progressPrefix starts the stdout lines through which an algorithm reports its percent complete
+const progressPrefix = "PZPROGRESS"
+
+// progressInterval is the least time between two progress updates sent to Piazza
+var progressInterval = getProgressInterval()
+
+func getProgressInterval() time.Duration {
+	interval := 10
+	if envInterval, err := strconv.Atoi(os.Getenv("PROGRESS_INTERVAL")); envInterval > 0 && err == nil {
+		interval = envInterval
+	}
+	return time.Duration(interval) * time.Second
+}
+
+// parseProgressLine returns the percent complete reported by a "PZPROGRESS <percent>" line,
+// and whether the line was a valid progress report
+func parseProgressLine(line string) (int, bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 || fields[0] != progressPrefix {
+		return 0, false
+	}
+	percent, err := strconv.Atoi(fields[1])
+	if err != nil || percent < 0 || percent > 100 {
+		return 0, false
+	}
+	return percent, true
+}
+
+// progressReporter forwards the progress an algorithm prints to Piazza.  Updates are
+// throttled to one per interval, and sent in the background so that they never hold up
+// the algorithm's output; an update that falls due while another is being sent waits
+// for it, replacing any older one still waiting.
+type progressReporter struct {
+	cfg       config.WorkerConfig
+	send      func(pzsvc.Session, string, string, string, pzsvc.JobProg) *pzsvc.PzCustomError
+	interval  time.Duration
+	started   time.Time
+	mutex     *sync.Mutex
+	waitGroup *sync.WaitGroup
+	sending   bool
+	waiting   *pzsvc.JobProg
+	lastSent  time.Time
+	lastValue int
+}
+
+func newProgressReporter(cfg config.WorkerConfig, send func(pzsvc.Session, string, string, string, pzsvc.JobProg) *pzsvc.PzCustomError) *progressReporter {
+	return &progressReporter{
+		cfg:       cfg,
+		send:      send,
+		interval:  progressInterval,
+		started:   time.Now(),
+		mutex:     &sync.Mutex{},
+		waitGroup: &sync.WaitGroup{},
+		lastValue: -1,
+	}
+}
+
+// HandleLine sends a progress update if the given stdout line is a progress report that is due
+func (r *progressReporter) HandleLine(line string) {
+	percent, ok := parseProgressLine(line)
+	if !ok {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if percent == r.lastValue {
+		return
+	}
+	// Completion is always reported, however recently the last update went out
+	now := time.Now()
+	if percent < 100 && now.Sub(r.lastSent) < r.interval {
+		return
+	}
+	r.lastSent = now
+	r.lastValue = percent
+
+	progress := pzsvc.JobProg{
+		PercentComplete: percent,
+		TimeSpent:       now.Sub(r.started).Round(time.Second).String(),
+	}
+	if r.sending {
+		r.waiting = &progress
+		return
+	}
+	r.sending = true
+	r.waitGroup.Add(1)
+	go r.sendUpdates(progress)
+}
+
+// sendUpdates sends the given update, then any that fell due while it was being sent
+func (r *progressReporter) sendUpdates(progress pzsvc.JobProg) {
+	defer r.waitGroup.Done()
+	for {
+		if pzErr := r.send(*r.cfg.Session, r.cfg.PiazzaBaseURL, r.cfg.PiazzaServiceID, r.cfg.JobID, progress); pzErr != nil {
+			workerlog.Warn(r.cfg, "Failed to send progress to Piazza: "+pzErr.Error())
+		}
+
+		r.mutex.Lock()
+		if r.waiting == nil {
+			r.sending = false
+			r.mutex.Unlock()
+			return
+		}
+		progress = *r.waiting
+		r.waiting = nil
+		r.mutex.Unlock()
+	}
+}
+
+// Stop waits for any update still being sent, so that it cannot land after the job's result
+func (r *progressReporter) Stop() {
+	r.waitGroup.Wait()
+}
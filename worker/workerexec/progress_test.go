@@ -0,0 +1,74 @@
+package workerexec
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/pzsvc-exec/pzsvc"
+	"github.com/venicegeo/pzsvc-exec/worker/config"
+)
+
+func TestParseProgressLine(t *testing.T) {
+	for line, expected := range map[string]int{"PZPROGRESS 42": 42, "  PZPROGRESS 0 ": 0, "PZPROGRESS 100": 100} {
+		percent, ok := parseProgressLine(line)
+		assert.True(t, ok, line)
+		assert.Equal(t, expected, percent, line)
+	}
+	for _, line := range []string{"", "PZPROGRESS", "PZPROGRESS 101", "PZPROGRESS -1", "PZPROGRESS 4.2", "progress 42", "PZPROGRESS 42 done"} {
+		_, ok := parseProgressLine(line)
+		assert.False(t, ok, line)
+	}
+}
+
+func TestProgressReporter_Throttles(t *testing.T) {
+	// Setup
+	sent := []pzsvc.JobProg{}
+	mutex := &sync.Mutex{}
+	send := func(s pzsvc.Session, pzAddr, svcID, jobID string, progress pzsvc.JobProg) *pzsvc.PzCustomError {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sent = append(sent, progress)
+		return nil
+	}
+	reporter := newProgressReporter(config.WorkerConfig{MuteLogs: true, Session: &pzsvc.Session{}}, send)
+	reporter.interval = time.Hour
+
+	// Tested code
+	reporter.HandleLine("PZPROGRESS 5")
+	reporter.HandleLine("PZPROGRESS 50")
+	reporter.HandleLine("not progress")
+	reporter.HandleLine("PZPROGRESS 100")
+	reporter.HandleLine("PZPROGRESS 100")
+	reporter.Stop()
+
+	// Asserts
+	assert.Len(t, sent, 2)
+	assert.Equal(t, 5, sent[0].PercentComplete)
+	assert.Equal(t, 100, sent[1].PercentComplete)
+	assert.Equal(t, "0s", sent[1].TimeSpent)
+}
+
+func TestProgressReporter_WaitsForSend(t *testing.T) {
+	// Setup
+	sent := []int{}
+	release := make(chan bool)
+	send := func(s pzsvc.Session, pzAddr, svcID, jobID string, progress pzsvc.JobProg) *pzsvc.PzCustomError {
+		<-release
+		sent = append(sent, progress.PercentComplete)
+		return nil
+	}
+	reporter := newProgressReporter(config.WorkerConfig{MuteLogs: true, Session: &pzsvc.Session{}}, send)
+	reporter.interval = 0
+
+	// Tested code
+	reporter.HandleLine("PZPROGRESS 10")
+	reporter.HandleLine("PZPROGRESS 20")
+	reporter.HandleLine("PZPROGRESS 30")
+	close(release)
+	reporter.Stop()
+
+	// Asserts: the update due while the first was sent replaced the older one waiting
+	assert.Equal(t, []int{10, 30}, sent)
+}
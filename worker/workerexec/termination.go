@@ -0,0 +1,84 @@
+// Copyright 2018, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workerexec
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// errCommandTerminated is returned by execWithTimeout when the worker was told to stop while the command ran
+var errCommandTerminated = errors.New("command was stopped because the worker was terminated")
+
+// commandTracker keeps count of the commands the worker is running, so that a worker told to
+// stop can stop their process groups before it exits.  The algorithm runs in a process group of
+// its own, which a signal to the worker does not reach.
+type commandTracker struct {
+	mutex    sync.Mutex
+	stopping bool
+	stop     chan bool // Closed when the worker is told to stop
+	running  sync.WaitGroup
+}
+
+func newCommandTracker() *commandTracker {
+	return &commandTracker{stop: make(chan bool)}
+}
+
+var runningCommands = newCommandTracker()
+
+// begin records that a command is starting, and returns false if the worker is stopping, in
+// which case the command must not be started
+func (c *commandTracker) begin() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.stopping {
+		return false
+	}
+	c.running.Add(1)
+	return true
+}
+
+// end records that a command started with begin has exited
+func (c *commandTracker) end() {
+	c.running.Done()
+}
+
+// terminate tells the running commands to stop, and waits until they have
+func (c *commandTracker) terminate() {
+	c.mutex.Lock()
+	if !c.stopping {
+		c.stopping = true
+		close(c.stop)
+	}
+	c.mutex.Unlock()
+	c.running.Wait()
+}
+
+// HandleTermination makes the worker stop the commands it is running when it is sent SIGTERM
+// or interrupted, as when its task is cancelled, and then exit
+func HandleTermination() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		fmt.Fprintf(os.Stderr, "Worker received %v; stopping running commands and exiting\n", sig)
+		runningCommands.terminate()
+		os.Exit(1)
+	}()
+}
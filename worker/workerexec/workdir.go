@@ -0,0 +1,68 @@
+// Copyright 2018, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workerexec
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/venicegeo/pzsvc-exec/worker/config"
+)
+
+// workDirRoot is the directory that job working directories are created in
+var workDirRoot = getWorkDirRoot()
+
+// cleanWorkDir is whether a job's working directory is deleted once its result has been sent
+var cleanWorkDir = getCleanWorkDir()
+
+func getWorkDirRoot() string {
+	root := "."
+	if envRoot := os.Getenv("WORK_DIR_ROOT"); envRoot != "" {
+		root = envRoot
+	}
+	return root
+}
+
+func getCleanWorkDir() bool {
+	clean := true
+	if envClean := os.Getenv("CLEAN_WORK_DIR"); envClean != "" {
+		if parsed, err := strconv.ParseBool(envClean); err == nil {
+			clean = parsed
+		}
+	}
+	return clean
+}
+
+// makeWorkDir creates a new, uniquely named scratch directory for the job, and returns its absolute path
+func makeWorkDir(cfg config.WorkerConfig) (string, error) {
+	if err := os.MkdirAll(workDirRoot, 0777); err != nil {
+		return "", err
+	}
+	dir, err := ioutil.TempDir(workDirRoot, "job-"+cfg.JobID+"-")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(dir)
+}
+
+// removeWorkDir deletes the job's scratch directory and everything in it, unless CLEAN_WORK_DIR disables it
+func removeWorkDir(dir string) error {
+	if !cleanWorkDir {
+		return nil
+	}
+	return os.RemoveAll(dir)
+}
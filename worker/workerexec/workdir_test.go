@@ -0,0 +1,58 @@
+package workerexec
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/pzsvc-exec/worker/config"
+)
+
+func TestMakeWorkDir(t *testing.T) {
+	// Setup
+	root, _ := ioutil.TempDir("", "workdir-test")
+	defer os.RemoveAll(root)
+	oldRoot := workDirRoot
+	workDirRoot = filepath.Join(root, "jobs")
+	defer func() { workDirRoot = oldRoot }()
+
+	// Tested code
+	dir1, err1 := makeWorkDir(config.WorkerConfig{JobID: "job1"})
+	dir2, err2 := makeWorkDir(config.WorkerConfig{JobID: "job1"})
+
+	// Asserts
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+	assert.True(t, filepath.IsAbs(dir1))
+	assert.True(t, strings.HasPrefix(filepath.Base(dir1), "job-job1-"))
+	assert.NotEqual(t, dir1, dir2) // the same job run twice does not collide
+	info, err := os.Stat(dir1)
+	assert.Nil(t, err)
+	assert.True(t, info.IsDir())
+}
+
+func TestRemoveWorkDir(t *testing.T) {
+	// Setup
+	dir, _ := ioutil.TempDir("", "workdir-test")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "output.txt"), []byte("output"), 0666)
+	oldClean := cleanWorkDir
+	defer func() { cleanWorkDir = oldClean }()
+
+	// Tested code
+	cleanWorkDir = false
+	errKept := removeWorkDir(dir)
+	_, statKept := os.Stat(dir)
+	cleanWorkDir = true
+	errRemoved := removeWorkDir(dir)
+	_, statRemoved := os.Stat(dir)
+
+	// Asserts
+	assert.Nil(t, errKept)
+	assert.Nil(t, statKept)
+	assert.Nil(t, errRemoved)
+	assert.True(t, os.IsNotExist(statRemoved))
+}
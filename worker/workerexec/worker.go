@@ -15,6 +15,7 @@
 package workerexec
 
 import (
+	"errors"
 	"net/http"
 	"strings"
 
@@ -28,6 +29,8 @@ import (
 type Worker struct {
 	fetchInputsFunc         func(config.WorkerConfig, []config.InputSource) error
 	outputFilesToPiazzaFunc func(config.WorkerConfig, string, string) ingest.MultiIngestOutput
+	makeWorkDirFunc         func(config.WorkerConfig) (string, error)
+	removeWorkDirFunc       func(string) error
 	piazzaOutputter         *piazzaOutputter
 	commandRunner           *commandRunner
 }
@@ -37,6 +40,8 @@ func NewWorker() *Worker {
 	return &Worker{
 		fetchInputsFunc:         input.FetchInputs,
 		outputFilesToPiazzaFunc: ingest.OutputFilesToPiazza,
+		makeWorkDirFunc:         makeWorkDir,
+		removeWorkDirFunc:       removeWorkDir,
 		piazzaOutputter:         newPiazzaOutputter(),
 		commandRunner:           newCommandRunner(),
 	}
@@ -50,6 +55,25 @@ func (w Worker) Exec(cfg config.WorkerConfig) (err error) {
 		HTTPStatus: http.StatusOK,
 	}
 
+	// Each job gets its own scratch directory, so that jobs sharing a machine or container cannot collide
+	workDir, err := w.makeWorkDirFunc(cfg)
+	if err != nil {
+		workerlog.SimpleErr(cfg, "Failed to create working directory", err)
+		outData.AddErrors(err)
+		outData.HTTPStatus = http.StatusInternalServerError
+		return w.piazzaOutputter.OutputToPiazza(cfg, outData)
+	}
+	defer func() {
+		if removeErr := w.removeWorkDirFunc(workDir); removeErr != nil {
+			workerlog.SimpleErr(cfg, "Failed to remove working directory "+workDir, removeErr)
+		}
+	}()
+	cfg.WorkDir = workDir
+	session := *cfg.Session
+	session.SubFold = workDir
+	cfg.Session = &session
+	workerlog.Info(cfg, "Working in directory "+workDir)
+
 	workerlog.Info(cfg, "Fetching inputs")
 	err = w.fetchInputsFunc(cfg, cfg.Inputs)
 	if err != nil {
@@ -62,26 +86,49 @@ func (w Worker) Exec(cfg config.WorkerConfig) (err error) {
 	workerlog.Info(cfg, "Inputs fetched")
 
 	workerlog.Info(cfg, "Running version command")
-	versionCmdOutput := w.commandRunner.Run(cfg, cfg.PzSEConfig.VersionCmd)
+	versionCmdOutput := w.commandRunner.Run(cfg, cfg.PzSEConfig.VersionCmd, nil)
 	if versionCmdOutput.Error != nil {
 		workerlog.SimpleErr(cfg, "Failed to get algorithm version", versionCmdOutput.Error)
 		outData.AddErrors(versionCmdOutput.Error)
-		outData.HTTPStatus = http.StatusInternalServerError
+		outData.HTTPStatus = versionCmdOutput.failureStatus()
 		outData.ProgStdErr = string(versionCmdOutput.Stderr)
 		return w.piazzaOutputter.OutputToPiazza(cfg, outData)
 	}
 	version := strings.TrimSpace(string(versionCmdOutput.Stdout))
 	workerlog.Info(cfg, "Retrieved algorithm version: "+version)
 
-	fullCommand := strings.Join([]string{cfg.PzSEConfig.CliCmd, cfg.CLICommandExtra}, " ")
+	if len(cfg.PzSEConfig.Params) > 0 && cfg.CLICommandExtra != "" {
+		err := errors.New("this service takes its parameters as params; free-form command text is not permitted")
+		workerlog.SimpleErr(cfg, "Rejected algorithm command", err)
+		outData.AddErrors(err)
+		outData.HTTPStatus = http.StatusBadRequest
+		return w.piazzaOutputter.OutputToPiazza(cfg, outData)
+	}
+	cliCmd, err := expandCliCmd(cfg)
+	if err != nil {
+		workerlog.SimpleErr(cfg, "Failed to build algorithm command", err)
+		outData.AddErrors(err)
+		outData.HTTPStatus = http.StatusInternalServerError
+		return w.piazzaOutputter.OutputToPiazza(cfg, outData)
+	}
+	commandParts := []string{cliCmd}
+	if cfg.CLICommandExtra != "" {
+		commandParts = append(commandParts, cfg.CLICommandExtra)
+	}
+	for _, arg := range cfg.Args {
+		commandParts = append(commandParts, shellQuote(arg))
+	}
+	fullCommand := strings.Join(commandParts, " ")
 	workerlog.Info(cfg, "Running algorithm command: "+fullCommand)
-	algCmdOutput := w.commandRunner.Run(cfg, fullCommand)
+	progress := newProgressReporter(cfg, w.piazzaOutputter.sendExecProgress)
+	algCmdOutput := w.commandRunner.Run(cfg, fullCommand, progress.HandleLine)
+	progress.Stop()
 	outData.ProgStdOut = string(algCmdOutput.Stdout)
 	outData.ProgStdErr = string(algCmdOutput.Stderr)
 	if algCmdOutput.Error != nil {
 		workerlog.SimpleErr(cfg, "Failed running algorithm command", algCmdOutput.Error)
 		outData.AddErrors(algCmdOutput.Error)
-		outData.HTTPStatus = http.StatusInternalServerError
+		outData.HTTPStatus = algCmdOutput.failureStatus()
 		return w.piazzaOutputter.OutputToPiazza(cfg, outData)
 	}
 	workerlog.Info(cfg, "Algorithm command successful")
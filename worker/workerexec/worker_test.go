@@ -2,8 +2,10 @@ package workerexec
 
 import (
 	"errors"
+	"io"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/venicegeo/pzsvc-exec/pzsvc"
@@ -23,13 +25,21 @@ type sendExecResultDataCall struct {
 	resultData           []byte
 }
 
+type sendExecProgressCall struct {
+	pzAddr, svcID, jobID string
+	progress             pzsvc.JobProg
+}
+
 type workerMock struct {
 	workerConfig             *config.WorkerConfig
 	worker                   *Worker
 	fetchInputsCalls         [][]config.InputSource
 	outputFilesToPiazzaCalls []outputFilesToPiazzaCall
 	sendExecResultDataCalls  []sendExecResultDataCall
+	sendExecProgressCalls    []sendExecProgressCall
 	commandRunnerCalls       [][]string
+	commandRunnerDirs        []string
+	removedWorkDirs          []string
 }
 
 func execMockSetup() *workerMock {
@@ -39,7 +49,10 @@ func execMockSetup() *workerMock {
 		fetchInputsCalls:         [][]config.InputSource{},
 		outputFilesToPiazzaCalls: []outputFilesToPiazzaCall{},
 		sendExecResultDataCalls:  []sendExecResultDataCall{},
+		sendExecProgressCalls:    []sendExecProgressCall{},
 		commandRunnerCalls:       [][]string{},
+		commandRunnerDirs:        []string{},
+		removedWorkDirs:          []string{},
 	}
 
 	mock.worker.fetchInputsFunc = func(cfg config.WorkerConfig, inputs []config.InputSource) error {
@@ -50,15 +63,27 @@ func execMockSetup() *workerMock {
 		mock.outputFilesToPiazzaCalls = append(mock.outputFilesToPiazzaCalls, outputFilesToPiazzaCall{algFullCommand, algVersion})
 		return ingest.MultiIngestOutput{}
 	}
+	mock.worker.makeWorkDirFunc = func(cfg config.WorkerConfig) (string, error) {
+		return "/test/workdir", nil
+	}
+	mock.worker.removeWorkDirFunc = func(dir string) error {
+		mock.removedWorkDirs = append(mock.removedWorkDirs, dir)
+		return nil
+	}
 	mock.worker.piazzaOutputter = newPiazzaOutputter()
 	mock.worker.piazzaOutputter.sendExecResultData = func(s pzsvc.Session, pzAddr, svcID, jobID string, status pzsvc.PiazzaStatus, resultData []byte) *pzsvc.PzCustomError {
 		mock.sendExecResultDataCalls = append(mock.sendExecResultDataCalls, sendExecResultDataCall{pzAddr, svcID, jobID, status, resultData})
 		return nil
 	}
+	mock.worker.piazzaOutputter.sendExecProgress = func(s pzsvc.Session, pzAddr, svcID, jobID string, progress pzsvc.JobProg) *pzsvc.PzCustomError {
+		mock.sendExecProgressCalls = append(mock.sendExecProgressCalls, sendExecProgressCall{pzAddr, svcID, jobID, progress})
+		return nil
+	}
 	mock.worker.commandRunner = newCommandRunner()
-	mock.worker.commandRunner.exec = func(cmdName string, args ...string) ([]byte, error) {
+	mock.worker.commandRunner.exec = func(timeout time.Duration, dir string, stdout, stderr io.Writer, cmdName string, args ...string) error {
 		mock.commandRunnerCalls = append(mock.commandRunnerCalls, append([]string{cmdName}, args...))
-		return nil, nil
+		mock.commandRunnerDirs = append(mock.commandRunnerDirs, dir)
+		return nil
 	}
 
 	return mock
@@ -78,9 +103,10 @@ func TestExec_Success(t *testing.T) {
 	execMock.workerConfig.CLICommandExtra = "--extra"
 	execMock.workerConfig.PzSEConfig.VersionCmd = "version cli command"
 	oldExec := execMock.worker.commandRunner.exec
-	execMock.worker.commandRunner.exec = func(cmdName string, args ...string) ([]byte, error) {
-		oldExec(cmdName, args...)
-		return []byte("1.2.3test"), nil
+	execMock.worker.commandRunner.exec = func(timeout time.Duration, dir string, stdout, stderr io.Writer, cmdName string, args ...string) error {
+		oldExec(timeout, dir, stdout, stderr, cmdName, args...)
+		stdout.Write([]byte("1.2.3test"))
+		return nil
 	}
 
 	// Tested code
@@ -129,13 +155,14 @@ func TestExec_ErrorVersionCmd(t *testing.T) {
 	// Setup
 	execMock := execMockSetup()
 	execMock.workerConfig.PzSEConfig.VersionCmd = "version-cmd"
-	execMock.worker.commandRunner.exec = func(cmdName string, args ...string) ([]byte, error) {
+	execMock.worker.commandRunner.exec = func(timeout time.Duration, dir string, stdout, stderr io.Writer, cmdName string, args ...string) error {
 		for _, arg := range args {
 			if strings.Contains(arg, "version-cmd") {
-				return []byte{}, errors.New("test version cmd error")
+				return errors.New("test version cmd error")
 			}
 		}
-		return []byte("ok"), nil
+		stdout.Write([]byte("ok"))
+		return nil
 	}
 
 	// Tested code
@@ -154,13 +181,14 @@ func TestExec_ErrorAlgoCmd(t *testing.T) {
 	// Setup
 	execMock := execMockSetup()
 	execMock.workerConfig.PzSEConfig.CliCmd = "algo-cmd"
-	execMock.worker.commandRunner.exec = func(cmdName string, args ...string) ([]byte, error) {
+	execMock.worker.commandRunner.exec = func(timeout time.Duration, dir string, stdout, stderr io.Writer, cmdName string, args ...string) error {
 		for _, arg := range args {
 			if strings.Contains(arg, "algo-cmd") {
-				return []byte{}, errors.New("test algo cmd error")
+				return errors.New("test algo cmd error")
 			}
 		}
-		return []byte("ok"), nil
+		stdout.Write([]byte("ok"))
+		return nil
 	}
 
 	// Tested code
@@ -213,3 +241,169 @@ func TestExec_ErrorSendExecResult(t *testing.T) {
 	assert.NotNil(t, err) // check there should be an unrecoverable error
 	assert.Contains(t, err.Error(), "failed to send result data")
 }
+
+func TestExec_TimeoutAlgoCmd(t *testing.T) {
+	// Setup
+	execMock := execMockSetup()
+	execMock.workerConfig.PzSEConfig.CliCmd = "algo-cmd"
+	execMock.workerConfig.PzSEConfig.MaxRunTime = 60
+	execMock.worker.commandRunner.exec = func(timeout time.Duration, dir string, stdout, stderr io.Writer, cmdName string, args ...string) error {
+		for _, arg := range args {
+			if strings.Contains(arg, "algo-cmd") {
+				return errCommandTimedOut
+			}
+		}
+		stdout.Write([]byte("ok"))
+		return nil
+	}
+
+	// Tested code
+	err := execMock.worker.Exec(*execMock.workerConfig)
+
+	// Asserts
+	assert.Nil(t, err) // check no unrecoverable error
+
+	// check error exec result was sent to piazza, reporting the timeout
+	assert.Len(t, execMock.sendExecResultDataCalls, 1)
+	assert.Equal(t, pzsvc.PiazzaStatusError, execMock.sendExecResultDataCalls[0].status)
+	assert.Contains(t, string(execMock.sendExecResultDataCalls[0].resultData), "MaxRunTime of 1m0s")
+	assert.Contains(t, string(execMock.sendExecResultDataCalls[0].resultData), `"HTTPStatus":504`)
+}
+
+func TestExec_ReportsProgress(t *testing.T) {
+	// Setup
+	execMock := execMockSetup()
+	execMock.workerConfig.PzSEConfig.CliCmd = "algo-cmd"
+	execMock.workerConfig.JobID = "test-job"
+	execMock.worker.commandRunner.exec = func(timeout time.Duration, dir string, stdout, stderr io.Writer, cmdName string, args ...string) error {
+		if strings.Contains(args[len(args)-1], "algo-cmd") {
+			stdout.Write([]byte("working\nPZPROGRESS 10\nPZPROGRESS 20\nPZPROGRESS 100\n"))
+		}
+		return nil
+	}
+
+	// Tested code
+	err := execMock.worker.Exec(*execMock.workerConfig)
+
+	// Asserts
+	assert.Nil(t, err)
+
+	// the first update goes out, the next is throttled, and completion is always sent
+	assert.Len(t, execMock.sendExecProgressCalls, 2)
+	assert.Equal(t, "test-job", execMock.sendExecProgressCalls[0].jobID)
+	assert.Equal(t, 10, execMock.sendExecProgressCalls[0].progress.PercentComplete)
+	assert.Equal(t, 100, execMock.sendExecProgressCalls[1].progress.PercentComplete)
+	assert.Len(t, execMock.sendExecResultDataCalls, 1)
+	assert.Equal(t, pzsvc.PiazzaStatusSuccess, execMock.sendExecResultDataCalls[0].status)
+}
+
+func TestExec_WorkDir(t *testing.T) {
+	// Setup
+	execMock := execMockSetup()
+	execMock.workerConfig.Session.SubFold = "original"
+	var fetchWorkDir, ingestSubFold string
+	execMock.worker.fetchInputsFunc = func(cfg config.WorkerConfig, inputs []config.InputSource) error {
+		fetchWorkDir = cfg.WorkDir
+		return nil
+	}
+	execMock.worker.outputFilesToPiazzaFunc = func(cfg config.WorkerConfig, algFullCommand string, algVersion string) ingest.MultiIngestOutput {
+		ingestSubFold = cfg.Session.SubFold
+		return ingest.MultiIngestOutput{}
+	}
+
+	// Tested code
+	err := execMock.worker.Exec(*execMock.workerConfig)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Equal(t, "/test/workdir", fetchWorkDir)
+	assert.Equal(t, []string{"/test/workdir", "/test/workdir"}, execMock.commandRunnerDirs)
+	assert.Equal(t, "/test/workdir", ingestSubFold)
+	assert.Equal(t, "original", execMock.workerConfig.Session.SubFold) // the caller's session is left alone
+	assert.Equal(t, []string{"/test/workdir"}, execMock.removedWorkDirs)
+}
+
+func TestExec_ErrorWorkDir(t *testing.T) {
+	// Setup
+	execMock := execMockSetup()
+	execMock.worker.makeWorkDirFunc = func(cfg config.WorkerConfig) (string, error) {
+		return "", errors.New("test work dir error")
+	}
+
+	// Tested code
+	err := execMock.worker.Exec(*execMock.workerConfig)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Len(t, execMock.fetchInputsCalls, 0)
+	assert.Len(t, execMock.commandRunnerCalls, 0)
+	assert.Len(t, execMock.removedWorkDirs, 0)
+	assert.Len(t, execMock.sendExecResultDataCalls, 1)
+	assert.Equal(t, pzsvc.PiazzaStatusError, execMock.sendExecResultDataCalls[0].status)
+	assert.Contains(t, string(execMock.sendExecResultDataCalls[0].resultData), "test work dir error")
+}
+
+func TestExec_CliCmdTemplate(t *testing.T) {
+	// Setup
+	execMock := execMockSetup()
+	execMock.workerConfig.JobID = "job-1"
+	execMock.workerConfig.Inputs = []config.InputSource{config.InputSource{FileName: "image.tif", URL: "http://example.localdomain/image.tif"}}
+	execMock.workerConfig.PzSEConfig.CliCmd = `algo --in {{input "image.tif"}} --job {{jobID}}`
+
+	// Tested code
+	err := execMock.worker.Exec(*execMock.workerConfig)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Len(t, execMock.commandRunnerCalls, 2)
+	assert.Equal(t, "algo --in '/test/workdir/image.tif' --job 'job-1'", execMock.commandRunnerCalls[1][2])
+}
+
+func TestExec_ErrorCliCmdTemplate(t *testing.T) {
+	// Setup
+	execMock := execMockSetup()
+	execMock.workerConfig.PzSEConfig.CliCmd = `algo --in {{input "missing.tif"}}`
+
+	// Tested code
+	err := execMock.worker.Exec(*execMock.workerConfig)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Len(t, execMock.commandRunnerCalls, 1) // only the version command ran
+	assert.Len(t, execMock.sendExecResultDataCalls, 1)
+	assert.Equal(t, pzsvc.PiazzaStatusError, execMock.sendExecResultDataCalls[0].status)
+	assert.Contains(t, string(execMock.sendExecResultDataCalls[0].resultData), "missing.tif is not an input of this job")
+}
+
+func TestExec_Args(t *testing.T) {
+	// Setup
+	execMock := execMockSetup()
+	execMock.workerConfig.PzSEConfig.CliCmd = "algo"
+	execMock.workerConfig.PzSEConfig.Params = []pzsvc.ParamSpec{{Name: "image"}}
+	execMock.workerConfig.Args = []string{"in.tif; rm -rf /", "-b", "3"}
+
+	// Tested code
+	err := execMock.worker.Exec(*execMock.workerConfig)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Len(t, execMock.commandRunnerCalls, 2)
+	assert.Equal(t, "algo 'in.tif; rm -rf /' '-b' '3'", execMock.commandRunnerCalls[1][2])
+}
+
+func TestExec_ErrorCommandWithParams(t *testing.T) {
+	// Setup
+	execMock := execMockSetup()
+	execMock.workerConfig.PzSEConfig.CliCmd = "algo"
+	execMock.workerConfig.PzSEConfig.Params = []pzsvc.ParamSpec{{Name: "image"}}
+	execMock.workerConfig.CLICommandExtra = "; rm -rf /"
+
+	// Tested code
+	err := execMock.worker.Exec(*execMock.workerConfig)
+
+	// Asserts
+	assert.Nil(t, err)
+	assert.Len(t, execMock.commandRunnerCalls, 1) // only the version command ran
+	assert.Contains(t, string(execMock.sendExecResultDataCalls[0].resultData), "free-form command text is not permitted")
+	assert.Contains(t, string(execMock.sendExecResultDataCalls[0].resultData), `"HTTPStatus":400`)
+}